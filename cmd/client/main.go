@@ -49,6 +49,11 @@ func maybeDumpStack() {
 func LastErr() *C.char {
 	defer maybeDumpStack()
 
+	// NOTE(blukai): client may fail on its own (e.g. if it could not
+	// recover after reconnecting or if server rejected it)
+	if lastErr == nil && lc != nil {
+		lastErr = lc.Err()
+	}
 	if lastErr == nil {
 		return nil
 	}
@@ -62,7 +67,7 @@ func Connect(network, address *C.char) {
 
 	debug.Assert(lc == nil)
 
-	lobbyClient, err := lobbyclient.NewLobbyClient(C.GoString(network), C.GoString(address), nil)
+	lobbyClient, err := lobbyclient.NewLobbyClient(C.GoString(network), C.GoString(address), nil, nil)
 	if err != nil {
 		lastErr = err
 		return
@@ -81,14 +86,35 @@ func Connect(network, address *C.char) {
 	cancel = cancelFunc
 }
 
+// SendCCmdJoinRecvSCmdSetSeed takes player's metadata as two arrays of equal
+// length: keys and values.
+//
 //export SendCCmdJoinRecvSCmdSetSeed
-func SendCCmdJoinRecvSCmdSetSeed(id uint64) int32 {
+func SendCCmdJoinRecvSCmdSetSeed(
+	id uint64,
+	lobby *C.char,
+	name *C.char,
+	metadataKeys, metadataValues **C.char,
+	metadataLen int32,
+) int32 {
 	defer maybeDumpStack()
 
 	debug.Assert(lc != nil)
 	debug.Assert(lastErr == nil)
 
-	seed, err := lc.SendCCmdJoinRecvSCmdSetSeed(id)
+	info := lobbyclient.PlayerInfo{
+		Name:     C.GoString(name),
+		Metadata: make(map[string]string, metadataLen),
+	}
+	if metadataLen > 0 {
+		keys := unsafe.Slice(metadataKeys, metadataLen)
+		values := unsafe.Slice(metadataValues, metadataLen)
+		for i := range keys {
+			info.Metadata[C.GoString(keys[i])] = C.GoString(values[i])
+		}
+	}
+
+	seed, err := lc.SendCCmdJoinRecvSCmdSetSeed(id, C.GoString(lobby), info)
 	if err != nil {
 		lastErr = err
 		return 0
@@ -97,14 +123,142 @@ func SendCCmdJoinRecvSCmdSetSeed(id uint64) int32 {
 	return seed
 }
 
+// GetRunSetting returns nil if server did not define the setting.
+//
+//export GetRunSetting
+func GetRunSetting(key *C.char) *C.char {
+	defer maybeDumpStack()
+
+	debug.Assert(lc != nil)
+	debug.Assert(lastErr == nil)
+
+	value, ok := lc.RunSettings()[C.GoString(key)]
+	if !ok {
+		return nil
+	}
+
+	return C.CString(value)
+}
+
+// GetPlayerName returns nil if player is not known.
+//
+//export GetPlayerName
+func GetPlayerName(id uint64) *C.char {
+	defer maybeDumpStack()
+
+	debug.Assert(lc != nil)
+	debug.Assert(lastErr == nil)
+
+	info, ok := lc.PlayerInfo(id)
+	if !ok {
+		return nil
+	}
+
+	return C.CString(info.Name)
+}
+
+// GetPlayerMetadata returns nil if player is not known or if it did not define
+// the key.
+//
+//export GetPlayerMetadata
+func GetPlayerMetadata(id uint64, key *C.char) *C.char {
+	defer maybeDumpStack()
+
+	debug.Assert(lc != nil)
+	debug.Assert(lastErr == nil)
+
+	info, ok := lc.PlayerInfo(id)
+	if !ok {
+		return nil
+	}
+	value, ok := info.Metadata[C.GoString(key)]
+	if !ok {
+		return nil
+	}
+
+	return C.CString(value)
+}
+
+// SendCCmdTransformPlayer takes position in pixels and velocity in pixels per
+// second; facing is one of protocol.Facing... constants and animation is an id
+// defined by the mod.
+//
 //export SendCCmdTransformPlayer
-func SendCCmdTransformPlayer(id uint64, x int32, y int32) {
+func SendCCmdTransformPlayer(
+	id uint64,
+	x, y float32,
+	vx, vy float32,
+	facing int32,
+	animation int32,
+) {
 	defer maybeDumpStack()
 
 	debug.Assert(lc != nil)
 	debug.Assert(lastErr == nil)
 
-	lc.SendCCmdTransformPlayer(id, x, y)
+	lc.SendCCmdTransformPlayer(protocol.NetworkedTransformPlayer{
+		ID: protocol.NetworkedID(id),
+		Transform: protocol.NetworkedInt32Vector2{
+			X: protocol.ToFixedPoint(float64(x)),
+			Y: protocol.ToFixedPoint(float64(y)),
+		},
+		Velocity: protocol.NetworkedInt32Vector2{
+			X: protocol.ToFixedPoint(float64(vx)),
+			Y: protocol.ToFixedPoint(float64(vy)),
+		},
+		Facing:    protocol.NetworkedInt32(facing),
+		Animation: protocol.NetworkedInt32(animation),
+	})
+}
+
+// GetLatency writes latency estimates (see lobbyclient.Latency) in
+// milliseconds; it returns false (and writes nothing) if they are not known
+// yet.
+//
+//export GetLatency
+func GetLatency(rtt, jitter, clockOffset *C.float) bool {
+	defer maybeDumpStack()
+
+	debug.Assert(lc != nil)
+	debug.Assert(lastErr == nil)
+
+	latency, ok := lc.Latency()
+	if !ok {
+		return false
+	}
+
+	ms := func(d time.Duration) C.float {
+		return C.float(float64(d) / float64(time.Millisecond))
+	}
+	*rtt = ms(latency.RTT)
+	*jitter = ms(latency.Jitter)
+	*clockOffset = ms(latency.ClockOffset)
+	return true
+}
+
+// CPlayer is protocol.NetworkedTransformPlayer with fixed-point numbers
+// converted to floats.
+//
+// NOTE(blukai): fields are ordered (and sized) so that there's no padding;
+// alignment of 64 bit numbers differs between go and c on 32 bit windows.
+type CPlayer struct {
+	ID        uint64
+	X, Y      float32
+	VX, VY    float32
+	Facing    int32
+	Animation int32
+}
+
+func makeCPlayer(player *protocol.NetworkedTransformPlayer) CPlayer {
+	return CPlayer{
+		ID:        uint64(player.ID),
+		X:         float32(protocol.FromFixedPoint(player.Transform.X)),
+		Y:         float32(protocol.FromFixedPoint(player.Transform.Y)),
+		VX:        float32(protocol.FromFixedPoint(player.Velocity.X)),
+		VY:        float32(protocol.FromFixedPoint(player.Velocity.Y)),
+		Facing:    int32(player.Facing),
+		Animation: int32(player.Animation),
+	}
 }
 
 type CIter struct {
@@ -145,15 +299,37 @@ func IterFree(iterPtr unsafe.Pointer) {
 	C.free(iterPtr)
 }
 
-//export GetNextPlayerInIter
-func GetNextPlayerInIter(iterPtr unsafe.Pointer) unsafe.Pointer {
-	defer maybeDumpStack()
+// newCIter copies items into malloc'ed memory and returns a pointer to malloc'ed
+// CIter. both must be freed with IterFree.
+//
+// NOTE(blukai): it seems like the only way to return some non-owned (possibly
+// non-primitive) data to lua is to malloc memory and put the value there
+func newCIter[T any](items []T) unsafe.Pointer {
+	itemSize := unsafe.Sizeof(*new(T))
+
+	itemsPtr := C.malloc(C.size_t(len(items) * int(itemSize)))
+	for i, item := range items {
+		itemPtr := unsafe.Add(itemsPtr, i*int(itemSize))
+		*(*T)(itemPtr) = item
+	}
+
+	iterPtr := C.malloc(C.size_t(unsafe.Sizeof(CIter{})))
+	*(*CIter)(iterPtr) = CIter{
+		itemsPtr: itemsPtr,
+		len:      len(items),
+		pos:      0,
+	}
+	return iterPtr
+}
 
+// nextInCIter returns a pointer to the next item of type T or nil if iter is
+// exhausted.
+func nextInCIter[T any](iterPtr unsafe.Pointer) unsafe.Pointer {
 	debug.Assert(iterPtr != nil)
 
 	iter := (*CIter)(iterPtr)
 	if iter.len > iter.pos {
-		itemSize := unsafe.Sizeof(protocol.NetworkedTransformPlayer{})
+		itemSize := unsafe.Sizeof(*new(T))
 		itemPtr := unsafe.Add(iter.itemsPtr, iter.pos*int(itemSize))
 
 		iter.pos += 1
@@ -164,6 +340,17 @@ func GetNextPlayerInIter(iterPtr unsafe.Pointer) unsafe.Pointer {
 	return nil
 }
 
+//export GetNextPlayerInIter
+func GetNextPlayerInIter(iterPtr unsafe.Pointer) unsafe.Pointer {
+	defer maybeDumpStack()
+
+	return nextInCIter[CPlayer](iterPtr)
+}
+
+// GetPlayerIter returns all known players as they should be drawn right now;
+// positions are smoothed (see LobbyClient.GetInterpolatedPlayers), so it is
+// meant to be called every frame.
+//
 //export GetPlayerIter
 func GetPlayerIter() unsafe.Pointer {
 	defer maybeDumpStack()
@@ -171,41 +358,140 @@ func GetPlayerIter() unsafe.Pointer {
 	debug.Assert(lc != nil)
 	debug.Assert(lastErr == nil)
 
-	players := lc.GetPlayers()
+	players := lc.GetInterpolatedPlayers(time.Now())
 
 	// NOTE(blukai): this is useful to fake player for local testing
-	// players = []*protocol.NetworkedTransformPlayer{
+	// players = []protocol.NetworkedTransformPlayer{
 	// 	{
 	// 		ID: 42,
 	// 		Transform: protocol.NetworkedInt32Vector2{
-	// 			X: protocol.NetworkedInt32(rand.Intn(245-235+1) + 235),
-	// 			Y: protocol.NetworkedInt32(rand.Int31n(275-265) - 256),
+	// 			X: protocol.ToFixedPoint(float64(rand.Intn(245-235+1) + 235)),
+	// 			Y: protocol.ToFixedPoint(float64(rand.Int31n(275-265) - 256)),
 	// 		},
 	// 	},
 	// }
 
-	// NOTE(blukai): it seems like the only way to return some non-owned
-	// (possibly non-primitive) data to lua is to malloc memory and put the
-	// value there
+	items := make([]CPlayer, len(players))
+	for i := range players {
+		items[i] = makeCPlayer(&players[i])
+	}
+	return newCIter(items)
+}
+
+// CDeltaPlayer is an item of delta player iter. if Despawned is true, only
+// Player.ID is meaningful.
+type CDeltaPlayer struct {
+	Player    CPlayer
+	Despawned bool
+	// NOTE(blukai): c pads the struct to the alignment of CPlayer.ID (8),
+	// go on 32 bit platforms does not.
+	_ [7]byte
+}
 
-	itemSize := unsafe.Sizeof(protocol.NetworkedTransformPlayer{})
+//export GetNextDeltaPlayerInIter
+func GetNextDeltaPlayerInIter(iterPtr unsafe.Pointer) unsafe.Pointer {
+	defer maybeDumpStack()
 
-	itemsPtr := C.malloc(C.size_t(len(players) * int(itemSize)))
-	for i, item := range players {
-		itemPtr := unsafe.Add(itemsPtr, i*int(itemSize))
-		*(*protocol.NetworkedTransformPlayer)(itemPtr) = *item
+	return nextInCIter[CDeltaPlayer](iterPtr)
+}
+
+// GetDeltaPlayerIter returns players that moved and players that left since the
+// previous call. despawned players come first.
+//
+//export GetDeltaPlayerIter
+func GetDeltaPlayerIter() unsafe.Pointer {
+	defer maybeDumpStack()
+
+	debug.Assert(lc != nil)
+	debug.Assert(lastErr == nil)
+
+	changed, despawned := lc.GetDeltaPlayers()
+
+	items := make([]CDeltaPlayer, 0, len(despawned)+len(changed))
+	for _, id := range despawned {
+		items = append(items, CDeltaPlayer{
+			Player:    CPlayer{ID: uint64(id)},
+			Despawned: true,
+		})
+	}
+	for _, player := range changed {
+		items = append(items, CDeltaPlayer{Player: makeCPlayer(player)})
 	}
+	return newCIter(items)
+}
 
-	iterPtr := C.malloc(C.size_t(unsafe.Sizeof(CIter{})))
-	*(*CIter)(iterPtr) = CIter{
-		itemsPtr: itemsPtr,
-		len:      len(players),
-		pos:      0,
+// SendCCmdChat returns nil if message was sent; otherwise it returns the reason
+// why it was not (e.g. client sends messages too fast). unlike other errors
+// these are not fatal.
+//
+//export SendCCmdChat
+func SendCCmdChat(kind int32, text *C.char) *C.char {
+	defer maybeDumpStack()
+
+	debug.Assert(lc != nil)
+	debug.Assert(lastErr == nil)
+
+	if err := lc.SendCCmdChat(uint64(kind), C.GoString(text)); err != nil {
+		return C.CString(err.Error())
 	}
-	return iterPtr
+	return nil
+}
+
+// CChatMessage is protocol.NetworkedChat with text copied into a fixed size
+// array; text is not null terminated, Len is its length in bytes.
+type CChatMessage struct {
+	ID   uint64
+	Kind int32
+	Len  int32
+	Text [protocol.ChatTextMaxLen]byte
+}
+
+//export GetNextChatMessageInIter
+func GetNextChatMessageInIter(iterPtr unsafe.Pointer) unsafe.Pointer {
+	defer maybeDumpStack()
+
+	return nextInCIter[CChatMessage](iterPtr)
 }
 
-// TODO: how can mod issue a disconnect when game is finished, etc?
+// GetChatIter returns chat messages received since the previous call.
+//
+//export GetChatIter
+func GetChatIter() unsafe.Pointer {
+	defer maybeDumpStack()
+
+	debug.Assert(lc != nil)
+	debug.Assert(lastErr == nil)
+
+	chat := lc.GetChatMessages()
+
+	items := make([]CChatMessage, len(chat))
+	for i, message := range chat {
+		item := &items[i]
+		item.ID = uint64(message.ID)
+		item.Kind = int32(message.Kind)
+		item.Len = int32(copy(item.Text[:], message.Text))
+	}
+	return newCIter(items)
+}
+
+// Disconnect leaves the lobby and stops the client; Connect may be called
+// again afterwards. it is safe to call Disconnect if client is not connected.
+//
+//export Disconnect
+func Disconnect() {
+	defer maybeDumpStack()
+
+	if lc != nil {
+		// NOTE(blukai): leaving is a courtesy; server evicts the player
+		// eventually anyway.
+		_ = lc.Leave()
+		cancel()
+	}
+
+	lc = nil
+	cancel = nil
+	lastErr = nil
+}
 
 func main() {
 	// Connect(C.CString("udp4"), C.CString("127.0.0.1:5000"))
@@ -2,19 +2,77 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"net"
+	"net/http"
 	"os"
 	"os/signal"
 	"sync"
 	"syscall"
+	"time"
 
+	"github.com/blukai/noitaparty/internal/lobbyadmin"
 	"github.com/blukai/noitaparty/internal/lobbyserver"
 	"github.com/kelseyhightower/envconfig"
 	"github.com/phuslu/log"
 )
 
 type Config struct {
-	LobbyServerAddr4 string `encvonfig:"LOBBY_SERVER_ADDR4" required:"true" default:"0.0.0.0:5000"`
+	// LobbyServerAddr4 and LobbyServerAddr6 are the addresses server
+	// listens on; either may be set to an empty string to not listen on
+	// that address family, but not both.
+	LobbyServerAddr4 string `envconfig:"LOBBY_SERVER_ADDR4" default:"0.0.0.0:5000"`
+	LobbyServerAddr6 string `envconfig:"LOBBY_SERVER_ADDR6" default:"[::]:5000"`
+
+	// LobbySeed, if set, is given to every new lobby instead of a random
+	// one.
+	LobbySeed *int32 `envconfig:"LOBBY_SEED"`
+	// LobbyPinnedSeeds pins seeds of specific lobbies (e.g.
+	// "party:42,friday:1337"); pinned lobbies are never destroyed.
+	LobbyPinnedSeeds map[string]int32 `envconfig:"LOBBY_PINNED_SEEDS"`
+	// LobbyRetention is how long an empty lobby keeps its seed.
+	LobbyRetention time.Duration `envconfig:"LOBBY_RETENTION" default:"5m"`
+	// LobbyRunSettings are sent to the mod together with the seed (e.g.
+	// "mode:nightmare").
+	LobbyRunSettings map[string]string `envconfig:"LOBBY_RUN_SETTINGS"`
+
+	// InterestRadius is the distance (in pixels) within which players
+	// see each other move at full rate; 0 disables filtering.
+	InterestRadius float64 `envconfig:"INTEREST_RADIUS" default:"1024"`
+	// InterestFarInterval is how often players outside of InterestRadius
+	// are sent.
+	InterestFarInterval time.Duration `envconfig:"INTEREST_FAR_INTERVAL" default:"1s"`
+
+	// NOTE(blukai): options that are not set take values of
+	// lobbyserver.DefaultOptions.
+
+	// TickInterval determines how often player snapshots are sent out
+	// (e.g. "50ms").
+	TickInterval time.Duration `envconfig:"TICK_INTERVAL"`
+	// RefreshInterval determines how often players that stand still are
+	// sent (e.g. "1s").
+	RefreshInterval time.Duration `envconfig:"REFRESH_INTERVAL"`
+	// EvictionTimeout is how long client may stay silent before it is
+	// evicted.
+	EvictionTimeout time.Duration `envconfig:"EVICTION_TIMEOUT"`
+	// EvictorInterval determines how often silent clients are looked for.
+	EvictorInterval time.Duration `envconfig:"EVICTOR_INTERVAL"`
+	// ReadTimeout is how long a read from the socket blocks.
+	ReadTimeout time.Duration `envconfig:"READ_TIMEOUT"`
+	// CmdMaxSize is the max size (in bytes) of a received cmd.
+	CmdMaxSize int `envconfig:"CMD_MAX_SIZE"`
+
+	// BannedPlayers are ids of players that are not allowed to join (e.g.
+	// "1337,42"); more may be banned via admin api.
+	BannedPlayers []uint64 `envconfig:"BANNED_PLAYERS"`
+
+	// AdminAddr, if set, is the address of admin http api (see
+	// lobbyadmin.Handler); it serves metrics too. don't expose it publicly
+	// without AdminToken.
+	AdminAddr string `envconfig:"ADMIN_ADDR"`
+	// AdminToken, if set, must be sent as a bearer token to admin api.
+	AdminToken string `envconfig:"ADMIN_TOKEN"`
 }
 
 func loadConfig() (*Config, error) {
@@ -48,11 +106,82 @@ func erringMain() error {
 
 	logger := configureLogger()
 
-	lobbyServer, err := lobbyserver.NewLobbyServer("udp4", config.LobbyServerAddr4, logger)
+	// NOTE(blukai): udp6 sockets only accept ipv6 (see IPV6_V6ONLY), both
+	// may listen on the same port.
+	type listener struct {
+		network string
+		address string
+	}
+	var listeners []listener
+	if config.LobbyServerAddr4 != "" {
+		listeners = append(listeners, listener{"udp4", config.LobbyServerAddr4})
+	}
+	if config.LobbyServerAddr6 != "" {
+		listeners = append(listeners, listener{"udp6", config.LobbyServerAddr6})
+	}
+	if len(listeners) == 0 {
+		return errors.New("nothing to listen on: both LOBBY_SERVER_ADDR4 and LOBBY_SERVER_ADDR6 are empty")
+	}
+
+	lobbyServer, err := lobbyserver.NewLobbyServer(listeners[0].network, listeners[0].address, logger, &lobbyserver.Options{
+		TickInterval:    config.TickInterval,
+		RefreshInterval: config.RefreshInterval,
+		EvictionTimeout: config.EvictionTimeout,
+		EvictorInterval: config.EvictorInterval,
+		ReadTimeout:     config.ReadTimeout,
+		CmdMaxSize:      config.CmdMaxSize,
+	})
 	if err != nil {
 		return fmt.Errorf("could not construct lobby server: %w", err)
 	}
-	logger.Info().Msgf("started lobby server on %s", config.LobbyServerAddr4)
+	for _, l := range listeners[1:] {
+		if err := lobbyServer.Listen(l.network, l.address); err != nil {
+			return fmt.Errorf("could not listen on %s: %w", l.address, err)
+		}
+	}
+
+	err = lobbyServer.SetLobbyConfig(lobbyserver.LobbyConfig{
+		Seed:        config.LobbySeed,
+		Retention:   config.LobbyRetention,
+		RunSettings: config.LobbyRunSettings,
+	})
+	if err != nil {
+		return fmt.Errorf("could not configure lobbies: %w", err)
+	}
+	err = lobbyServer.SetInterestConfig(lobbyserver.InterestConfig{
+		Radius:      config.InterestRadius,
+		FarInterval: config.InterestFarInterval,
+	})
+	if err != nil {
+		return fmt.Errorf("could not configure interest management: %w", err)
+	}
+	for lobby, seed := range config.LobbyPinnedSeeds {
+		if err := lobbyServer.PinLobbySeed(lobby, seed); err != nil {
+			return fmt.Errorf("could not pin seed of lobby %q: %w", lobby, err)
+		}
+	}
+
+	for _, id := range config.BannedPlayers {
+		lobbyServer.BanPlayer(id)
+	}
+
+	for _, addr := range lobbyServer.Addrs() {
+		logger.Info().Msgf("started lobby server on %s", addr)
+	}
+
+	var adminServer *http.Server
+	var adminListener net.Listener
+	if config.AdminAddr != "" {
+		adminListener, err = net.Listen("tcp", config.AdminAddr)
+		if err != nil {
+			return fmt.Errorf("could not listen admin api: %w", err)
+		}
+		adminServer = &http.Server{
+			Handler:           lobbyadmin.NewHandler(lobbyServer, config.AdminToken),
+			ReadHeaderTimeout: time.Second * 10,
+		}
+		logger.Info().Msgf("started admin api on %s", adminListener.Addr())
+	}
 
 	wg := new(sync.WaitGroup)
 	ctx, cancel := context.WithCancel(context.Background())
@@ -64,6 +193,18 @@ func erringMain() error {
 		lobbyServerRunErr = lobbyServer.Run(ctx)
 	}()
 
+	var adminServerErr error
+	if adminServer != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := adminServer.Serve(adminListener)
+			if !errors.Is(err, http.ErrServerClosed) {
+				adminServerErr = err
+			}
+		}()
+	}
+
 	signalChan := make(chan os.Signal, 1)
 	signal.Notify(signalChan, syscall.SIGTERM, syscall.SIGINT)
 
@@ -73,9 +214,19 @@ func erringMain() error {
 	}
 
 	cancel()
+	if adminServer != nil {
+		shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), time.Second*5)
+		defer shutdownCancel()
+		if err := adminServer.Shutdown(shutdownCtx); err != nil {
+			logger.Error().Msgf("could not shut admin api down: %v", err)
+		}
+	}
 	wg.Wait()
 	if lobbyServerRunErr != nil {
-		return fmt.Errorf("lobby server run failed: %w", err)
+		return fmt.Errorf("lobby server run failed: %w", lobbyServerRunErr)
+	}
+	if adminServerErr != nil {
+		return fmt.Errorf("admin api failed: %w", adminServerErr)
 	}
 
 	return nil
@@ -0,0 +1,173 @@
+package interpolation
+
+import (
+	"math"
+	"sort"
+	"time"
+
+	"github.com/blukai/noitaparty/internal/protocol"
+)
+
+// NOTE(blukai): remote players are drawn slightly in the past (see Delay); that
+// way there are usually two known states around the render time and player can
+// be moved smoothly between them regardless of how unevenly packets arrive. if
+// packets are late, player keeps moving with its last known velocity for a bit
+// (dead reckoning).
+
+const (
+	// Delay is how far in the past remote players are drawn (see
+	// protocol.InterpolationDelay).
+	Delay = protocol.InterpolationDelay
+	// MaxExtrapolation limits how far player is moved past its last known
+	// state when packets are late.
+	MaxExtrapolation = time.Millisecond * 250
+	// BufferLen is the max amount of states kept per player; older states
+	// are dropped.
+	BufferLen = 32
+	// clockDriftDivisor controls how fast Clock adapts to increased delays
+	// (see Clock.Observe).
+	clockDriftDivisor = 32
+)
+
+// Clock maps local time onto server's time. Clock is not safe for concurrent
+// use.
+type Clock struct {
+	// origin is local time that corresponds to server's time 0.
+	origin time.Time
+	// measured is set by Sync; measured clock ignores Observe.
+	measured bool
+}
+
+// Observe adjusts clock using server's time of a packet that was received at
+// local time recvAt. it is a fallback for when round trip time is not known
+// yet (see Sync).
+//
+// NOTE(blukai): packets that took the least time to arrive describe the clock
+// the best; those are adopted immediately. packets that arrive later than
+// expected only move the clock slightly, that compensates for clock drift
+// without reacting to every delayed packet.
+func (c *Clock) Observe(serverTime time.Duration, recvAt time.Time) {
+	if c.measured {
+		return
+	}
+
+	origin := recvAt.Add(-serverTime)
+	switch {
+	case c.origin.IsZero() || origin.Before(c.origin):
+		c.origin = origin
+	default:
+		c.origin = c.origin.Add(origin.Sub(c.origin) / clockDriftDivisor)
+	}
+}
+
+// Sync sets clock using a round trip to the server: serverTime was taken by
+// the server about half of rtt before recvAt. unlike Observe it accounts for
+// the time packets spend in flight.
+func (c *Clock) Sync(serverTime time.Duration, rtt time.Duration, recvAt time.Time) {
+	c.origin = recvAt.Add(-serverTime - rtt/2)
+	c.measured = true
+}
+
+// Synced reports whether clock observed anything since it was reset.
+func (c *Clock) Synced() bool {
+	return !c.origin.IsZero()
+}
+
+// ServerTime returns server's time at local time now.
+func (c *Clock) ServerTime(now time.Time) time.Duration {
+	return now.Sub(c.origin)
+}
+
+func (c *Clock) Reset() {
+	c.origin = time.Time{}
+	c.measured = false
+}
+
+type sample struct {
+	at     time.Duration
+	player protocol.NetworkedTransformPlayer
+}
+
+// Buffer holds timestamped states of a single player. Buffer is not safe for
+// concurrent use.
+type Buffer struct {
+	// samples are ordered by time.
+	samples []sample
+}
+
+// Push adds player's state at server's time at. states may be pushed out of
+// order.
+func (b *Buffer) Push(at time.Duration, player protocol.NetworkedTransformPlayer) {
+	i := sort.Search(len(b.samples), func(i int) bool {
+		return b.samples[i].at >= at
+	})
+	switch {
+	case i < len(b.samples) && b.samples[i].at == at:
+		b.samples[i].player = player
+		return
+	case i == 0 && len(b.samples) == BufferLen:
+		// older than anything else in a full buffer
+		return
+	}
+
+	b.samples = append(b.samples, sample{})
+	copy(b.samples[i+1:], b.samples[i:])
+	b.samples[i] = sample{at: at, player: player}
+
+	if len(b.samples) > BufferLen {
+		b.samples = b.samples[len(b.samples)-BufferLen:]
+	}
+}
+
+// At returns player's state at server's time at. ok is false if buffer is
+// empty.
+func (b *Buffer) At(at time.Duration) (player protocol.NetworkedTransformPlayer, ok bool) {
+	if len(b.samples) == 0 {
+		return player, false
+	}
+
+	first := b.samples[0]
+	if at <= first.at {
+		return first.player, true
+	}
+
+	last := b.samples[len(b.samples)-1]
+	if at >= last.at {
+		return extrapolate(last.player, min(at-last.at, MaxExtrapolation)), true
+	}
+
+	i := sort.Search(len(b.samples), func(i int) bool {
+		return b.samples[i].at > at
+	})
+	prev, next := b.samples[i-1], b.samples[i]
+	t := float64(at-prev.at) / float64(next.at-prev.at)
+	return interpolate(prev.player, next.player, t), true
+}
+
+func (b *Buffer) Reset() {
+	b.samples = b.samples[:0]
+}
+
+func lerp(a, b protocol.NetworkedInt32, t float64) protocol.NetworkedInt32 {
+	return a + protocol.NetworkedInt32(math.Round(float64(b-a)*t))
+}
+
+// interpolate returns state between prev and next; t is in [0, 1).
+func interpolate(prev, next protocol.NetworkedTransformPlayer, t float64) protocol.NetworkedTransformPlayer {
+	// NOTE(blukai): facing and animation can't be blended; they change
+	// once next state is reached.
+	player := prev
+	player.Transform.X = lerp(prev.Transform.X, next.Transform.X, t)
+	player.Transform.Y = lerp(prev.Transform.Y, next.Transform.Y, t)
+	player.Velocity.X = lerp(prev.Velocity.X, next.Velocity.X, t)
+	player.Velocity.Y = lerp(prev.Velocity.Y, next.Velocity.Y, t)
+	return player
+}
+
+// extrapolate moves player along its velocity for duration d.
+func extrapolate(player protocol.NetworkedTransformPlayer, d time.Duration) protocol.NetworkedTransformPlayer {
+	seconds := d.Seconds()
+	player.Transform.X += protocol.NetworkedInt32(math.Round(float64(player.Velocity.X) * seconds))
+	player.Transform.Y += protocol.NetworkedInt32(math.Round(float64(player.Velocity.Y) * seconds))
+	return player
+}
@@ -0,0 +1,145 @@
+package interpolation_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/blukai/noitaparty/internal/interpolation"
+	"github.com/blukai/noitaparty/internal/protocol"
+	"github.com/matryer/is"
+)
+
+func makePlayer(x, y, vx, vy float64) protocol.NetworkedTransformPlayer {
+	return protocol.NetworkedTransformPlayer{
+		ID: 42,
+		Transform: protocol.NetworkedInt32Vector2{
+			X: protocol.ToFixedPoint(x),
+			Y: protocol.ToFixedPoint(y),
+		},
+		Velocity: protocol.NetworkedInt32Vector2{
+			X: protocol.ToFixedPoint(vx),
+			Y: protocol.ToFixedPoint(vy),
+		},
+	}
+}
+
+func TestInterpolate(t *testing.T) {
+	is := is.New(t)
+
+	buf := interpolation.Buffer{}
+	_, ok := buf.At(0)
+	is.True(!ok)
+
+	buf.Push(time.Millisecond*100, makePlayer(0, 0, 0, 0))
+	buf.Push(time.Millisecond*200, makePlayer(10, -10, 0, 0))
+
+	testCases := []struct {
+		at   time.Duration
+		x, y float64
+	}{
+		// before the first known state player stays in place
+		{time.Millisecond * 50, 0, 0},
+		{time.Millisecond * 100, 0, 0},
+		{time.Millisecond * 125, 2.5, -2.5},
+		{time.Millisecond * 150, 5, -5},
+		{time.Millisecond * 200, 10, -10},
+	}
+
+	for _, tc := range testCases {
+		player, ok := buf.At(tc.at)
+		is.True(ok)
+		is.Equal(protocol.FromFixedPoint(player.Transform.X), tc.x)
+		is.Equal(protocol.FromFixedPoint(player.Transform.Y), tc.y)
+	}
+}
+
+func TestExtrapolate(t *testing.T) {
+	is := is.New(t)
+
+	buf := interpolation.Buffer{}
+	buf.Push(time.Millisecond*100, makePlayer(0, 0, 100, -40))
+
+	player, ok := buf.At(time.Millisecond * 200)
+	is.True(ok)
+	is.Equal(protocol.FromFixedPoint(player.Transform.X), 10.0)
+	is.Equal(protocol.FromFixedPoint(player.Transform.Y), -4.0)
+
+	// player does not run away forever if packets stopped coming
+
+	player, ok = buf.At(time.Hour)
+	is.True(ok)
+	is.Equal(protocol.FromFixedPoint(player.Transform.X), 100*interpolation.MaxExtrapolation.Seconds())
+}
+
+func TestPushOutOfOrder(t *testing.T) {
+	is := is.New(t)
+
+	buf := interpolation.Buffer{}
+	buf.Push(time.Millisecond*200, makePlayer(10, 0, 0, 0))
+	buf.Push(time.Millisecond*100, makePlayer(0, 0, 0, 0))
+
+	player, ok := buf.At(time.Millisecond * 150)
+	is.True(ok)
+	is.Equal(protocol.FromFixedPoint(player.Transform.X), 5.0)
+
+	// full buffer keeps the latest states
+
+	for i := range interpolation.BufferLen {
+		buf.Push(time.Second+time.Duration(i)*time.Millisecond, makePlayer(float64(i), 0, 0, 0))
+	}
+	buf.Push(0, makePlayer(-1, 0, 0, 0))
+
+	player, ok = buf.At(0)
+	is.True(ok)
+	is.Equal(protocol.FromFixedPoint(player.Transform.X), 0.0)
+}
+
+func TestClock(t *testing.T) {
+	is := is.New(t)
+
+	clock := interpolation.Clock{}
+	is.True(!clock.Synced())
+
+	now := time.Now()
+	clock.Observe(time.Second, now)
+	is.True(clock.Synced())
+	is.Equal(clock.ServerTime(now), time.Second)
+
+	// packet that arrived faster than the previous one is adopted
+
+	clock.Observe(time.Second*2, now.Add(time.Second-time.Millisecond*10))
+	is.Equal(clock.ServerTime(now), time.Second+time.Millisecond*10)
+
+	// delayed packet barely moves the clock
+
+	clock.Observe(time.Second*3, now.Add(time.Second*2))
+	is.True(clock.ServerTime(now) > time.Second)
+	is.True(clock.ServerTime(now) <= time.Second+time.Millisecond*10)
+
+	clock.Reset()
+	is.True(!clock.Synced())
+}
+
+func TestClockSync(t *testing.T) {
+	is := is.New(t)
+
+	clock := interpolation.Clock{}
+	now := time.Now()
+
+	// server's time was taken half way through the round trip
+
+	clock.Sync(time.Second, time.Millisecond*100, now)
+	is.True(clock.Synced())
+	is.Equal(clock.ServerTime(now), time.Second+time.Millisecond*50)
+
+	// synced clock is not affected by one way observations
+
+	clock.Observe(time.Second*2, now)
+	is.Equal(clock.ServerTime(now), time.Second+time.Millisecond*50)
+
+	// until it is reset
+
+	clock.Reset()
+	clock.Observe(time.Second*2, now)
+	is.Equal(clock.ServerTime(now), time.Second*2)
+}
@@ -0,0 +1,200 @@
+package lobbyadmin
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/blukai/noitaparty/internal/lobbyserver"
+)
+
+// Handler serves lobby server's admin http api:
+//
+//	GET  /healthz             - 200 while process is alive
+//	GET  /readyz              - 200 while lobby server is running, 503 otherwise
+//	GET  /metrics             - lobby server's metrics in prometheus format
+//	GET  /lobbies             - lobbies and their clients
+//	POST /kick?lobby=&id=     - kick player out of the lobby
+//	GET  /bans                - ids of banned players
+//	POST /ban?id=             - kick player out of every lobby and ban it
+//	POST /unban?id=           - unban player
+//	POST /seed?lobby=[&seed=] - set lobby's seed; random if seed is omitted
+//
+// parameters may be sent either in the query or in a form encoded body. lobby
+// parameter may be empty (which is the default lobby), but must be present.
+type Handler struct {
+	ls *lobbyserver.LobbyServer
+	// token, if not empty, must be sent as a bearer token to everything
+	// but probes and metrics.
+	token string
+	mux   *http.ServeMux
+}
+
+func NewHandler(ls *lobbyserver.LobbyServer, token string) *Handler {
+	h := &Handler{
+		ls:    ls,
+		token: token,
+		mux:   http.NewServeMux(),
+	}
+
+	// NOTE(blukai): probes and metrics are meant for orchestrators and
+	// scrapers, they don't expose anything sensitive and don't need a
+	// token.
+	h.mux.HandleFunc("GET /healthz", h.handleHealthz)
+	h.mux.HandleFunc("GET /readyz", h.handleReadyz)
+	h.mux.Handle("GET /metrics", ls.Metrics())
+
+	h.mux.HandleFunc("GET /lobbies", h.authorized(h.handleLobbies))
+	h.mux.HandleFunc("POST /kick", h.authorized(h.handleKick))
+	h.mux.HandleFunc("GET /bans", h.authorized(h.handleBans))
+	h.mux.HandleFunc("POST /ban", h.authorized(h.handleBan))
+	h.mux.HandleFunc("POST /unban", h.authorized(h.handleUnban))
+	h.mux.HandleFunc("POST /seed", h.authorized(h.handleSeed))
+
+	return h
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mux.ServeHTTP(w, r)
+}
+
+func (h *Handler) authorized(next http.HandlerFunc) http.HandlerFunc {
+	want := []byte("Bearer " + h.token)
+	return func(w http.ResponseWriter, r *http.Request) {
+		got := []byte(r.Header.Get("Authorization"))
+		if h.token != "" && subtle.ConstantTimeCompare(got, want) != 1 {
+			writeError(w, http.StatusUnauthorized, errors.New("invalid token"))
+			return
+		}
+		next(w, r)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, value any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	// NOTE(blukai): nothing can be done if client went away
+	_ = json.NewEncoder(w).Encode(value)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+// writeServerError maps errors returned by lobby server to http statuses.
+func writeServerError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	if errors.Is(err, lobbyserver.ErrLobbyNotFound) || errors.Is(err, lobbyserver.ErrPlayerNotFound) {
+		status = http.StatusNotFound
+	}
+	writeError(w, status, err)
+}
+
+func lobbyParam(r *http.Request) (string, error) {
+	if err := r.ParseForm(); err != nil {
+		return "", err
+	}
+	if !r.Form.Has("lobby") {
+		return "", errors.New("missing lobby")
+	}
+	return r.Form.Get("lobby"), nil
+}
+
+func idParam(r *http.Request) (uint64, error) {
+	id, err := strconv.ParseUint(r.FormValue("id"), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid id: %w", err)
+	}
+	return id, nil
+}
+
+func (h *Handler) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+func (h *Handler) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	if !h.ls.Ready() {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"status": "not ready"})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ready"})
+}
+
+func (h *Handler) handleLobbies(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, h.ls.Lobbies())
+}
+
+func (h *Handler) handleKick(w http.ResponseWriter, r *http.Request) {
+	lobby, err := lobbyParam(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	id, err := idParam(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if err := h.ls.KickPlayer(lobby, id); err != nil {
+		writeServerError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *Handler) handleBans(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, h.ls.Bans())
+}
+
+func (h *Handler) handleBan(w http.ResponseWriter, r *http.Request) {
+	id, err := idParam(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	h.ls.BanPlayer(id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *Handler) handleUnban(w http.ResponseWriter, r *http.Request) {
+	id, err := idParam(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	h.ls.UnbanPlayer(id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *Handler) handleSeed(w http.ResponseWriter, r *http.Request) {
+	lobby, err := lobbyParam(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	var seed int32
+	if !r.Form.Has("seed") {
+		seed, err = h.ls.RotateLobbySeed(lobby)
+	} else {
+		var parsed int64
+		parsed, err = strconv.ParseInt(r.Form.Get("seed"), 10, 32)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid seed: %w", err))
+			return
+		}
+		seed = int32(parsed)
+		err = h.ls.SetLobbySeed(lobby, seed)
+	}
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]int32{"seed": seed})
+}
@@ -0,0 +1,197 @@
+package lobbyadmin_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/blukai/noitaparty/internal/lobbyadmin"
+	"github.com/blukai/noitaparty/internal/lobbyclient"
+	"github.com/blukai/noitaparty/internal/lobbyserver"
+	"github.com/blukai/noitaparty/internal/protocol"
+	"github.com/matryer/is"
+)
+
+func request(t *testing.T, handler http.Handler, method, path string, params url.Values) *httptest.ResponseRecorder {
+	t.Helper()
+
+	r := httptest.NewRequest(method, path+"?"+params.Encode(), nil)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	return w
+}
+
+// waitFor polls cond until it returns true; the test fails if that does not
+// happen within a second.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestProbes(t *testing.T) {
+	is := is.New(t)
+
+	ls, err := lobbyserver.NewLobbyServer("udp4", ":0", nil, nil)
+	is.NoErr(err)
+	handler := lobbyadmin.NewHandler(ls, "secret")
+
+	// probes don't need a token
+	is.Equal(request(t, handler, "GET", "/healthz", nil).Code, http.StatusOK)
+	is.Equal(request(t, handler, "GET", "/readyz", nil).Code, http.StatusServiceUnavailable) // server is not running yet
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ls.Run(ctx)
+	}()
+
+	waitFor(t, "server to be ready", func() bool {
+		return request(t, handler, "GET", "/readyz", nil).Code == http.StatusOK
+	})
+
+	cancel()
+	<-done
+	is.Equal(request(t, handler, "GET", "/readyz", nil).Code, http.StatusServiceUnavailable)
+}
+
+func TestAuthorization(t *testing.T) {
+	is := is.New(t)
+
+	ls, err := lobbyserver.NewLobbyServer("udp4", ":0", nil, nil)
+	is.NoErr(err)
+	handler := lobbyadmin.NewHandler(ls, "secret")
+
+	is.Equal(request(t, handler, "GET", "/lobbies", nil).Code, http.StatusUnauthorized)
+
+	r := httptest.NewRequest("GET", "/lobbies", nil)
+	r.Header.Set("Authorization", "Bearer wrong")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	is.Equal(w.Code, http.StatusUnauthorized)
+
+	r = httptest.NewRequest("GET", "/lobbies", nil)
+	r.Header.Set("Authorization", "Bearer secret")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	is.Equal(w.Code, http.StatusOK)
+}
+
+func TestAdmin(t *testing.T) {
+	is := is.New(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ls, err := lobbyserver.NewLobbyServer("udp4", ":0", nil, nil)
+	is.NoErr(err)
+	go ls.Run(ctx)
+	handler := lobbyadmin.NewHandler(ls, "")
+
+	playerOneClient, err := lobbyclient.NewLobbyClient("udp4", ls.Addr().String(), nil, nil)
+	is.NoErr(err)
+	go playerOneClient.Run(ctx)
+
+	playerTwoClient, err := lobbyclient.NewLobbyClient("udp4", ls.Addr().String(), nil, nil)
+	is.NoErr(err)
+	go playerTwoClient.Run(ctx)
+
+	_, err = playerOneClient.SendCCmdJoinRecvSCmdSetSeed(1, "party", lobbyclient.PlayerInfo{Name: "one"})
+	is.NoErr(err)
+	_, err = playerTwoClient.SendCCmdJoinRecvSCmdSetSeed(2, "party", lobbyclient.PlayerInfo{Name: "two"})
+	is.NoErr(err)
+
+	playerOneClient.SendCCmdTransformPlayer(protocol.NetworkedTransformPlayer{
+		ID: 1,
+		Transform: protocol.NetworkedInt32Vector2{
+			X: protocol.ToFixedPoint(24),
+			Y: protocol.ToFixedPoint(13),
+		},
+	})
+
+	// lobbies
+
+	var lobbies []lobbyserver.LobbyStatus
+	waitFor(t, "player one to move", func() bool {
+		w := request(t, handler, "GET", "/lobbies", nil)
+		is.Equal(w.Code, http.StatusOK)
+		is.NoErr(json.Unmarshal(w.Body.Bytes(), &lobbies))
+		return len(lobbies) == 1 && len(lobbies[0].Clients) == 2 && lobbies[0].Clients[0].Position != nil
+	})
+	is.Equal(len(lobbies), 1)
+	is.Equal(lobbies[0].Name, "party")
+	is.Equal(len(lobbies[0].Clients), 2)
+	is.Equal(lobbies[0].Clients[0].ID, uint64(1))
+	is.Equal(lobbies[0].Clients[0].Name, "one")
+	is.Equal(*lobbies[0].Clients[0].Position, lobbyserver.Position{X: 24, Y: 13})
+	is.Equal(lobbies[0].Clients[1].Position, nil) // player two did not move
+
+	// seed
+
+	w := request(t, handler, "POST", "/seed", url.Values{"lobby": {"party"}, "seed": {"42"}})
+	is.Equal(w.Code, http.StatusOK)
+	seed, err := ls.LobbySeed("party")
+	is.NoErr(err)
+	is.Equal(seed, int32(42))
+
+	is.Equal(request(t, handler, "POST", "/seed", url.Values{"lobby": {"nope"}}).Code, http.StatusNotFound)
+	is.Equal(request(t, handler, "POST", "/seed", url.Values{"seed": {"42"}}).Code, http.StatusBadRequest) // lobby is missing
+	is.Equal(request(t, handler, "POST", "/seed", url.Values{"lobby": {"party"}, "seed": {"x"}}).Code, http.StatusBadRequest)
+
+	// kick
+
+	is.Equal(request(t, handler, "POST", "/kick", url.Values{"lobby": {"party"}, "id": {"3"}}).Code, http.StatusNotFound)
+	is.Equal(request(t, handler, "POST", "/kick", url.Values{"lobby": {"party"}, "id": {"2"}}).Code, http.StatusNoContent)
+
+	waitFor(t, "player two to be kicked", func() bool {
+		return errors.Is(playerTwoClient.Err(), lobbyclient.ErrRejected) // kicked client knows why
+	})
+	var despawned []protocol.NetworkedID
+	waitFor(t, "player two to despawn", func() bool {
+		_, despawned = playerOneClient.GetDeltaPlayers()
+		return len(despawned) > 0
+	})
+	is.Equal(len(despawned), 1)
+	is.Equal(uint64(despawned[0]), uint64(2))
+
+	// ban
+
+	is.Equal(request(t, handler, "POST", "/ban", url.Values{"id": {"1"}}).Code, http.StatusNoContent)
+
+	waitFor(t, "player one to be banned", func() bool {
+		return errors.Is(playerOneClient.Err(), lobbyclient.ErrRejected)
+	})
+	is.Equal(len(ls.Lobbies()), 0) // lobby is destroyed once empty
+
+	w = request(t, handler, "GET", "/bans", nil)
+	is.Equal(w.Code, http.StatusOK)
+	var bans []uint64
+	is.NoErr(json.Unmarshal(w.Body.Bytes(), &bans))
+	is.Equal(bans, []uint64{1})
+
+	bannedClient, err := lobbyclient.NewLobbyClient("udp4", ls.Addr().String(), nil, nil)
+	is.NoErr(err)
+	go bannedClient.Run(ctx)
+	_, err = bannedClient.SendCCmdJoinRecvSCmdSetSeed(1, "party", lobbyclient.PlayerInfo{})
+	is.True(errors.Is(err, lobbyclient.ErrRejected))
+
+	is.Equal(request(t, handler, "POST", "/unban", url.Values{"id": {"1"}}).Code, http.StatusNoContent)
+
+	unbannedClient, err := lobbyclient.NewLobbyClient("udp4", ls.Addr().String(), nil, nil)
+	is.NoErr(err)
+	go unbannedClient.Run(ctx)
+	_, err = unbannedClient.SendCCmdJoinRecvSCmdSetSeed(1, "party", lobbyclient.PlayerInfo{})
+	is.NoErr(err)
+}
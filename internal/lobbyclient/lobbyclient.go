@@ -2,18 +2,210 @@ package lobbyclient
 
 import (
 	"context"
+	cryptorand "crypto/rand"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"net"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/blukai/noitaparty/internal/debug"
+	"github.com/blukai/noitaparty/internal/interpolation"
+	"github.com/blukai/noitaparty/internal/metrics"
 	"github.com/blukai/noitaparty/internal/protocol"
-	"github.com/blukai/noitaparty/internal/ptr"
+	"github.com/blukai/noitaparty/internal/ratelimit"
+	"github.com/blukai/noitaparty/internal/reliable"
 	"github.com/phuslu/log"
 )
 
+const (
+	// maxHelloCopies limits how many copies of hello are sent at once (see
+	// handshake).
+	maxHelloCopies = 3
+	// pingInterval determines how often ping is sent to measure latency
+	// (see Latency).
+	pingInterval = time.Second
+	// pongWindow is the amount of recent round trips the clock is synced
+	// from.
+	pongWindow = 8
+	// leaveCopies is how many copies of leave are sent; leave is not
+	// reliable (client does not wait for it to be acknowledged).
+	leaveCopies = 3
+	// chatQueueLen is the max amount of received chat messages that wait to
+	// be read; older messages are dropped.
+	chatQueueLen = 64
+)
+
+// Options tune client's timing and limits. zero fields take values of
+// DefaultOptions.
+type Options struct {
+	// KeepAliveInterval determines how often keep alive is sent to the
+	// server; server responds to it.
+	KeepAliveInterval time.Duration
+	// SilenceTimeout is how long client waits to hear anything from the
+	// server before it reconnects. it must be greater than
+	// KeepAliveInterval and less than server's eviction timeout for the
+	// session to be resumed.
+	SilenceTimeout time.Duration
+	// SendTimeout limits how long a write to the socket may block.
+	SendTimeout time.Duration
+	// RecvTimeout is how long a read from the socket blocks; it also
+	// limits how long SendCCmdPing waits for the pong.
+	RecvTimeout time.Duration
+	// CmdMaxSize is the max size (in bytes) of a received cmd; larger
+	// packets are dropped. it must not be lower than the size of cmds
+	// server sends (protocol.CmdMaxSize is always enough).
+	CmdMaxSize int
+}
+
+func DefaultOptions() Options {
+	return Options{
+		KeepAliveInterval: time.Second * 5,
+		SilenceTimeout:    time.Second * 7,
+		SendTimeout:       time.Second,
+		RecvTimeout:       time.Second,
+		CmdMaxSize:        protocol.CmdMaxSize,
+	}
+}
+
+// withDefaults returns a copy of options with zero fields replaced by
+// defaults.
+func (o Options) withDefaults() Options {
+	defaults := DefaultOptions()
+	if o.KeepAliveInterval == 0 {
+		o.KeepAliveInterval = defaults.KeepAliveInterval
+	}
+	if o.SilenceTimeout == 0 {
+		o.SilenceTimeout = defaults.SilenceTimeout
+	}
+	if o.SendTimeout == 0 {
+		o.SendTimeout = defaults.SendTimeout
+	}
+	if o.RecvTimeout == 0 {
+		o.RecvTimeout = defaults.RecvTimeout
+	}
+	if o.CmdMaxSize == 0 {
+		o.CmdMaxSize = defaults.CmdMaxSize
+	}
+	return o
+}
+
+func (o *Options) Validate() error {
+	if o.KeepAliveInterval <= 0 {
+		return fmt.Errorf("invalid keep alive interval: %v", o.KeepAliveInterval)
+	}
+	if o.SilenceTimeout <= o.KeepAliveInterval {
+		return fmt.Errorf(
+			"silence timeout is too short (got %v; want > %v)",
+			o.SilenceTimeout,
+			o.KeepAliveInterval,
+		)
+	}
+	if o.SendTimeout <= 0 {
+		return fmt.Errorf("invalid send timeout: %v", o.SendTimeout)
+	}
+	if o.RecvTimeout <= 0 {
+		return fmt.Errorf("invalid recv timeout: %v", o.RecvTimeout)
+	}
+	if o.CmdMaxSize <= protocol.CmdHeaderSize || o.CmdMaxSize > protocol.CmdMaxSize {
+		return fmt.Errorf(
+			"invalid cmd max size (got %d; want > %d and <= %d)",
+			o.CmdMaxSize,
+			protocol.CmdHeaderSize,
+			protocol.CmdMaxSize,
+		)
+	}
+	return nil
+}
+
+var (
+	ErrNotJoined = errors.New("did not join any lobby")
+	// ErrSeedChanged is returned when client reconnected, but lobby's seed
+	// is not the same anymore (e.g. lobby was destroyed in the meantime).
+	ErrSeedChanged = errors.New("lobby seed changed")
+	// ErrRejected is returned when server refused to talk to the client
+	// (see protocol.SCmdError); error message contains server's reason.
+	ErrRejected = errors.New("rejected by server")
+	// ErrIncompatible is returned when server speaks a different protocol
+	// version.
+	ErrIncompatible = errors.New("incompatible server")
+	// ErrRateLimited is returned when client tries to send chat messages
+	// faster than server would accept them (see protocol.ChatBurst).
+	ErrRateLimited = errors.New("rate limited")
+)
+
+// makeNonce generates a connection nonce (see protocol.NetworkedJoin).
+func makeNonce() uint64 {
+	buf := make([]byte, 8)
+	_, err := cryptorand.Read(buf)
+	debug.Assert(err == nil)
+	return binary.BigEndian.Uint64(buf)
+}
+
+// resetChannel starts reliable delivery over with a new connection nonce and
+// returns the nonce.
+func (lc *LobbyClient) resetChannel() uint64 {
+	nonce := makeNonce()
+	lc.channelMu.Lock()
+	lc.channel = reliable.NewChannel()
+	lc.nonce.Store(nonce)
+	lc.channelMu.Unlock()
+	return nonce
+}
+
+// Latency describes the connection to the server; it is estimated from
+// ping/pong round trips.
+type Latency struct {
+	// RTT is a smoothed round trip time.
+	RTT time.Duration
+	// Jitter is a smoothed deviation of round trip time.
+	Jitter time.Duration
+	// ClockOffset is how far server's time is ahead of client's time; both
+	// start at zero when server and client start.
+	ClockOffset time.Duration
+}
+
+// PlayerInfo describes a player to other lobby members.
+type PlayerInfo struct {
+	// Name is a display name; it is at most protocol.PlayerNameMaxLen
+	// bytes of utf-8.
+	Name string
+	// Metadata is defined and interpreted by the mod (e.g. mod version,
+	// chosen color); it holds at most protocol.PlayerMetadataMaxLen
+	// entries.
+	Metadata map[string]string
+}
+
+func makePlayerInfo(info *protocol.NetworkedPlayerInfo) PlayerInfo {
+	metadata := make(map[string]string, len(info.Metadata))
+	for _, md := range info.Metadata {
+		metadata[string(md.Key)] = string(md.Value)
+	}
+	return PlayerInfo{
+		Name:     string(info.Name),
+		Metadata: metadata,
+	}
+}
+
+// pongSample is a single ping/pong round trip.
+type pongSample struct {
+	rtt        time.Duration
+	serverTime time.Duration
+	recvAt     time.Time
+}
+
+// unannouncedPlayer is a snapshot entry of a player that was not spawned yet
+// (see LobbyClient.unannounced).
+type unannouncedPlayer struct {
+	player       protocol.NetworkedTransformPlayer
+	snapshotTime time.Duration
+	recvAt       time.Time
+}
+
 type sendChPayload struct {
 	cmd   protocol.Cmd
 	errCh chan error
@@ -28,14 +220,112 @@ type LobbyClient struct {
 	sendCh chan sendChPayload
 	recvCh chan protocol.Cmd
 
-	sendTimeout time.Duration
-	recvTimeout time.Duration
+	options Options
+
+	// token is a session token received from the server on join; it is
+	// attached to every outgoing cmd.
+	token atomic.Uint64
+	// nonce identifies current connection; cmds that server sent to a
+	// previous connection are dropped.
+	nonce atomic.Uint64
+	// lastRecv is a unix nano timestamp of the last received cmd; it is
+	// used to detect that server went silent.
+	lastRecv atomic.Int64
+	// err is set when connection can't be recovered.
+	err atomic.Pointer[error]
+	// startedAt is the origin of client's time that is sent in pings.
+	startedAt time.Time
+
+	// latencyMu guards latency and pongs which are written by runRecvCh.
+	latencyMu sync.Mutex
+	latency   Latency
+	// pongs are the most recent round trips, oldest first; the fastest one
+	// is used to sync the clock.
+	pongs []pongSample
+
+	// joinMu guards join, seed, runSettings and features and serializes
+	// joins. join is remembered to be able to re-join after reconnecting.
+	joinMu      sync.Mutex
+	join        *protocol.NetworkedJoin
+	seed        int32
+	runSettings map[string]string
+	// features are the protocol features that both, client and server,
+	// support; they are negotiated during the handshake.
+	features uint64
+	// sessionCh receives sessions from runRecvCh.
+	sessionCh chan *protocol.NetworkedSession
+	// helloCh receives server's hellos from runRecvCh.
+	helloCh chan *protocol.NetworkedHello
+	// rejectCh receives errors sent by the server from runRecvCh.
+	rejectCh chan error
+	// brokenCh makes runReconnect reconnect right away; runRetransmit
+	// signals it when server stopped acknowledging reliable cmds.
+	brokenCh chan struct{}
+
+	// channelMu guards channel which is used by runRecvCh, runRetransmit
+	// and reliable senders.
+	channelMu sync.Mutex
+	channel   *reliable.Channel
 
+	// playersMu guards players, changedPlayers, despawnedPlayers, infos,
+	// unannounced, buffers and clock which are written by runRecvCh and
+	// read from the game thread.
+	playersMu sync.Mutex
 	// NOTE(blukai): key is player's id
-	players map[protocol.NetworkedUint64]*protocol.NetworkedTransformPlayer
+	players map[protocol.NetworkedID]*protocol.NetworkedTransformPlayer
+	// changedPlayers holds ids of players whose transform changed since
+	// last GetDeltaPlayers call
+	changedPlayers map[protocol.NetworkedID]struct{}
+	// despawnedPlayers holds ids of players that left since last
+	// GetDeltaPlayers call
+	despawnedPlayers []protocol.NetworkedID
+	// infos hold names and metadata of players; they arrive with spawns.
+	infos map[protocol.NetworkedID]*protocol.NetworkedPlayerInfo
+	// unannounced holds the latest snapshot entries of players whose spawn
+	// did not arrive yet; they are applied once it does.
+	unannounced map[protocol.NetworkedID]unannouncedPlayer
+	// buffers hold recent states of players; they are used to draw
+	// players smoothly (see GetInterpolatedPlayers).
+	buffers map[protocol.NetworkedID]*interpolation.Buffer
+	// clock maps local time onto server's time of snapshots; it is synced
+	// by pongs.
+	clock interpolation.Clock
+
+	// chatMu guards chat and chatLimiter.
+	chatMu sync.Mutex
+	// chat holds received chat messages that were not read yet, oldest
+	// first.
+	chat []protocol.NetworkedChat
+	// chatLimiter mirrors server's chat rate limit; messages that server
+	// would drop are not sent.
+	chatLimiter *ratelimit.Bucket
+
+	// metrics holds counters below and more (see Metrics).
+	metrics       *metrics.Registry
+	sentPackets   *metrics.Counter
+	sentBytes     *metrics.Counter
+	sendErrors    *metrics.Counter
+	readPackets   *metrics.Counter
+	readBytes     *metrics.Counter
+	readErrors    *metrics.Counter
+	decodeErrors  *metrics.Counter
+	stalePackets  *metrics.Counter
+	retransmitted *metrics.Counter
+	rttHistogram  *metrics.Histogram
 }
 
-func NewLobbyClient(network, address string, logger *log.Logger) (*LobbyClient, error) {
+// NewLobbyClient constructs a client of the server at the given address.
+// options may be nil, in which case DefaultOptions are used.
+func NewLobbyClient(network, address string, logger *log.Logger, options *Options) (*LobbyClient, error) {
+	var opts Options
+	if options != nil {
+		opts = *options
+	}
+	opts = opts.withDefaults()
+	if err := opts.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid options: %w", err)
+	}
+
 	addr, err := net.ResolveUDPAddr(network, address)
 	if err != nil {
 		return nil, fmt.Errorf("could not resolve udp addr: %w", err)
@@ -55,44 +345,100 @@ func NewLobbyClient(network, address string, logger *log.Logger) (*LobbyClient,
 	}
 
 	lc := &LobbyClient{
-		conn:    conn,
-		readBuf: make([]byte, protocol.CmdMaxSize),
+		conn: conn,
+		// NOTE(blukai): packets that don't fit are truncated and fail to
+		// decode.
+		readBuf: make([]byte, opts.CmdMaxSize),
 
 		logger: logger,
 
-		sendCh: make(chan sendChPayload),
-		recvCh: make(chan protocol.Cmd),
+		sendCh:    make(chan sendChPayload),
+		recvCh:    make(chan protocol.Cmd),
+		sessionCh: make(chan *protocol.NetworkedSession, 1),
+		helloCh:   make(chan *protocol.NetworkedHello, 1),
+		rejectCh:  make(chan error, 1),
+		brokenCh:  make(chan struct{}, 1),
 
-		sendTimeout: time.Second,
-		recvTimeout: time.Second,
+		options: opts,
 
-		players: make(map[protocol.NetworkedUint64]*protocol.NetworkedTransformPlayer),
+		channel: reliable.NewChannel(),
+
+		players:        make(map[protocol.NetworkedID]*protocol.NetworkedTransformPlayer),
+		changedPlayers: make(map[protocol.NetworkedID]struct{}),
+		infos:          make(map[protocol.NetworkedID]*protocol.NetworkedPlayerInfo),
+		unannounced:    make(map[protocol.NetworkedID]unannouncedPlayer),
+		buffers:        make(map[protocol.NetworkedID]*interpolation.Buffer),
+
+		chatLimiter: ratelimit.NewBucket(protocol.ChatInterval, protocol.ChatBurst),
 	}
+	lc.nonce.Store(makeNonce())
+	lc.lastRecv.Store(time.Now().UnixNano())
+	lc.startedAt = time.Now()
+	lc.registerMetrics()
 
 	return lc, nil
 }
 
+func (lc *LobbyClient) registerMetrics() {
+	r := metrics.NewRegistry()
+	lc.metrics = r
+
+	lc.sentPackets = r.NewCounter(
+		"noitaparty_client_sent_packets_total",
+		"Packets written to the socket.",
+	)
+	lc.sentBytes = r.NewCounter(
+		"noitaparty_client_sent_bytes_total",
+		"Bytes written to the socket.",
+	)
+	lc.sendErrors = r.NewCounter(
+		"noitaparty_client_send_errors_total",
+		"Failed socket writes.",
+	)
+	lc.readPackets = r.NewCounter(
+		"noitaparty_client_read_packets_total",
+		"Packets read from the socket, including invalid ones.",
+	)
+	lc.readBytes = r.NewCounter(
+		"noitaparty_client_read_bytes_total",
+		"Bytes read from the socket.",
+	)
+	lc.readErrors = r.NewCounter(
+		"noitaparty_client_read_errors_total",
+		"Failed socket reads, excluding timeouts.",
+	)
+	lc.decodeErrors = r.NewCounter(
+		"noitaparty_client_decode_errors_total",
+		"Packets that could not be decoded.",
+	)
+	lc.stalePackets = r.NewCounter(
+		"noitaparty_client_stale_packets_total",
+		"Packets that were dropped because server sent them to a previous connection.",
+	)
+	lc.retransmitted = r.NewCounter(
+		"noitaparty_client_retransmitted_cmds_total",
+		"Reliable cmds that were re-sent because server did not acknowledge them in time.",
+	)
+	lc.rttHistogram = r.NewHistogram(
+		"noitaparty_client_rtt_seconds",
+		"Round trip time measured by ping/pong.",
+		metrics.ExponentialBuckets(0.005, 2, 8),
+	)
+}
+
+// Metrics returns client's metrics in a form that prometheus understands.
+func (lc *LobbyClient) Metrics() *metrics.Registry {
+	return lc.metrics
+}
+
 func (lc *LobbyClient) runSendCh(ctx context.Context) {
 	for {
 		select {
 		case <-ctx.Done():
 			return
 		case payload := <-lc.sendCh:
-			lc.logger.Debug().
-				Any("cmd", &payload.cmd).
-				Msg("sendCmd")
-
-			cmdBytes, err := payload.cmd.MarshalBinary()
-			debug.Assert(err == nil)
-
-			err = lc.conn.SetWriteDeadline(time.Now().Add(lc.sendTimeout))
-			debug.Assert(err == nil)
-
-			_, err = lc.conn.Write(cmdBytes)
+			err := lc.writeCmd(payload.cmd)
 			if err != nil {
-				lc.logger.Error().
-					Msgf("could not write: %v", err)
-
 				payload.errCh <- err
 				continue
 			}
@@ -105,13 +451,44 @@ func (lc *LobbyClient) runSendCh(ctx context.Context) {
 	}
 }
 
+// writeCmd writes cmd to the conn right away. unlike sendCmd it does not go
+// through sendCh and thus can be used by loops that must not block on it.
+func (lc *LobbyClient) writeCmd(cmd protocol.Cmd) error {
+	cmd.Header.Token = lc.token.Load()
+
+	lc.logger.Debug().
+		Any("cmd", &cmd).
+		Msg("sendCmd")
+
+	cmdBytes, err := cmd.MarshalBinary()
+	if err != nil {
+		lc.logger.Error().
+			Msgf("could not marshal: %v", err)
+		return err
+	}
+
+	err = lc.conn.SetWriteDeadline(time.Now().Add(lc.options.SendTimeout))
+	debug.Assert(err == nil)
+
+	n, err := lc.conn.Write(cmdBytes)
+	if err != nil {
+		lc.sendErrors.Inc()
+		lc.logger.Error().
+			Msgf("could not write: %v", err)
+		return err
+	}
+	lc.sentPackets.Inc()
+	lc.sentBytes.Add(uint64(n))
+	return nil
+}
+
 func (lc *LobbyClient) runRecvCh(ctx context.Context) {
 	for {
 		select {
 		case <-ctx.Done():
 			return
 		default:
-			err := lc.conn.SetReadDeadline(time.Now().Add(lc.recvTimeout))
+			err := lc.conn.SetReadDeadline(time.Now().Add(lc.options.RecvTimeout))
 			debug.Assert(err == nil)
 
 			n, _, err := lc.conn.ReadFromUDP(lc.readBuf)
@@ -120,20 +497,19 @@ func (lc *LobbyClient) runRecvCh(ctx context.Context) {
 					continue
 				}
 
+				lc.readErrors.Inc()
 				lc.logger.Error().
 					Msgf("could not read: %v", err)
 
 				// TODO(blukai): how to handle read error?
 				continue
 			}
-			if n < protocol.CmdHeaderSize {
-				lc.logger.Error().
-					Msgf("invalid msg size (got %d; want >= %d)", n, protocol.CmdHeaderSize)
-				continue
-			}
+			lc.readPackets.Inc()
+			lc.readBytes.Add(uint64(n))
 
 			cmd := protocol.Cmd{}
 			if err := cmd.UnmarshalBinary(lc.readBuf[0:n]); err != nil {
+				lc.decodeErrors.Inc()
 				lc.logger.Error().
 					Str("bytes", fmt.Sprintf("%v", lc.readBuf[0:n])).
 					Msgf("could not unmarshal cmd: %v", err)
@@ -144,15 +520,284 @@ func (lc *LobbyClient) runRecvCh(ctx context.Context) {
 				Any("cmd", &cmd).
 				Msgf("recv")
 
-			switch cmd.Header.Cmd {
-			// intercept some commands that don't need to be read
-			// individually
-			case protocol.SCmdTransformPlayer:
-				player, ok := cmd.Body.(*protocol.NetworkedTransformPlayer)
-				debug.Assert(ok)
-				lc.players[player.ID] = player
-			default:
-				lc.recvCh <- cmd
+			// NOTE(blukai): server re-sends cmds of a previous
+			// connection until it learns about the new one; they must
+			// not reach the new channel.
+			if nonce := cmd.Header.Token; nonce != 0 && nonce != lc.nonce.Load() {
+				lc.stalePackets.Inc()
+				continue
+			}
+			lc.lastRecv.Store(time.Now().UnixNano())
+
+			lc.channelMu.Lock()
+			cmds, ack := lc.channel.Recv(cmd)
+			ackCmd := protocol.Cmd{}
+			if ack {
+				ackCmd = lc.channel.Ack(protocol.CCmdAck)
+			}
+			lc.channelMu.Unlock()
+
+			if ack {
+				// NOTE(blukai): potential error is logged by
+				// writeCmd; server will re-send the cmd.
+				_ = lc.writeCmd(ackCmd)
+			}
+
+			for _, cmd := range cmds {
+				lc.handleCmd(cmd)
+			}
+		}
+	}
+}
+
+func (lc *LobbyClient) handleCmd(cmd protocol.Cmd) {
+	switch cmd.Header.Cmd {
+	// intercept some commands that don't need to be read
+	// individually
+	case protocol.SCmdPlayerSnapshot:
+		snapshot, ok := cmd.Body.(*protocol.NetworkedPlayerSnapshot)
+		debug.Assert(ok)
+		snapshotTime := time.Duration(snapshot.Time) * time.Millisecond
+		now := time.Now()
+		lc.playersMu.Lock()
+		lc.clock.Observe(snapshotTime, now)
+		for i := range snapshot.Players {
+			player := &snapshot.Players[i]
+
+			// NOTE(blukai): snapshots are unreliable and may arrive
+			// after the player was despawned (or before it was
+			// spawned, e.g. if the spawn got lost and is being
+			// re-sent); only players that were announced by
+			// SCmdSpawnPlayer are tracked, otherwise despawned
+			// players would come back as ghosts. server does not
+			// send transforms of players that stand still, entries
+			// of players that were not spawned yet are held on to
+			// until the spawn arrives.
+			if _, ok := lc.infos[player.ID]; !ok {
+				lc.unannounced[player.ID] = unannouncedPlayer{
+					player:       *player,
+					snapshotTime: snapshotTime,
+					recvAt:       now,
+				}
+				continue
+			}
+
+			lc.applyPlayer(snapshotTime, player)
+		}
+		lc.playersMu.Unlock()
+	case protocol.SCmdSpawnPlayer:
+		// NOTE(blukai): player is added to players once
+		// its first transform arrives
+		info, ok := cmd.Body.(*protocol.NetworkedPlayerInfo)
+		debug.Assert(ok)
+		if err := info.Validate(); err != nil {
+			lc.logger.Error().
+				Msgf("invalid player info: %v", err)
+			break
+		}
+		lc.playersMu.Lock()
+		lc.infos[info.ID] = info
+		lc.applyUnannounced(info.ID, time.Now())
+		lc.playersMu.Unlock()
+	case protocol.SCmdDespawnPlayer:
+		id, ok := cmd.Body.(*protocol.NetworkedID)
+		debug.Assert(ok)
+		lc.playersMu.Lock()
+		delete(lc.players, *id)
+		delete(lc.changedPlayers, *id)
+		delete(lc.infos, *id)
+		delete(lc.unannounced, *id)
+		delete(lc.buffers, *id)
+		lc.despawnedPlayers = append(lc.despawnedPlayers, *id)
+		lc.playersMu.Unlock()
+	case protocol.SCmdSetSeed:
+		session, ok := cmd.Body.(*protocol.NetworkedSession)
+		debug.Assert(ok)
+		replaceStale(lc.sessionCh, session)
+	case protocol.SCmdHello:
+		hello, ok := cmd.Body.(*protocol.NetworkedHello)
+		debug.Assert(ok)
+		replaceStale(lc.helloCh, hello)
+	case protocol.SCmdError:
+		body, ok := cmd.Body.(*protocol.NetworkedError)
+		debug.Assert(ok)
+		// NOTE(blukai): server does not send errors it expects client
+		// to recover from.
+		err := fmt.Errorf("%w: %s (code %d)", ErrRejected, body.Message, body.Code)
+		lc.err.Store(&err)
+		replaceStale(lc.rejectCh, err)
+	case protocol.SCmdChat:
+		chat, ok := cmd.Body.(*protocol.NetworkedChat)
+		debug.Assert(ok)
+		// NOTE(blukai): messages come from other players; server
+		// validates them, but don't trust it blindly.
+		if err := chat.Validate(); err != nil {
+			lc.logger.Error().
+				Msgf("invalid chat message: %v", err)
+			break
+		}
+		lc.chatMu.Lock()
+		lc.chat = append(lc.chat, *chat)
+		if len(lc.chat) > chatQueueLen {
+			lc.chat = lc.chat[len(lc.chat)-chatQueueLen:]
+		}
+		lc.chatMu.Unlock()
+	case protocol.SCmdAck:
+		// ignore ack because it is being processed by the channel in
+		// runRecvCh func
+	case protocol.SCmdKeepAlive:
+		// ignore keep alive because lastRecv is being maintained by
+		// runRecvCh func
+	case protocol.SCmdPong:
+		pong, ok := cmd.Body.(*protocol.NetworkedPong)
+		debug.Assert(ok)
+		lc.observePong(pong, time.Now())
+		// NOTE(blukai): pong is also interesting to SendCCmdPing; don't
+		// block the receive loop if nobody waits for it.
+		select {
+		case lc.recvCh <- cmd:
+		default:
+		}
+	default:
+		lc.logger.Error().
+			Msgf("unexpected cmd: %d", cmd.Header.Cmd)
+	}
+}
+
+// applyPlayer records player's state received in a snapshot.
+//
+// NOTE(blukai): lc.playersMu must be held.
+func (lc *LobbyClient) applyPlayer(snapshotTime time.Duration, player *protocol.NetworkedTransformPlayer) {
+	buffer, ok := lc.buffers[player.ID]
+	if !ok {
+		buffer = &interpolation.Buffer{}
+		lc.buffers[player.ID] = buffer
+	}
+	buffer.Push(snapshotTime, *player)
+
+	prev, ok := lc.players[player.ID]
+	if ok && *prev == *player {
+		return
+	}
+	lc.players[player.ID] = player
+	lc.changedPlayers[player.ID] = struct{}{}
+}
+
+// applyUnannounced applies the held on to snapshot entry of the player that
+// was just spawned and forgets entries that are too old to belong to a spawn
+// that is still on its way.
+//
+// NOTE(blukai): lc.playersMu must be held.
+func (lc *LobbyClient) applyUnannounced(id protocol.NetworkedID, now time.Time) {
+	for unannouncedID, unannounced := range lc.unannounced {
+		// NOTE(blukai): spawn is delivered reliably; entry that is
+		// older than the time it takes to re-send it arrived after a
+		// despawn (or was sent by a broken server).
+		if now.Sub(unannounced.recvAt) > reliable.RetransmitTimeout*reliable.MaxAttempts {
+			delete(lc.unannounced, unannouncedID)
+		}
+	}
+
+	unannounced, ok := lc.unannounced[id]
+	if !ok {
+		return
+	}
+	delete(lc.unannounced, id)
+	lc.applyPlayer(unannounced.snapshotTime, &unannounced.player)
+}
+
+// clientTime returns microseconds elapsed since client started; it is sent in
+// pings and echoed back in pongs.
+func (lc *LobbyClient) clientTime(now time.Time) uint64 {
+	return uint64(now.Sub(lc.startedAt).Microseconds())
+}
+
+// observePong updates latency estimates and syncs the clock with a pong that
+// was received at recvAt.
+func (lc *LobbyClient) observePong(pong *protocol.NetworkedPong, recvAt time.Time) {
+	sentAt := lc.startedAt.Add(time.Duration(pong.ClientTime) * time.Microsecond)
+	sample := pongSample{
+		rtt:        recvAt.Sub(sentAt),
+		serverTime: time.Duration(pong.ServerTime) * time.Millisecond,
+		recvAt:     recvAt,
+	}
+	// NOTE(blukai): server echoes whatever it was given; pong of a ping
+	// that was never sent is garbage.
+	if sample.rtt < 0 {
+		return
+	}
+	lc.rttHistogram.Observe(sample.rtt.Seconds())
+
+	lc.latencyMu.Lock()
+	// NOTE(blukai): rtt and jitter are smoothed the same way tcp smooths
+	// them (see rfc 6298).
+	if len(lc.pongs) == 0 {
+		lc.latency.RTT = sample.rtt
+		lc.latency.Jitter = sample.rtt / 2
+	} else {
+		lc.latency.Jitter = (lc.latency.Jitter*3 + (lc.latency.RTT - sample.rtt).Abs()) / 4
+		lc.latency.RTT = (lc.latency.RTT*7 + sample.rtt) / 8
+	}
+
+	lc.pongs = append(lc.pongs, sample)
+	if len(lc.pongs) > pongWindow {
+		lc.pongs = lc.pongs[len(lc.pongs)-pongWindow:]
+	}
+	// NOTE(blukai): the faster the round trip, the less room there is for
+	// asymmetric delays to skew the clock.
+	fastest := lc.pongs[0]
+	for _, pong := range lc.pongs[1:] {
+		if pong.rtt < fastest.rtt {
+			fastest = pong
+		}
+	}
+	lc.latency.ClockOffset = fastest.serverTime + fastest.rtt/2 - fastest.recvAt.Sub(lc.startedAt)
+	lc.latencyMu.Unlock()
+
+	lc.playersMu.Lock()
+	lc.clock.Sync(fastest.serverTime, fastest.rtt, fastest.recvAt)
+	lc.playersMu.Unlock()
+}
+
+// replaceStale sends v to ch (which must have a buffer of 1) replacing the
+// value nobody received.
+//
+// NOTE(blukai): only the latest value matters; if nobody waits for it (e.g.
+// join timed out) the stale one is replaced.
+func replaceStale[T any](ch chan T, v T) {
+	select {
+	case <-ch:
+	default:
+	}
+	ch <- v
+}
+
+func (lc *LobbyClient) runRetransmit(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(reliable.RetransmitTimeout / 4):
+			lc.channelMu.Lock()
+			cmds, err := lc.channel.Retransmit(time.Now())
+			lc.channelMu.Unlock()
+			if err != nil {
+				// NOTE(blukai): undelivered cmd stays at the head of
+				// the channel and nothing after it can be delivered;
+				// connection is unusable. start over and make
+				// runReconnect rejoin as if server went silent.
+				lc.logger.Error().
+					Msgf("could not deliver cmd: %v, reconnecting", err)
+				lc.resetChannel()
+				replaceStale(lc.brokenCh, struct{}{})
+				continue
+			}
+
+			lc.retransmitted.Add(uint64(len(cmds)))
+			for _, cmd := range cmds {
+				// NOTE(blukai): potential error is logged by
+				// writeCmd; cmd will be re-sent again.
+				_ = lc.writeCmd(cmd)
 			}
 		}
 	}
@@ -165,15 +810,55 @@ func (lc *LobbyClient) runKeepAlive(ctx context.Context) {
 			return
 		// send keep alive messages periodically if no other messages
 		// are being sent
-		case <-time.After(time.Second * 5):
-			sCmdKeepAlive := protocol.Cmd{
-				Header: &protocol.CmdHeader{
-					Cmd:  protocol.CCmdKeepAlive,
-					Size: 4,
-				},
-				Body: nil,
+		case <-time.After(lc.options.KeepAliveInterval):
+			lc.sendCmd(protocol.NewCCmdKeepAlive())
+		}
+	}
+}
+
+// runPing measures latency continuously.
+func (lc *LobbyClient) runPing(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(pingInterval):
+			lc.sendCmd(protocol.NewCCmdPing(lc.clientTime(time.Now())))
+		}
+	}
+}
+
+func (lc *LobbyClient) runReconnect(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-lc.brokenCh:
+			if lc.Err() != nil {
+				continue
 			}
-			lc.sendCmd(sCmdKeepAlive)
+		case <-time.After(time.Second):
+			silence := time.Since(time.Unix(0, lc.lastRecv.Load()))
+			if silence < lc.options.SilenceTimeout || lc.Err() != nil {
+				continue
+			}
+
+			lc.logger.Info().
+				Msgf("server is silent for %v, reconnecting", silence)
+		}
+
+		err := lc.Reconnect()
+		switch {
+		case err == nil:
+			lc.logger.Info().Msg("reconnected")
+		case errors.Is(err, ErrNotJoined):
+			// nothing to resume
+		case errors.Is(err, ErrSeedChanged):
+			lc.err.Store(&err)
+		default:
+			// NOTE(blukai): will be retried on next iteration
+			lc.logger.Error().
+				Msgf("could not reconnect: %v", err)
 		}
 	}
 }
@@ -196,6 +881,21 @@ func (lc *LobbyClient) Run(ctx context.Context) error {
 		defer wg.Done()
 		lc.runKeepAlive(ctx)
 	}()
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		lc.runPing(ctx)
+	}()
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		lc.runRetransmit(ctx)
+	}()
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		lc.runReconnect(ctx)
+	}()
 
 	select {
 	case <-ctx.Done():
@@ -213,28 +913,32 @@ func (lc *LobbyClient) sendCmd(cmd protocol.Cmd) <-chan error {
 	return errChan
 }
 
-func (lc *LobbyClient) recvCmd() (*protocol.Cmd, error) {
+// sendReliableCmd is like sendCmd, but cmd is re-sent until server
+// acknowledges it.
+func (lc *LobbyClient) sendReliableCmd(cmd protocol.Cmd) <-chan error {
+	lc.channelMu.Lock()
+	cmd = lc.channel.Send(cmd, time.Now())
+	lc.channelMu.Unlock()
+	return lc.sendCmd(cmd)
+}
+
+func (lc *LobbyClient) recvCmd(timeout time.Duration) (*protocol.Cmd, error) {
 	select {
-	case <-time.After(lc.recvTimeout):
+	case <-time.After(timeout):
 		return nil, fmt.Errorf("timeout reached")
 	case cmd := <-lc.recvCh:
 		return &cmd, nil
 	}
 }
 
-// SendCCmdPing is blocking
+// SendCCmdPing is blocking; pong also updates Latency.
 func (lc *LobbyClient) SendCCmdPing() error {
-	cCmdPing := protocol.Cmd{
-		Header: &protocol.CmdHeader{
-			Cmd: protocol.CCmdPing,
-		},
-	}
-	err := <-lc.sendCmd(cCmdPing)
+	err := <-lc.sendCmd(protocol.NewCCmdPing(lc.clientTime(time.Now())))
 	if err != nil {
 		return fmt.Errorf("could not send: %w", err)
 	}
 
-	sCmdPong, err := lc.recvCmd()
+	sCmdPong, err := lc.recvCmd(lc.options.RecvTimeout)
 	if err != nil {
 		return fmt.Errorf("could not recv: %w", err)
 	}
@@ -249,60 +953,332 @@ func (lc *LobbyClient) SendCCmdPing() error {
 	return nil
 }
 
-// SendCCmdJoinRecvSCmdSetSeed is blocking
-func (lc *LobbyClient) SendCCmdJoinRecvSCmdSetSeed(id uint64) (int32, error) {
-	cCmdJoin := protocol.Cmd{
-		Header: &protocol.CmdHeader{
-			Cmd:  protocol.CCmdJoin,
-			Size: 8,
-		},
-		Body: ptr.To(protocol.NetworkedUint64(id)),
+// SendCCmdJoinRecvSCmdSetSeed is blocking. players that joined the same lobby
+// receive the same seed and see each other; info is shown to other players
+// (see PlayerInfo).
+func (lc *LobbyClient) SendCCmdJoinRecvSCmdSetSeed(id uint64, lobby string, info PlayerInfo) (int32, error) {
+	if len(lobby) > protocol.LobbyNameMaxLen {
+		return 0, fmt.Errorf(
+			"lobby name is too long (got %d; want <= %d)",
+			len(lobby),
+			protocol.LobbyNameMaxLen,
+		)
+	}
+	if len(info.Metadata) > protocol.PlayerMetadataMaxLen {
+		return 0, fmt.Errorf(
+			"too much metadata (got %d; want <= %d)",
+			len(info.Metadata),
+			protocol.PlayerMetadataMaxLen,
+		)
+	}
+
+	// NOTE(blukai): metadata is sorted to make joins comparable; server
+	// re-broadcasts info of resumed sessions if it differs.
+	var metadata []protocol.NetworkedMetadata
+	for key, value := range info.Metadata {
+		metadata = append(metadata, protocol.NetworkedMetadata{
+			Key:   protocol.NetworkedString(key),
+			Value: protocol.NetworkedString(value),
+		})
 	}
-	err := <-lc.sendCmd(cCmdJoin)
+	sort.Slice(metadata, func(i, j int) bool {
+		return metadata[i].Key < metadata[j].Key
+	})
+
+	lc.joinMu.Lock()
+	defer lc.joinMu.Unlock()
+
+	join := &protocol.NetworkedJoin{
+		ID:       protocol.NetworkedID(id),
+		Nonce:    protocol.NetworkedID(lc.nonce.Load()),
+		Lobby:    protocol.NetworkedString(lobby),
+		Name:     protocol.NetworkedString(info.Name),
+		Metadata: metadata,
+	}
+	networkedInfo := join.PlayerInfo()
+	if err := networkedInfo.Validate(); err != nil {
+		return 0, err
+	}
+
+	// NOTE(blukai): join is sent within a single cmd, make sure that it
+	// fits even if every feature is agreed on during the handshake.
+	join.Version = protocol.ProtocolVersion
+	join.Features = protocol.NetworkedUint64(protocol.SupportedFeatures)
+	cCmdJoin := protocol.NewCmd(protocol.CCmdJoin, join)
+	if _, err := cCmdJoin.MarshalBinary(); err != nil {
+		return 0, fmt.Errorf("join is too big: %w", err)
+	}
+
+	session, err := lc.sendJoin(join)
 	if err != nil {
-		return 0, fmt.Errorf("could not send: %w", err)
+		return 0, err
 	}
 
-	recvCmd, err := lc.recvCmd()
+	lc.join = join
+	lc.seed = int32(session.Seed)
+	lc.runSettings = make(map[string]string, len(session.Settings))
+	for _, setting := range session.Settings {
+		lc.runSettings[string(setting.Key)] = string(setting.Value)
+	}
+
+	return lc.seed, nil
+}
+
+// RunSettings returns run settings received on join; settings are defined by
+// the server.
+func (lc *LobbyClient) RunSettings() map[string]string {
+	lc.joinMu.Lock()
+	defer lc.joinMu.Unlock()
+
+	return lc.runSettings
+}
+
+// Reconnect starts a new connection and re-joins the lobby as the same player.
+// server resumes the session if it still exists, otherwise client joins as a
+// new one. ErrSeedChanged is returned if lobby's seed is not the same anymore.
+//
+// NOTE(blukai): Reconnect is called automatically when server goes silent.
+func (lc *LobbyClient) Reconnect() error {
+	lc.joinMu.Lock()
+	defer lc.joinMu.Unlock()
+
+	if lc.join == nil {
+		return ErrNotJoined
+	}
+
+	// NOTE(blukai): reliable delivery starts over with the new connection;
+	// server does the same once it receives join with the new nonce.
+	nonce := lc.resetChannel()
+
+	// NOTE(blukai): server may have restarted, its time starts over too.
+	lc.latencyMu.Lock()
+	lc.pongs = lc.pongs[:0]
+	lc.latencyMu.Unlock()
+	lc.playersMu.Lock()
+	lc.clock.Reset()
+	for _, buffer := range lc.buffers {
+		buffer.Reset()
+	}
+	lc.playersMu.Unlock()
+
+	join := *lc.join
+	join.Nonce = protocol.NetworkedID(nonce)
+	session, err := lc.sendJoin(&join)
 	if err != nil {
-		return 0, fmt.Errorf("could not recv: %w", err)
+		return err
 	}
-	if recvCmd.Header.Cmd != protocol.SCmdSetSeed {
-		// TODO(blukai): generalize unexpected cmd err
-		return 0, fmt.Errorf(
-			"received unexpected cmd back (got %d; want %d)",
-			recvCmd.Header.Cmd,
-			protocol.SCmdPong,
-		)
+
+	lc.join = &join
+	if seed := int32(session.Seed); seed != lc.seed {
+		return fmt.Errorf("%w (got %d; want %d)", ErrSeedChanged, seed, lc.seed)
+	}
+	return nil
+}
+
+// Leave tells the server that player left the lobby; other lobby members see
+// the player despawn right away instead of after the server evicts it.
+// ErrNotJoined is returned if client did not join any lobby.
+func (lc *LobbyClient) Leave() error {
+	lc.joinMu.Lock()
+	defer lc.joinMu.Unlock()
+
+	if lc.join == nil {
+		return ErrNotJoined
+	}
+
+	for range leaveCopies {
+		if err := <-lc.sendCmd(protocol.NewCCmdLeave()); err != nil {
+			return fmt.Errorf("could not send: %w", err)
+		}
 	}
 
-	recvSeed, ok := recvCmd.Body.(*protocol.NetworkedInt32)
-	debug.Assert(ok)
+	// NOTE(blukai): session is over; client may join again, but must not
+	// re-join on its own (see Reconnect). server forgot about the
+	// connection, next join starts a new one.
+	lc.join = nil
+	lc.token.Store(0)
+	lc.resetChannel()
+
+	lc.playersMu.Lock()
+	clear(lc.players)
+	clear(lc.changedPlayers)
+	clear(lc.infos)
+	clear(lc.buffers)
+	lc.despawnedPlayers = nil
+	lc.playersMu.Unlock()
+
+	return nil
+}
+
+// handshake says hello to the server and negotiates features. ErrRejected is
+// returned if server refused to talk to the client.
+//
+// NOTE(blukai): lc.joinMu must be held.
+func (lc *LobbyClient) handshake() error {
+	// drop stale hello and error that nobody waited for
+	select {
+	case <-lc.helloCh:
+	default:
+	}
+	select {
+	case <-lc.rejectCh:
+	default:
+	}
+
+	// NOTE(blukai): hello is not reliable (reliable delivery state starts
+	// with join), re-send it the same way reliable cmds are re-sent. each
+	// retry sends one more copy (up to maxHelloCopies) in case the link
+	// loses packets in a pattern that matches request/response.
+	cCmdHello := protocol.NewCCmdHello(protocol.ProtocolVersion, protocol.SupportedFeatures)
+	for attempt := range reliable.MaxAttempts {
+		for range min(attempt+1, maxHelloCopies) {
+			err := <-lc.sendCmd(cCmdHello)
+			if err != nil {
+				return fmt.Errorf("could not send hello: %w", err)
+			}
+		}
+
+		select {
+		case <-time.After(reliable.RetransmitTimeout):
+			continue
+		case err := <-lc.rejectCh:
+			return err
+		case hello := <-lc.helloCh:
+			if hello.Version != protocol.ProtocolVersion {
+				return fmt.Errorf(
+					"%w (got protocol version %d; want %d)",
+					ErrIncompatible,
+					hello.Version,
+					protocol.ProtocolVersion,
+				)
+			}
+			lc.features = uint64(hello.Features) & protocol.SupportedFeatures
+			return nil
+		}
+	}
+
+	// NOTE(blukai): servers that don't know about hello ignore it.
+	return fmt.Errorf("could not recv hello: timeout reached (server may be outdated)")
+}
+
+// sendJoin says hello, reliably sends join and waits for the session.
+//
+// NOTE(blukai): lc.joinMu must be held.
+func (lc *LobbyClient) sendJoin(join *protocol.NetworkedJoin) (*protocol.NetworkedSession, error) {
+	if err := lc.handshake(); err != nil {
+		return nil, err
+	}
+
+	join.Version = protocol.ProtocolVersion
+	join.Features = protocol.NetworkedUint64(lc.features)
+	cCmdJoin := protocol.NewCmd(protocol.CCmdJoin, join)
+
+	// drop stale session that nobody waited for
+	select {
+	case <-lc.sessionCh:
+	default:
+	}
+
+	err := <-lc.sendReliableCmd(cCmdJoin)
+	if err != nil {
+		return nil, fmt.Errorf("could not send: %w", err)
+	}
+
+	// NOTE(blukai): both join and seed are delivered reliably, give them
+	// enough time to be re-sent
+	select {
+	case <-time.After(reliable.RetransmitTimeout * reliable.MaxAttempts):
+		return nil, fmt.Errorf("could not recv: timeout reached")
+	case err := <-lc.rejectCh:
+		return nil, err
+	case session := <-lc.sessionCh:
+		lc.token.Store(uint64(session.Token))
+		return session, nil
+	}
+}
+
+// Latency returns current latency estimates. ok is false if no pong was
+// received yet.
+func (lc *LobbyClient) Latency() (latency Latency, ok bool) {
+	lc.latencyMu.Lock()
+	defer lc.latencyMu.Unlock()
+
+	return lc.latency, len(lc.pongs) > 0
+}
 
-	return int32(*recvSeed), nil
+// Err returns an error that made connection unrecoverable; nil if there's
+// none.
+func (lc *LobbyClient) Err() error {
+	if err := lc.err.Load(); err != nil {
+		return *err
+	}
+	return nil
 }
 
 // SendCCmdTransformPlayer is non-blocking, potential err is ignored
-func (lc *LobbyClient) SendCCmdTransformPlayer(id uint64, x int32, y int32) {
-	cCmdTransformPlayer := protocol.Cmd{
-		Header: &protocol.CmdHeader{
-			Cmd:  protocol.CCmdTransformPlayer,
-			Size: 16,
-		},
-		Body: &protocol.NetworkedTransformPlayer{
-			ID: protocol.NetworkedUint64(id),
-			Transform: protocol.NetworkedInt32Vector2{
-				X: protocol.NetworkedInt32(x),
-				Y: protocol.NetworkedInt32(y),
-			},
-		},
-	}
-	lc.sendCmd(cCmdTransformPlayer)
-}
-
-// TODO(blukai): GetDeltaPlayers or something.. to not have to
-// re-draw(/re-update) things that already are up to date.
+func (lc *LobbyClient) SendCCmdTransformPlayer(player protocol.NetworkedTransformPlayer) {
+	lc.sendCmd(protocol.NewCCmdTransformPlayer(player))
+}
+
+// SendCCmdChat reliably sends a chat message to other lobby members; kind is
+// one of protocol.ChatKind... constants. ErrRateLimited is returned if message
+// was not sent because client sends messages too fast.
+func (lc *LobbyClient) SendCCmdChat(kind uint64, text string) error {
+	lc.joinMu.Lock()
+	join := lc.join
+	lc.joinMu.Unlock()
+	if join == nil {
+		return ErrNotJoined
+	}
+
+	cCmdChat := protocol.NewCCmdChat(uint64(join.ID), kind, text)
+	if err := cCmdChat.Body.(*protocol.NetworkedChat).Validate(); err != nil {
+		return err
+	}
+
+	lc.chatMu.Lock()
+	allowed := lc.chatLimiter.Allow(time.Now())
+	lc.chatMu.Unlock()
+	if !allowed {
+		return ErrRateLimited
+	}
+
+	if err := <-lc.sendReliableCmd(cCmdChat); err != nil {
+		return fmt.Errorf("could not send: %w", err)
+	}
+	return nil
+}
+
+// GetChatMessages returns chat messages received since the previous call,
+// oldest first.
+func (lc *LobbyClient) GetChatMessages() []protocol.NetworkedChat {
+	lc.chatMu.Lock()
+	defer lc.chatMu.Unlock()
+
+	chat := lc.chat
+	lc.chat = nil
+	return chat
+}
+
+// PlayerInfo returns name and metadata of another player; ok is false if
+// player is not known (e.g. it left).
+func (lc *LobbyClient) PlayerInfo(id uint64) (info PlayerInfo, ok bool) {
+	lc.playersMu.Lock()
+	defer lc.playersMu.Unlock()
+
+	networkedInfo, ok := lc.infos[protocol.NetworkedID(id)]
+	if !ok {
+		return info, false
+	}
+	return makePlayerInfo(networkedInfo), true
+}
+
+// GetPlayers returns all known players. consider using GetDeltaPlayers to not
+// have to re-draw(/re-update) things that already are up to date.
 func (lc *LobbyClient) GetPlayers() []*protocol.NetworkedTransformPlayer {
+	lc.playersMu.Lock()
+	defer lc.playersMu.Unlock()
+
 	nel := len(lc.players)
 	players := make([]*protocol.NetworkedTransformPlayer, nel, nel)
 	i := 0
@@ -312,3 +1288,46 @@ func (lc *LobbyClient) GetPlayers() []*protocol.NetworkedTransformPlayer {
 	}
 	return players
 }
+
+// GetDeltaPlayers returns players whose state changed and ids of players
+// that left the lobby since the previous call.
+func (lc *LobbyClient) GetDeltaPlayers() (
+	changed []*protocol.NetworkedTransformPlayer,
+	despawned []protocol.NetworkedID,
+) {
+	lc.playersMu.Lock()
+	defer lc.playersMu.Unlock()
+
+	changed = make([]*protocol.NetworkedTransformPlayer, 0, len(lc.changedPlayers))
+	for id := range lc.changedPlayers {
+		changed = append(changed, lc.players[id])
+		delete(lc.changedPlayers, id)
+	}
+
+	despawned = lc.despawnedPlayers
+	lc.despawnedPlayers = nil
+
+	return changed, despawned
+}
+
+// GetInterpolatedPlayers returns all known players as they should be drawn at
+// local time now: players are moved smoothly between received states; if
+// states are late, players keep moving with their last known velocity for a
+// bit.
+func (lc *LobbyClient) GetInterpolatedPlayers(now time.Time) []protocol.NetworkedTransformPlayer {
+	lc.playersMu.Lock()
+	defer lc.playersMu.Unlock()
+
+	if !lc.clock.Synced() {
+		return nil
+	}
+
+	renderTime := lc.clock.ServerTime(now) - interpolation.Delay
+	players := make([]protocol.NetworkedTransformPlayer, 0, len(lc.buffers))
+	for _, buffer := range lc.buffers {
+		if player, ok := buffer.At(renderTime); ok {
+			players = append(players, player)
+		}
+	}
+	return players
+}
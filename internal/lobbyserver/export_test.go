@@ -0,0 +1,36 @@
+package lobbyserver
+
+import (
+	"net"
+
+	"github.com/blukai/noitaparty/internal/protocol"
+)
+
+// HandlePacket decodes data and handles it synchronously, the way runRecv and
+// runWorker would; data is handled as if it arrived on the first listener.
+func (ls *LobbyServer) HandlePacket(data []byte, addr *net.UDPAddr) error {
+	cmd := protocol.Cmd{}
+	if err := cmd.UnmarshalBinary(data); err != nil {
+		return err
+	}
+	ls.handleCmd(cmd, addr, ls.conns[0])
+	return nil
+}
+
+// Tick runs one tick synchronously.
+func (ls *LobbyServer) Tick() {
+	ls.tick()
+}
+
+// SessionToken returns the token of the session that is bound to addr; 0 if
+// there's none.
+func (ls *LobbyServer) SessionToken(addr *net.UDPAddr) uint64 {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+
+	client, ok := ls.clients[makeAddrKey(addr)]
+	if !ok {
+		return 0
+	}
+	return client.token
+}
@@ -2,51 +2,379 @@ package lobbyserver
 
 import (
 	"context"
+	cryptorand "crypto/rand"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
+	"math"
 	"math/rand"
 	"net"
+	"reflect"
+	"runtime"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/blukai/noitaparty/internal/debug"
+	"github.com/blukai/noitaparty/internal/metrics"
 	"github.com/blukai/noitaparty/internal/protocol"
-	"github.com/blukai/noitaparty/internal/ptr"
+	"github.com/blukai/noitaparty/internal/ratelimit"
+	"github.com/blukai/noitaparty/internal/reliable"
 	"github.com/cespare/xxhash/v2"
 	"github.com/hashicorp/go-multierror"
 	"github.com/phuslu/log"
 )
 
+const (
+	// recvQueueSize is the max amount of received cmds that may wait to be
+	// handled by a single worker; cmds that don't fit are dropped.
+	recvQueueSize = 256
+	// errorCopies is how many copies of SCmdError are sent to a client
+	// that server is done with (see sendError); such client has no channel
+	// to deliver it reliably.
+	errorCopies = 3
+)
+
 type addrKey uint64
 
 func makeAddrKey(addr *net.UDPAddr) addrKey {
 	return addrKey(xxhash.Sum64String(addr.String()))
 }
 
+// makeToken generates an unpredictable session token.
+func makeToken() uint64 {
+	buf := make([]byte, 8)
+	_, err := cryptorand.Read(buf)
+	debug.Assert(err == nil)
+	return binary.BigEndian.Uint64(buf)
+}
+
 type client struct {
-	addr     *net.UDPAddr
+	addr *net.UDPAddr
+	// conn is the socket client's cmds arrive on; client is replied on the
+	// same one.
+	conn     *net.UDPConn
 	lastSeen time.Time
+	lobby    *lobby
+	// NOTE(blukai): id is player's id sent by client in CCmdJoin
+	id protocol.NetworkedID
+	// info is player's name and metadata sent by client in CCmdJoin; it is
+	// sent to other lobby members with spawn.
+	info protocol.NetworkedPlayerInfo
+	// token is issued on join; cmds that don't carry it are rejected.
+	token uint64
+	// nonce identifies client's current connection (see
+	// protocol.NetworkedJoin); it is attached to every cmd sent to the
+	// client.
+	nonce uint64
+	// channel is used to reliably deliver cmds like spawn/despawn.
+	channel *reliable.Channel
+	// features are the protocol features that both, client and server,
+	// support.
+	features uint64
+	// chatLimiter limits the rate of chat messages client may send.
+	chatLimiter *ratelimit.Bucket
+
+	// transform is the latest transform received from the client; nil if
+	// client did not send any yet.
+	transform *protocol.NetworkedTransformPlayer
+	// transformDirty indicates that transform changed since the last tick.
+	transformDirty bool
+	// needsFullSnapshot indicates that client must receive transforms of
+	// all lobby members, not only of those that moved (set on join).
+	needsFullSnapshot bool
+	// nearby holds tokens of lobby members that were within client's area
+	// of interest on the last tick (see InterestConfig).
+	nearby map[uint64]struct{}
+	// farSentAt is when client received transforms of lobby members that
+	// are outside of its area of interest the last time.
+	farSentAt time.Time
+	// refreshedAt is when client received transforms of all lobby members
+	// the last time (see Options.RefreshInterval).
+	refreshedAt time.Time
 }
 
-type LobbyServer struct {
+// lobby is an isolated group of clients that share a seed; commands are never
+// broadcasted across lobby boundaries.
+type lobby struct {
+	name    string
+	clients map[addrKey]*client
+	seed    int32
+	// pinned lobby keeps its seed and is never destroyed, even if empty.
+	pinned bool
+	// emptySince is when the last client left the lobby; empty lobby is
+	// destroyed after LobbyConfig.Retention.
+	emptySince time.Time
+}
+
+// Options tune server's timing and limits. zero fields take values of
+// DefaultOptions.
+type Options struct {
+	// TickInterval determines how often player snapshots are sent out and
+	// unacknowledged reliable cmds are re-sent.
+	TickInterval time.Duration
+	// RefreshInterval determines how often transforms of all players are
+	// sent, whether they moved or not; snapshots are unreliable, this lets
+	// clients recover from lost ones.
+	RefreshInterval time.Duration
+	// EvictionTimeout is how long client may stay silent before it is
+	// evicted. it must be greater than client's silence timeout, otherwise
+	// clients that reconnect could not resume their sessions.
+	EvictionTimeout time.Duration
+	// EvictorInterval determines how often silent clients and empty lobbies
+	// are looked for.
+	EvictorInterval time.Duration
+	// ReadTimeout is how long a read from the socket blocks; it determines
+	// how fast server notices that it must stop.
+	ReadTimeout time.Duration
+	// CmdMaxSize is the max size (in bytes) of a received cmd; larger
+	// packets are dropped. it may be lowered to reject oversized packets
+	// early, but joins with a lot of player's metadata may not fit then.
+	CmdMaxSize int
+}
+
+func DefaultOptions() Options {
+	return Options{
+		TickInterval:    time.Second / 20,
+		RefreshInterval: time.Second,
+		EvictionTimeout: time.Second * 10,
+		EvictorInterval: time.Second,
+		ReadTimeout:     time.Second,
+		CmdMaxSize:      protocol.CmdMaxSize,
+	}
+}
+
+// withDefaults returns a copy of options with zero fields replaced by
+// defaults.
+func (o Options) withDefaults() Options {
+	defaults := DefaultOptions()
+	if o.TickInterval == 0 {
+		o.TickInterval = defaults.TickInterval
+	}
+	if o.RefreshInterval == 0 {
+		o.RefreshInterval = defaults.RefreshInterval
+	}
+	if o.EvictionTimeout == 0 {
+		o.EvictionTimeout = defaults.EvictionTimeout
+	}
+	if o.EvictorInterval == 0 {
+		o.EvictorInterval = defaults.EvictorInterval
+	}
+	if o.ReadTimeout == 0 {
+		o.ReadTimeout = defaults.ReadTimeout
+	}
+	if o.CmdMaxSize == 0 {
+		o.CmdMaxSize = defaults.CmdMaxSize
+	}
+	return o
+}
+
+func (o *Options) Validate() error {
+	// NOTE(blukai): clients draw remote players
+	// protocol.InterpolationDelay in the past; they need at least one
+	// snapshot ahead of that.
+	if o.TickInterval <= 0 || o.TickInterval >= protocol.InterpolationDelay {
+		return fmt.Errorf(
+			"invalid tick interval (got %v; want > 0 and < %v)",
+			o.TickInterval,
+			protocol.InterpolationDelay,
+		)
+	}
+	if o.RefreshInterval < o.TickInterval {
+		return fmt.Errorf(
+			"refresh interval is too short (got %v; want >= %v)",
+			o.RefreshInterval,
+			o.TickInterval,
+		)
+	}
+	if o.EvictorInterval <= 0 {
+		return fmt.Errorf("invalid evictor interval: %v", o.EvictorInterval)
+	}
+	if o.EvictionTimeout < o.EvictorInterval {
+		return fmt.Errorf(
+			"eviction timeout is too short (got %v; want >= %v)",
+			o.EvictionTimeout,
+			o.EvictorInterval,
+		)
+	}
+	if o.ReadTimeout <= 0 {
+		return fmt.Errorf("invalid read timeout: %v", o.ReadTimeout)
+	}
+	// NOTE(blukai): peers never send cmds bigger than protocol.CmdMaxSize;
+	// bigger buffer would be a waste.
+	if o.CmdMaxSize <= protocol.CmdHeaderSize || o.CmdMaxSize > protocol.CmdMaxSize {
+		return fmt.Errorf(
+			"invalid cmd max size (got %d; want > %d and <= %d)",
+			o.CmdMaxSize,
+			protocol.CmdHeaderSize,
+			protocol.CmdMaxSize,
+		)
+	}
+	return nil
+}
+
+var (
+	ErrLobbyNotFound  = errors.New("lobby not found")
+	ErrPlayerNotFound = errors.New("player not found")
+)
+
+// LobbyConfig determines how lobbies are created and kept around.
+type LobbyConfig struct {
+	// Seed, if not nil, is given to every new lobby; otherwise new lobbies
+	// get a random seed.
+	Seed *int32
+	// Retention is how long a lobby (and its seed) is kept around after
+	// the last client left it. this allows everyone to briefly disconnect
+	// without losing the run.
+	Retention time.Duration
+	// RunSettings are sent to clients together with the seed.
+	RunSettings map[string]string
+}
+
+// InterestConfig determines which transforms clients receive at full rate.
+// players that are far from each other don't need to see each other move
+// every tick.
+type InterestConfig struct {
+	// Radius (in pixels) around the player within which other players'
+	// transforms are sent every tick; 0 disables filtering.
+	Radius float64
+	// FarInterval is how often transforms of players outside of Radius are
+	// sent.
+	FarInterval time.Duration
+}
+
+// near reports whether other is within the area of interest of player. player
+// whose position is unknown is interested in everyone.
+func (c *InterestConfig) near(player, other *protocol.NetworkedTransformPlayer) bool {
+	if c.Radius == 0 || player == nil {
+		return true
+	}
+
+	dx := protocol.FromFixedPoint(other.Transform.X) - protocol.FromFixedPoint(player.Transform.X)
+	dy := protocol.FromFixedPoint(other.Transform.Y) - protocol.FromFixedPoint(player.Transform.Y)
+	return dx*dx+dy*dy <= c.Radius*c.Radius
+}
+
+// LobbyStatus describes a lobby and its members (see LobbyServer.Lobbies).
+type LobbyStatus struct {
+	Name    string         `json:"name"`
+	Seed    int32          `json:"seed"`
+	Pinned  bool           `json:"pinned"`
+	Clients []ClientStatus `json:"clients"`
+}
+
+// ClientStatus describes a client that joined a lobby.
+type ClientStatus struct {
+	Addr     string            `json:"addr"`
+	ID       uint64            `json:"id"`
+	Name     string            `json:"name"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+	LastSeen time.Time         `json:"last_seen"`
+	// Position is player's last known position (in pixels); nil if client
+	// did not send any transform yet.
+	Position *Position `json:"position"`
+}
+
+type Position struct {
+	X float64 `json:"x"`
+	Y float64 `json:"y"`
+}
+
+type recvPayload struct {
+	cmd  protocol.Cmd
+	addr *net.UDPAddr
 	conn *net.UDPConn
-	buf  []byte
+}
+
+// Stats contains counters that describe server's load.
+type Stats struct {
+	// RecvPackets is the amount of valid packets that were queued for
+	// handling.
+	RecvPackets uint64
+	// DroppedPackets is the amount of valid packets that were dropped
+	// because workers could not keep up.
+	DroppedPackets uint64
+	// RejectedPackets is the amount of packets that were rejected because
+	// their session token or player id did not match the session.
+	RejectedPackets uint64
+}
+
+type LobbyServer struct {
+	// conns are the sockets server listens on (see Listen); there's one per
+	// address family when server is dual-stack.
+	conns []*net.UDPConn
+
+	options Options
 
 	logger *log.Logger
 
+	// NOTE(blukai): cmds are distributed across workers by sender's
+	// address; this preserves order of cmds sent by a single client and a
+	// peer that floods the server only fills the queue it maps to. workers
+	// don't handle cmds in parallel, handleCmd holds ls.mu; queues only
+	// bound the amount of cmds that wait for it.
+	recvQueues []chan recvPayload
+
+	// metrics holds counters below and more (see Metrics).
+	metrics         *metrics.Registry
+	recvPackets     *metrics.Counter
+	droppedPackets  *metrics.Counter
+	rejectedPackets *metrics.Counter
+	readPackets     *metrics.Counter
+	readBytes       *metrics.Counter
+	readErrors      *metrics.Counter
+	decodeErrors    *metrics.Counter
+	sentPackets     *metrics.Counter
+	sentBytes       *metrics.Counter
+	sendErrors      *metrics.Counter
+	evictedClients  *metrics.Counter
+	packetSize      *metrics.Histogram
+	broadcastFanOut *metrics.Histogram
+	tickDuration    *metrics.Histogram
+
+	// mu guards clients, lobbies and everything reachable from them.
+	mu sync.Mutex
+	// NOTE(blukai): clients contains clients of all lobbies; it is used to
+	// look clients up by address without knowing their lobby.
 	clients map[addrKey]*client
-	seed    int32
+	// sessions indexes clients by token; it is used to recognize clients
+	// that come back from a different address.
+	sessions map[uint64]*client
+	lobbies  map[string]*lobby
+
+	lobbyConfig LobbyConfig
+	// runSettings are lobbyConfig.RunSettings in networked form.
+	runSettings []protocol.NetworkedRunSetting
+
+	interestConfig InterestConfig
+
+	// bans holds ids of players that are not allowed to join.
+	bans map[protocol.NetworkedID]struct{}
+
+	// running is true while Run is running.
+	running atomic.Bool
+
+	// startedAt is the origin of server's time (see serverTime).
+	startedAt time.Time
 }
 
-func NewLobbyServer(network, address string, logger *log.Logger) (*LobbyServer, error) {
-	addr, err := net.ResolveUDPAddr(network, address)
-	if err != nil {
-		return nil, fmt.Errorf("could not resolve udp addr: %w", err)
+// NewLobbyServer constructs a server that listens on the given address. options
+// may be nil, in which case DefaultOptions are used.
+func NewLobbyServer(network, address string, logger *log.Logger, options *Options) (*LobbyServer, error) {
+	var opts Options
+	if options != nil {
+		opts = *options
+	}
+	opts = opts.withDefaults()
+	if err := opts.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid options: %w", err)
 	}
 
-	conn, err := net.ListenUDP(network, addr)
+	conn, err := listenUDP(network, address)
 	if err != nil {
-		return nil, fmt.Errorf("could not listen udp: %w", err)
+		return nil, err
 	}
 
 	// if logger is nil (which might be true in tests) => use default, but
@@ -57,151 +385,960 @@ func NewLobbyServer(network, address string, logger *log.Logger) (*LobbyServer,
 		logger.Writer = &log.IOWriter{Writer: io.Discard}
 	}
 
+	recvQueues := make([]chan recvPayload, runtime.GOMAXPROCS(0))
+	for i := range recvQueues {
+		recvQueues[i] = make(chan recvPayload, recvQueueSize)
+	}
+
 	ls := &LobbyServer{
-		conn: conn,
-		buf:  make([]byte, protocol.CmdMaxSize),
+		conns: []*net.UDPConn{conn},
+
+		options: opts,
 
 		logger: logger,
 
-		clients: make(map[addrKey]*client),
-		seed:    0,
+		recvQueues: recvQueues,
+
+		clients:  make(map[addrKey]*client),
+		sessions: make(map[uint64]*client),
+		lobbies:  make(map[string]*lobby),
+		bans:     make(map[protocol.NetworkedID]struct{}),
+
+		startedAt: time.Now(),
 	}
+	ls.registerMetrics()
 
 	return ls, nil
 }
 
+func (ls *LobbyServer) registerMetrics() {
+	r := metrics.NewRegistry()
+	ls.metrics = r
+
+	ls.readPackets = r.NewCounter(
+		"noitaparty_server_read_packets_total",
+		"Packets read from the socket, including invalid ones.",
+	)
+	ls.readBytes = r.NewCounter(
+		"noitaparty_server_read_bytes_total",
+		"Bytes read from the socket.",
+	)
+	ls.readErrors = r.NewCounter(
+		"noitaparty_server_read_errors_total",
+		"Failed socket reads, excluding timeouts.",
+	)
+	ls.decodeErrors = r.NewCounter(
+		"noitaparty_server_decode_errors_total",
+		"Packets that could not be decoded.",
+	)
+	ls.recvPackets = r.NewCounter(
+		"noitaparty_server_recv_packets_total",
+		"Valid packets that were queued for handling.",
+	)
+	ls.droppedPackets = r.NewCounter(
+		"noitaparty_server_dropped_packets_total",
+		"Valid packets that were dropped because workers could not keep up.",
+	)
+	ls.rejectedPackets = r.NewCounter(
+		"noitaparty_server_rejected_packets_total",
+		"Packets that were rejected because they did not match the session or were invalid.",
+	)
+	ls.sentPackets = r.NewCounter(
+		"noitaparty_server_sent_packets_total",
+		"Packets written to the socket.",
+	)
+	ls.sentBytes = r.NewCounter(
+		"noitaparty_server_sent_bytes_total",
+		"Bytes written to the socket.",
+	)
+	ls.sendErrors = r.NewCounter(
+		"noitaparty_server_send_errors_total",
+		"Failed socket writes.",
+	)
+	ls.evictedClients = r.NewCounter(
+		"noitaparty_server_evicted_clients_total",
+		"Clients that were evicted because they went silent or stopped acknowledging reliable cmds.",
+	)
+	ls.packetSize = r.NewHistogram(
+		"noitaparty_server_read_packet_size_bytes",
+		"Size of packets read from the socket.",
+		metrics.ExponentialBuckets(32, 2, 6),
+	)
+	ls.broadcastFanOut = r.NewHistogram(
+		"noitaparty_server_broadcast_recipients",
+		"Amount of clients a reliable broadcast was sent to.",
+		metrics.ExponentialBuckets(1, 2, 6),
+	)
+	ls.tickDuration = r.NewHistogram(
+		"noitaparty_server_tick_duration_seconds",
+		"Time it took to run a tick.",
+		metrics.ExponentialBuckets(0.0001, 4, 6),
+	)
+
+	r.NewGaugeFunc(
+		"noitaparty_server_clients",
+		"Clients that joined a lobby.",
+		func() float64 {
+			ls.mu.Lock()
+			defer ls.mu.Unlock()
+			return float64(len(ls.clients))
+		},
+	)
+	r.NewGaugeFunc(
+		"noitaparty_server_lobbies",
+		"Lobbies, including empty ones that are retained.",
+		func() float64 {
+			ls.mu.Lock()
+			defer ls.mu.Unlock()
+			return float64(len(ls.lobbies))
+		},
+	)
+}
+
+// Metrics returns server's metrics; registry may be served to prometheus as is.
+func (ls *LobbyServer) Metrics() *metrics.Registry {
+	return ls.metrics
+}
+
+func listenUDP(network, address string) (*net.UDPConn, error) {
+	addr, err := net.ResolveUDPAddr(network, address)
+	if err != nil {
+		return nil, fmt.Errorf("could not resolve udp addr: %w", err)
+	}
+
+	conn, err := net.ListenUDP(network, addr)
+	if err != nil {
+		return nil, fmt.Errorf("could not listen udp: %w", err)
+	}
+	return conn, nil
+}
+
+// Listen makes server listen on one more address (e.g. on ipv6 in addition to
+// ipv4); all listeners share lobbies. it must be called before Run.
+func (ls *LobbyServer) Listen(network, address string) error {
+	if ls.running.Load() {
+		return errors.New("server is already running")
+	}
+
+	conn, err := listenUDP(network, address)
+	if err != nil {
+		return err
+	}
+	ls.conns = append(ls.conns, conn)
+	return nil
+}
+
 // Addr can be useful to retreive server's address when LobbyServer was
-// constructed with ":0".
+// constructed with ":0". it is the address that was given to NewLobbyServer.
 func (ls *LobbyServer) Addr() *net.UDPAddr {
-	return ls.conn.LocalAddr().(*net.UDPAddr)
+	return ls.conns[0].LocalAddr().(*net.UDPAddr)
 }
 
-func (ls *LobbyServer) runRecv(ctx context.Context) {
+// Addrs returns addresses of all listeners, in the order they were added.
+func (ls *LobbyServer) Addrs() []*net.UDPAddr {
+	addrs := make([]*net.UDPAddr, len(ls.conns))
+	for i, conn := range ls.conns {
+		addrs[i] = conn.LocalAddr().(*net.UDPAddr)
+	}
+	return addrs
+}
+
+// SetLobbyConfig replaces lobby config; it does not affect existing lobbies,
+// but run settings are sent to everyone who joins afterwards.
+func (ls *LobbyServer) SetLobbyConfig(config LobbyConfig) error {
+	runSettings := make([]protocol.NetworkedRunSetting, 0, len(config.RunSettings))
+	for key, value := range config.RunSettings {
+		runSettings = append(runSettings, protocol.NetworkedRunSetting{
+			Key:   protocol.NetworkedString(key),
+			Value: protocol.NetworkedString(value),
+		})
+	}
+
+	// NOTE(blukai): settings are sent within a single cmd, make sure that
+	// they fit even if token and seed take the max amount of bytes.
+	session := protocol.NetworkedSession{
+		Token:    math.MaxUint64,
+		Seed:     math.MinInt32,
+		Settings: runSettings,
+	}
+	sessionBytes, err := session.MarshalBinary()
+	if err != nil {
+		return fmt.Errorf("invalid run settings: %w", err)
+	}
+	if size := protocol.CmdHeaderSize + len(sessionBytes); size > protocol.CmdMaxSize {
+		return fmt.Errorf(
+			"run settings are too big (got %d; want <= %d)",
+			size,
+			protocol.CmdMaxSize,
+		)
+	}
+
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+
+	ls.lobbyConfig = config
+	ls.runSettings = runSettings
+
+	return nil
+}
+
+// SetInterestConfig replaces interest config; it takes effect on next tick.
+func (ls *LobbyServer) SetInterestConfig(config InterestConfig) error {
+	if config.Radius < 0 || math.IsNaN(config.Radius) {
+		return fmt.Errorf("invalid radius: %v", config.Radius)
+	}
+	if config.Radius > 0 && config.FarInterval < ls.options.TickInterval {
+		return fmt.Errorf(
+			"far interval is too short (got %v; want >= %v)",
+			config.FarInterval,
+			ls.options.TickInterval,
+		)
+	}
+
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+
+	ls.interestConfig = config
+
+	return nil
+}
+
+// PinLobbySeed makes lobby use the given seed; lobby is created if it does not
+// exist. pinned lobby is never destroyed.
+//
+// NOTE(blukai): clients that already are in the lobby keep playing their run;
+// new seed is given to those who join afterwards.
+func (ls *LobbyServer) PinLobbySeed(name string, seed int32) error {
+	if len(name) > protocol.LobbyNameMaxLen {
+		return fmt.Errorf(
+			"lobby name is too long (got %d; want <= %d)",
+			len(name),
+			protocol.LobbyNameMaxLen,
+		)
+	}
+
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+
+	lby, ok := ls.lobbies[name]
+	if !ok {
+		lby = ls.createLobby(name)
+	}
+	lby.seed = seed
+	lby.pinned = true
+
+	return nil
+}
+
+// UnpinLobbySeed lets lobby be destroyed once it is empty; lobby keeps its
+// seed until then.
+func (ls *LobbyServer) UnpinLobbySeed(name string) error {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+
+	lby, ok := ls.lobbies[name]
+	if !ok {
+		return ErrLobbyNotFound
+	}
+	lby.pinned = false
+	if len(lby.clients) == 0 {
+		lby.emptySince = time.Now()
+	}
+
+	return nil
+}
+
+// RotateLobbySeed gives lobby a new random seed and returns it.
+//
+// NOTE(blukai): clients that already are in the lobby keep playing their run;
+// new seed is given to those who join afterwards.
+func (ls *LobbyServer) RotateLobbySeed(name string) (int32, error) {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+
+	lby, ok := ls.lobbies[name]
+	if !ok {
+		return 0, ErrLobbyNotFound
+	}
+	lby.seed = rand.Int31()
+
+	return lby.seed, nil
+}
+
+// LobbySeed returns lobby's current seed.
+func (ls *LobbyServer) LobbySeed(name string) (int32, error) {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+
+	lby, ok := ls.lobbies[name]
+	if !ok {
+		return 0, ErrLobbyNotFound
+	}
+	return lby.seed, nil
+}
+
+// SetLobbySeed gives lobby the given seed; unlike PinLobbySeed it neither
+// creates nor pins the lobby.
+//
+// NOTE(blukai): clients that already are in the lobby keep playing their run;
+// new seed is given to those who join afterwards.
+func (ls *LobbyServer) SetLobbySeed(name string, seed int32) error {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+
+	lby, ok := ls.lobbies[name]
+	if !ok {
+		return ErrLobbyNotFound
+	}
+	lby.seed = seed
+
+	return nil
+}
+
+// Lobbies returns status of every lobby sorted by name; clients are sorted by
+// player id.
+func (ls *LobbyServer) Lobbies() []LobbyStatus {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+
+	lobbies := make([]LobbyStatus, 0, len(ls.lobbies))
+	for _, lby := range ls.lobbies {
+		clients := make([]ClientStatus, 0, len(lby.clients))
+		for _, c := range lby.clients {
+			status := ClientStatus{
+				Addr:     c.addr.String(),
+				ID:       uint64(c.id),
+				Name:     string(c.info.Name),
+				LastSeen: c.lastSeen,
+			}
+			if len(c.info.Metadata) > 0 {
+				status.Metadata = make(map[string]string, len(c.info.Metadata))
+				for _, md := range c.info.Metadata {
+					status.Metadata[string(md.Key)] = string(md.Value)
+				}
+			}
+			if c.transform != nil {
+				status.Position = &Position{
+					X: protocol.FromFixedPoint(c.transform.Transform.X),
+					Y: protocol.FromFixedPoint(c.transform.Transform.Y),
+				}
+			}
+			clients = append(clients, status)
+		}
+		sort.Slice(clients, func(i, j int) bool {
+			return clients[i].ID < clients[j].ID
+		})
+
+		lobbies = append(lobbies, LobbyStatus{
+			Name:    lby.name,
+			Seed:    lby.seed,
+			Pinned:  lby.pinned,
+			Clients: clients,
+		})
+	}
+	sort.Slice(lobbies, func(i, j int) bool {
+		return lobbies[i].Name < lobbies[j].Name
+	})
+
+	return lobbies
+}
+
+// KickPlayer removes player from the lobby; player's client is told why, but
+// it may join again.
+func (ls *LobbyServer) KickPlayer(lobbyName string, id uint64) error {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+
+	lby, ok := ls.lobbies[lobbyName]
+	if !ok {
+		return ErrLobbyNotFound
+	}
+	for clientAddrKey, c := range lby.clients {
+		if c.id == protocol.NetworkedID(id) {
+			ls.kickClient(clientAddrKey, c, protocol.ErrCodeKicked, "kicked by server operator")
+			return nil
+		}
+	}
+	return ErrPlayerNotFound
+}
+
+// BanPlayer kicks player out of every lobby and does not let it join again
+// until it is unbanned.
+func (ls *LobbyServer) BanPlayer(id uint64) {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+
+	ls.bans[protocol.NetworkedID(id)] = struct{}{}
+	for clientAddrKey, c := range ls.clients {
+		if c.id == protocol.NetworkedID(id) {
+			ls.kickClient(clientAddrKey, c, protocol.ErrCodeBanned, "banned by server operator")
+		}
+	}
+}
+
+// UnbanPlayer lets banned player join again.
+func (ls *LobbyServer) UnbanPlayer(id uint64) {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+
+	delete(ls.bans, protocol.NetworkedID(id))
+}
+
+// Bans returns sorted ids of banned players.
+func (ls *LobbyServer) Bans() []uint64 {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+
+	bans := make([]uint64, 0, len(ls.bans))
+	for id := range ls.bans {
+		bans = append(bans, uint64(id))
+	}
+	sort.Slice(bans, func(i, j int) bool {
+		return bans[i] < bans[j]
+	})
+	return bans
+}
+
+// Ready reports whether server is running and handles cmds.
+func (ls *LobbyServer) Ready() bool {
+	return ls.running.Load()
+}
+
+// createLobby creates a lobby with the seed determined by lobby config.
+//
+// NOTE(blukai): ls.mu must be held.
+func (ls *LobbyServer) createLobby(name string) *lobby {
+	seed := rand.Int31()
+	if ls.lobbyConfig.Seed != nil {
+		seed = *ls.lobbyConfig.Seed
+	}
+
+	lby := &lobby{
+		name:       name,
+		clients:    make(map[addrKey]*client),
+		seed:       seed,
+		emptySince: time.Now(),
+	}
+	ls.lobbies[name] = lby
+	ls.logger.Debug().
+		Str("lobby", name).
+		Msg("created lobby")
+
+	return lby
+}
+
+// Stats returns a snapshot of server's counters.
+func (ls *LobbyServer) Stats() Stats {
+	return Stats{
+		RecvPackets:     ls.recvPackets.Load(),
+		DroppedPackets:  ls.droppedPackets.Load(),
+		RejectedPackets: ls.rejectedPackets.Load(),
+	}
+}
+
+func (ls *LobbyServer) runRecv(ctx context.Context, conn *net.UDPConn) {
+	// NOTE(blukai): packets that don't fit are truncated and fail to
+	// decode.
+	buf := make([]byte, ls.options.CmdMaxSize)
 	for {
 		select {
 		case <-ctx.Done():
 			return
 		default:
-			err := ls.conn.SetReadDeadline(time.Now().Add(time.Second))
+			err := conn.SetReadDeadline(time.Now().Add(ls.options.ReadTimeout))
 			debug.Assert(err == nil)
 
-			n, addr, err := ls.conn.ReadFromUDP(ls.buf)
+			n, addr, err := conn.ReadFromUDP(buf)
 			if err != nil {
 				if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
 					continue
 				}
 
+				ls.readErrors.Inc()
 				ls.logger.Error().
 					Msgf("could not read from udp: %v", err)
 				continue
 			}
-			if n < protocol.CmdHeaderSize {
-				ls.logger.Error().
-					Msgf("invalid msg size (got %d; want >= %d)", n, protocol.CmdHeaderSize)
-				continue
-			}
+			ls.readPackets.Inc()
+			ls.readBytes.Add(uint64(n))
+			ls.packetSize.Observe(float64(n))
 
+			// NOTE(blukai): decoded cmd does not reference buf, it is
+			// safe to pass it to a worker and reuse buf.
 			cmd := protocol.Cmd{}
-			if err := cmd.UnmarshalBinary(ls.buf); err != nil {
+			if err := cmd.UnmarshalBinary(buf[0:n]); err != nil {
+				ls.decodeErrors.Inc()
 				ls.logger.Error().
-					Str("bytes", fmt.Sprintf("%v", ls.buf[0:n])).
+					Str("bytes", fmt.Sprintf("%v", buf[0:n])).
 					Msgf("could not unmarshal cmd: %v", err)
 				continue
 			}
 
-			client, ok := ls.clients[makeAddrKey(addr)]
-			// client is created in handleCCmdJoin func
-			if ok {
-				client.lastSeen = time.Now()
-			}
-
 			ls.logger.Debug().
 				Any("cmd", &cmd).
 				Any("addr", addr).
 				Msgf("recv")
 
-			// TODO(blukai): can this spawn a shit ton of go routines?
-			go ls.handleCmd(cmd, addr)
+			// never block on a busy worker, drop instead.
+			recvQueue := ls.recvQueues[uint64(makeAddrKey(addr))%uint64(len(ls.recvQueues))]
+			select {
+			case recvQueue <- recvPayload{cmd: cmd, addr: addr, conn: conn}:
+				ls.recvPackets.Inc()
+			default:
+				ls.droppedPackets.Inc()
+				ls.logger.Debug().
+					Any("addr", addr).
+					Msg("recv queue is full, dropping cmd")
+			}
+		}
+	}
+}
+
+func (ls *LobbyServer) runWorker(ctx context.Context, recvQueue <-chan recvPayload) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case payload := <-recvQueue:
+			ls.handleCmd(payload.cmd, payload.addr, payload.conn)
 		}
 	}
 }
 
-// TODO(blukai): how to handle re-connects? get rid of join message? send seed
-// together with probably https "authentication" response?
+// NOTE(blukai): clients that come back before they are evicted resume their
+// session (see handleCmd and handleCCmdJoin); those that come back later join
+// as new clients.
 func (ls *LobbyServer) runClientEvictor(ctx context.Context) {
 	for {
 		select {
 		case <-ctx.Done():
 			return
-		case <-time.After(time.Second):
+		case <-time.After(ls.options.EvictorInterval):
+			ls.mu.Lock()
 			now := time.Now()
 			for clientAddrKey, client := range ls.clients {
-				if now.Sub(client.lastSeen) > time.Second*10 {
-					delete(ls.clients, clientAddrKey)
+				if now.Sub(client.lastSeen) > ls.options.EvictionTimeout {
+					ls.removeClient(clientAddrKey, client)
+					ls.evictedClients.Inc()
 					ls.logger.Debug().
 						Str("client", fmt.Sprintf("%+#v", client)).
 						Msg("evicted client")
 				}
 			}
+			for _, lobby := range ls.lobbies {
+				if len(lobby.clients) == 0 && !lobby.pinned &&
+					now.Sub(lobby.emptySince) > ls.lobbyConfig.Retention {
+					ls.destroyLobby(lobby)
+				}
+			}
+			ls.mu.Unlock()
+		}
+	}
+}
+
+// removeClient removes client from the server and from its lobby and notifies
+// remaining lobby members. lobby is destroyed once last client leaves it,
+// unless it must be retained (see LobbyConfig.Retention).
+//
+// NOTE(blukai): ls.mu must be held.
+func (ls *LobbyServer) removeClient(clientAddrKey addrKey, client *client) {
+	delete(ls.clients, clientAddrKey)
+	delete(ls.sessions, client.token)
+
+	lobby := client.lobby
+	delete(lobby.clients, clientAddrKey)
+	if len(lobby.clients) == 0 {
+		lobby.emptySince = time.Now()
+		if !lobby.pinned && ls.lobbyConfig.Retention == 0 {
+			ls.destroyLobby(lobby)
+		}
+		return
+	}
+
+	sCmdDespawnPlayer := protocol.NewSCmdDespawnPlayer(uint64(client.id))
+	if err := ls.broadcastReliableCmd(sCmdDespawnPlayer, lobby, clientAddrKey); err != nil {
+		ls.logger.Error().
+			Msgf("could not broadcast despawn of %v: %v", client, err)
+	}
+}
+
+// sendError tells client's connection why server is done with it (see
+// errorCopies).
+//
+// NOTE(blukai): ls.mu must be held.
+func (ls *LobbyServer) sendError(client *client, code uint64, message string) {
+	sCmdError := protocol.NewSCmdError(code, message)
+	sCmdError.Header.Token = client.nonce
+	for range errorCopies {
+		if err := ls.sendCmd(sCmdError, client.conn, client.addr); err != nil {
+			ls.logger.Error().
+				Msgf("could not send error to %v: %v", client, err)
+		}
+	}
+}
+
+// kickClient tells client why it is being removed and removes it (see
+// removeClient).
+//
+// NOTE(blukai): ls.mu must be held.
+func (ls *LobbyServer) kickClient(clientAddrKey addrKey, client *client, code uint64, message string) {
+	ls.sendError(client, code, message)
+	ls.removeClient(clientAddrKey, client)
+	ls.logger.Info().
+		Str("lobby", client.lobby.name).
+		Uint64("id", uint64(client.id)).
+		Msg(message)
+}
+
+// NOTE(blukai): ls.mu must be held.
+func (ls *LobbyServer) destroyLobby(lobby *lobby) {
+	delete(ls.lobbies, lobby.name)
+	ls.logger.Debug().
+		Str("lobby", lobby.name).
+		Msg("destroyed lobby")
+}
+
+// migrateClient moves client to a new address; this happens when client's
+// address changes mid-session (e.g. nat rebinding). new address may even be of
+// a different family if server is dual-stack.
+//
+// NOTE(blukai): ls.mu must be held.
+func (ls *LobbyServer) migrateClient(client *client, addr *net.UDPAddr, conn *net.UDPConn) {
+	prevAddrKey := makeAddrKey(client.addr)
+	delete(ls.clients, prevAddrKey)
+	delete(client.lobby.clients, prevAddrKey)
+
+	ls.logger.Debug().
+		Any("from", client.addr).
+		Any("to", addr).
+		Msg("migrated client")
+
+	clientAddrKey := makeAddrKey(addr)
+	client.addr = addr
+	client.conn = conn
+	ls.clients[clientAddrKey] = client
+	client.lobby.clients[clientAddrKey] = client
+}
+
+func (ls *LobbyServer) runTicker(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(ls.options.TickInterval):
+			ls.tick()
+		}
+	}
+}
+
+// outgoingCmd is a cmd that is built while ls.mu is held and sent after it
+// is released.
+type outgoingCmd struct {
+	cmd  protocol.Cmd
+	conn *net.UDPConn
+	addr *net.UDPAddr
+}
+
+// tick re-sends unacknowledged reliable cmds and sends each client a snapshot
+// of other lobby members' transforms.
+func (ls *LobbyServer) tick() {
+	now := time.Now()
+	defer func() {
+		ls.tickDuration.Observe(time.Since(now).Seconds())
+	}()
+
+	// NOTE(blukai): cmds are sent after ls.mu is released; workers don't
+	// have to wait for all the writes to the socket.
+	for _, outgoing := range ls.prepareTick(now) {
+		if err := ls.sendCmd(outgoing.cmd, outgoing.conn, outgoing.addr); err != nil {
+			ls.logger.Error().
+				Msgf("could not send cmd %d to %v: %v", outgoing.cmd.Header.Cmd, outgoing.addr, err)
+		}
+	}
+}
+
+// prepareTick returns cmds that must be sent on tick (see tick).
+func (ls *LobbyServer) prepareTick(now time.Time) []outgoingCmd {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+
+	var outgoing []outgoingCmd
+
+	for clientAddrKey, client := range ls.clients {
+		cmds, err := client.channel.Retransmit(now)
+		if err != nil {
+			ls.removeClient(clientAddrKey, client)
+			ls.evictedClients.Inc()
+			ls.logger.Debug().
+				Str("client", fmt.Sprintf("%+#v", client)).
+				Msgf("evicted client: %v", err)
+			continue
+		}
+		for _, cmd := range cmds {
+			outgoing = append(outgoing, outgoingCmd{cmd, client.conn, client.addr})
+		}
+	}
+
+	snapshotTime := ls.serverTime(now)
+	interest := &ls.interestConfig
+	for _, lobby := range ls.lobbies {
+		for receiverAddrKey, receiver := range lobby.clients {
+			// NOTE(blukai): players that stand still are not sent
+			// every tick; receiver that lost their last snapshot
+			// would not see them move until they do, unless they are
+			// re-sent once in a while.
+			refreshDue := receiver.needsFullSnapshot || now.Sub(receiver.refreshedAt) >= ls.options.RefreshInterval
+			if refreshDue {
+				receiver.refreshedAt = now
+			}
+			// NOTE(blukai): far players are sent all at once, whether
+			// they moved or not; the rate is low anyway.
+			farDue := refreshDue || now.Sub(receiver.farSentAt) >= interest.FarInterval
+			if farDue {
+				receiver.farSentAt = now
+			}
+
+			nearby := make(map[uint64]struct{}, len(receiver.nearby))
+			players := make([]protocol.NetworkedTransformPlayer, 0, len(lobby.clients)-1)
+			for clientAddrKey, client := range lobby.clients {
+				// don't send player's transform back to the player
+				if clientAddrKey == receiverAddrKey || client.transform == nil {
+					continue
+				}
+
+				if !interest.near(receiver.transform, client.transform) {
+					if farDue {
+						players = append(players, *client.transform)
+					}
+					continue
+				}
+
+				// NOTE(blukai): player that just came close may have
+				// stopped while it was far; its latest transform was
+				// not necessarily sent.
+				_, wasNearby := receiver.nearby[client.token]
+				nearby[client.token] = struct{}{}
+				if client.transformDirty || refreshDue || !wasNearby {
+					players = append(players, *client.transform)
+				}
+			}
+			receiver.nearby = nearby
+			receiver.needsFullSnapshot = false
+
+			outgoing = appendPlayerSnapshots(outgoing, snapshotTime, players, receiver)
+		}
+
+		for _, client := range lobby.clients {
+			client.transformDirty = false
 		}
 	}
+
+	return outgoing
+}
+
+// serverTime returns milliseconds elapsed since server started; it is
+// monotonic.
+func (ls *LobbyServer) serverTime(now time.Time) uint64 {
+	return uint64(now.Sub(ls.startedAt).Milliseconds())
+}
+
+// appendPlayerSnapshots packs players into as few SCmdPlayerSnapshot cmds as
+// possible and appends them to outgoing.
+func appendPlayerSnapshots(
+	outgoing []outgoingCmd,
+	snapshotTime uint64,
+	players []protocol.NetworkedTransformPlayer,
+	receiver *client,
+) []outgoingCmd {
+	for len(players) > 0 {
+		n := min(len(players), protocol.PlayerSnapshotMaxLen)
+
+		sCmdPlayerSnapshot := protocol.NewSCmdPlayerSnapshot(snapshotTime, players[:n])
+		sCmdPlayerSnapshot.Header.Token = receiver.nonce
+		outgoing = append(outgoing, outgoingCmd{sCmdPlayerSnapshot, receiver.conn, receiver.addr})
+
+		players = players[n:]
+	}
+	return outgoing
 }
 
 func (ls *LobbyServer) Run(ctx context.Context) error {
 	wg := &sync.WaitGroup{}
 
+	for _, conn := range ls.conns {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ls.runRecv(ctx, conn)
+		}()
+	}
+
+	for _, recvQueue := range ls.recvQueues {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ls.runWorker(ctx, recvQueue)
+		}()
+	}
+
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
-		ls.runRecv(ctx)
+		ls.runClientEvictor(ctx)
 	}()
 
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
-		ls.runClientEvictor(ctx)
+		ls.runTicker(ctx)
 	}()
 
+	ls.running.Store(true)
+
 	select {
 	case <-ctx.Done():
+		ls.running.Store(false)
 		wg.Wait()
-		return ls.conn.Close()
+
+		var errs error
+		for _, conn := range ls.conns {
+			if err := conn.Close(); err != nil {
+				errs = multierror.Append(errs, err)
+			}
+		}
+		return errs
+	}
+}
+
+func (ls *LobbyServer) handleCmd(cmd protocol.Cmd, addr *net.UDPAddr, conn *net.UDPConn) {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+
+	var (
+		channel *reliable.Channel
+		nonce   uint64
+	)
+	client, ok := ls.clients[makeAddrKey(addr)]
+	if !ok && cmd.Header.Token != 0 {
+		// NOTE(blukai): client's address may change mid-session (nat
+		// rebinding, re-created socket, etc.); token identifies the
+		// session regardless of the address.
+		if client, ok = ls.sessions[cmd.Header.Token]; ok {
+			ls.migrateClient(client, addr, conn)
+		}
+	}
+	// client is created in handleCCmdJoin func
+	if ok {
+		// NOTE(blukai): anyone can send a packet with a spoofed source
+		// address; only those who know the token can act on behalf of
+		// the session. ping and hello are allowed because they carry
+		// no state.
+		if cmd.Header.Token != client.token &&
+			cmd.Header.Cmd != protocol.CCmdPing &&
+			cmd.Header.Cmd != protocol.CCmdHello {
+			ls.rejectedPackets.Inc()
+			ls.logger.Debug().
+				Any("cmd", &cmd).
+				Any("addr", addr).
+				Msg("rejected cmd with invalid token")
+			return
+		}
+
+		client.lastSeen = time.Now()
+		// NOTE(blukai): server may listen on more than one address of
+		// the same family; client may switch between them.
+		client.conn = conn
+		channel = client.channel
+		nonce = client.nonce
+	} else {
+		// NOTE(blukai): peers that did not join yet get a fresh channel
+		// which is adopted by handleCCmdJoin.
+		channel = reliable.NewChannel()
+	}
+
+	// NOTE(blukai): join with a new nonce means that client reconnected
+	// and started its reliable delivery over; so must the server.
+	if join, isJoin := cmd.Body.(*protocol.NetworkedJoin); isJoin && uint64(join.Nonce) != nonce {
+		if ok {
+			channel = reliable.NewChannel()
+		}
+		nonce = uint64(join.Nonce)
+	}
+
+	cmds, ack := channel.Recv(cmd)
+	if ack {
+		ackCmd := channel.Ack(protocol.SCmdAck)
+		ackCmd.Header.Token = nonce
+		if err := ls.sendCmd(ackCmd, conn, addr); err != nil {
+			ls.logger.Error().
+				Msgf("could not send ack to %s: %v", addr.String(), err)
+		}
+	}
+
+	for _, cmd := range cmds {
+		ls.dispatchCmd(cmd, addr, conn, channel)
 	}
 }
 
-func (ls *LobbyServer) handleCmd(cmd protocol.Cmd, addr *net.UDPAddr) {
+// NOTE(blukai): ls.mu must be held.
+func (ls *LobbyServer) dispatchCmd(
+	cmd protocol.Cmd,
+	addr *net.UDPAddr,
+	conn *net.UDPConn,
+	channel *reliable.Channel,
+) {
 	var err error
 
 	switch cmd.Header.Cmd {
 	case protocol.CCmdPing:
-		err = ls.handleCCmdPing(addr)
+		err = ls.handleCCmdPing(&cmd, addr, conn)
+	case protocol.CCmdHello:
+		err = ls.handleCCmdHello(&cmd, addr, conn)
 	case protocol.CCmdJoin:
-		err = ls.handleCCmdJoin(&cmd, addr)
+		err = ls.handleCCmdJoin(&cmd, addr, conn, channel)
 	case protocol.CCmdTransformPlayer:
 		err = ls.handleCCmdTransformPlayer(&cmd, addr)
 	case protocol.CCmdKeepAlive:
-		// ignore keep alive because lastSeen is being maintained by
-		// runRecv func
+		// NOTE(blukai): lastSeen is being maintained by handleCmd func
+		err = ls.handleCCmdKeepAlive(addr, conn)
+	case protocol.CCmdChat:
+		err = ls.handleCCmdChat(&cmd, addr)
+	case protocol.CCmdLeave:
+		err = ls.handleCCmdLeave(addr)
+	case protocol.CCmdAck:
+		// ignore ack because it is being processed by the channel in
+		// handleCmd func
 	default:
-		debug.Assert(false, fmt.Sprintf("unhandled cmd: %d", cmd.Header.Cmd))
+		// NOTE(blukai): cmds come from the network; peer may send
+		// anything, including server cmds.
+		ls.rejectedPackets.Inc()
+		err = fmt.Errorf("unexpected cmd: %d", cmd.Header.Cmd)
 	}
 
 	if err != nil {
 		ls.logger.Error().
-			Msgf("error handling message (addr: %s; cmd: %v)", addr.String(), cmd)
+			Msgf("error handling message (addr: %s; cmd: %v): %v", addr.String(), cmd, err)
 	}
 }
 
-func (ls *LobbyServer) sendBytes(bytes []byte, addr *net.UDPAddr) error {
+func (ls *LobbyServer) sendBytes(bytes []byte, conn *net.UDPConn, addr *net.UDPAddr) error {
 	ls.logger.Debug().
 		Str("bytes", fmt.Sprintf("%v", bytes)).
 		Msg("sendBytes")
 
-	_, err := ls.conn.WriteToUDP(bytes, addr)
-	return err
+	n, err := conn.WriteToUDP(bytes, addr)
+	if err != nil {
+		ls.sendErrors.Inc()
+		return err
+	}
+	ls.sentPackets.Inc()
+	ls.sentBytes.Add(uint64(n))
+	return nil
 }
 
-func (ls *LobbyServer) sendCmd(cmd protocol.Cmd, addr *net.UDPAddr) error {
+// sendCmd sends cmd to addr through conn, which must be the socket addr's cmds
+// arrive on.
+func (ls *LobbyServer) sendCmd(cmd protocol.Cmd, conn *net.UDPConn, addr *net.UDPAddr) error {
 	ls.logger.Debug().
 		Any("cmd", &cmd).
 		Any("addr", addr).
@@ -210,53 +1347,309 @@ func (ls *LobbyServer) sendCmd(cmd protocol.Cmd, addr *net.UDPAddr) error {
 	bytes, err := cmd.MarshalBinary()
 	debug.Assert(err == nil)
 
-	return ls.sendBytes(bytes, addr)
+	return ls.sendBytes(bytes, conn, addr)
 }
 
-func (ls *LobbyServer) handleCCmdPing(addr *net.UDPAddr) error {
-	sCmdPong := protocol.Cmd{
-		Header: &protocol.CmdHeader{
-			Cmd:  protocol.SCmdPong,
-			Size: 0,
-		},
-		Body: nil,
+// sendReliableCmd sends cmd to the client; cmd is re-sent on tick until client
+// acknowledges it.
+//
+// NOTE(blukai): ls.mu must be held.
+func (ls *LobbyServer) sendReliableCmd(cmd protocol.Cmd, client *client) error {
+	// NOTE(blukai): header is copied because cmd may be shared (e.g. in
+	// broadcasts), but nonce differs per client.
+	header := *cmd.Header
+	header.Token = client.nonce
+	cmd = protocol.Cmd{Header: &header, Body: cmd.Body}
+
+	return ls.sendCmd(client.channel.Send(cmd, time.Now()), client.conn, client.addr)
+}
+
+// broadcastReliableCmd reliably sends cmd to every client of the lobby except
+// the one identified by exceptAddrKey (which usually is the sender).
+//
+// NOTE(blukai): ls.mu must be held.
+func (ls *LobbyServer) broadcastReliableCmd(cmd protocol.Cmd, lobby *lobby, exceptAddrKey addrKey) error {
+	ls.logger.Debug().
+		Any("cmd", &cmd).
+		Str("lobby", lobby.name).
+		Msg("broadcastReliableCmd")
+
+	var (
+		errs       error
+		recipients int
+	)
+	for clientAddrKey, client := range lobby.clients {
+		if clientAddrKey == exceptAddrKey {
+			continue
+		}
+		recipients += 1
+
+		err := ls.sendReliableCmd(cmd, client)
+		if err != nil {
+			ls.logger.Error().
+				Msgf("could not send cmd to %v: %v", client, err)
+
+			errs = multierror.Append(errs, err)
+		}
+	}
+	ls.broadcastFanOut.Observe(float64(recipients))
+	return errs
+}
+
+func (ls *LobbyServer) handleCCmdPing(cCmdPing *protocol.Cmd, addr *net.UDPAddr, conn *net.UDPConn) error {
+	debug.Assert(cCmdPing.Header.Cmd == protocol.CCmdPing)
+
+	ping, ok := cCmdPing.Body.(*protocol.NetworkedPing)
+	debug.Assert(ok)
+
+	sCmdPong := protocol.NewSCmdPong(uint64(ping.ClientTime), ls.serverTime(time.Now()))
+	return ls.sendCmd(sCmdPong, conn, addr)
+}
+
+// checkVersion returns a non-nil SCmdError if client of the given version
+// can't be served.
+func checkVersion(version protocol.NetworkedUint64) *protocol.Cmd {
+	if version == protocol.ProtocolVersion {
+		return nil
+	}
+
+	sCmdError := protocol.NewSCmdError(
+		protocol.ErrCodeIncompatibleVersion,
+		fmt.Sprintf(
+			"incompatible protocol version (got %d; want %d); update the mod or the server",
+			version,
+			protocol.ProtocolVersion,
+		),
+	)
+	return &sCmdError
+}
+
+func (ls *LobbyServer) handleCCmdHello(cCmdHello *protocol.Cmd, addr *net.UDPAddr, conn *net.UDPConn) error {
+	debug.Assert(cCmdHello.Header.Cmd == protocol.CCmdHello)
+
+	hello, ok := cCmdHello.Body.(*protocol.NetworkedHello)
+	debug.Assert(ok)
+
+	// NOTE(blukai): hello does not carry a token, its source address may
+	// be spoofed; reply must not be bigger than hello, otherwise server
+	// could be used to amplify traffic. client that speaks a different
+	// version finds that out from server's version in the reply, there's
+	// no need for an error.
+	sCmdHello := protocol.NewSCmdHello(protocol.ProtocolVersion, protocol.SupportedFeatures)
+	if err := ls.sendCmd(sCmdHello, conn, addr); err != nil {
+		return err
+	}
+
+	if hello.Version != protocol.ProtocolVersion {
+		ls.rejectedPackets.Inc()
+		return fmt.Errorf("rejected hello of protocol version %d", hello.Version)
+	}
+	return nil
+}
+
+func (ls *LobbyServer) handleCCmdKeepAlive(addr *net.UDPAddr, conn *net.UDPConn) error {
+	sCmdKeepAlive := protocol.NewSCmdKeepAlive()
+	if client, ok := ls.clients[makeAddrKey(addr)]; ok {
+		sCmdKeepAlive.Header.Token = client.nonce
+	}
+	return ls.sendCmd(sCmdKeepAlive, conn, addr)
+}
+
+func (ls *LobbyServer) handleCCmdLeave(addr *net.UDPAddr) error {
+	clientAddrKey := makeAddrKey(addr)
+	client, ok := ls.clients[clientAddrKey]
+	if !ok {
+		// NOTE(blukai): leave is sent more than once in case some copies
+		// get lost; client is gone after the first one.
+		return nil
 	}
-	return ls.sendCmd(sCmdPong, addr)
+
+	ls.removeClient(clientAddrKey, client)
+	ls.logger.Debug().
+		Str("client", fmt.Sprintf("%+#v", client)).
+		Msg("client left")
+
+	return nil
 }
 
-func (ls *LobbyServer) handleCCmdJoin(cCmdJoin *protocol.Cmd, addr *net.UDPAddr) error {
+func (ls *LobbyServer) handleCCmdJoin(
+	cCmdJoin *protocol.Cmd,
+	addr *net.UDPAddr,
+	conn *net.UDPConn,
+	channel *reliable.Channel,
+) error {
 	debug.Assert(cCmdJoin.Header.Cmd == protocol.CCmdJoin)
 
-	id, ok := cCmdJoin.Body.(*protocol.NetworkedUint64)
+	join, ok := cCmdJoin.Body.(*protocol.NetworkedJoin)
 	debug.Assert(ok)
-	// TODO(blukai): get rid of id if it'll end up not being needed
-	_ = id
-
-	// TODO(blukai): controllable seed
-	//
-	// for now if there are no players generate a random seed
-	if len(ls.clients) == 0 {
-		ls.seed = rand.Int31()
-	}
-
-	// TODO: some form of authentication (but keep stuff anonymized).
-	//
-	// maybe require clients to receive a token over https or in some other
-	// secure way and then send it with each udp packet or/and use it to
-	// encrypt messages (on client).
-	ls.clients[makeAddrKey(addr)] = &client{
+
+	// NOTE(blukai): clients are supposed to say hello first, but nothing
+	// stops them from skipping it.
+	if sCmdError := checkVersion(join.Version); sCmdError != nil {
+		ls.rejectedPackets.Inc()
+		sCmdError.Header.Token = uint64(join.Nonce)
+		if err := ls.sendCmd(*sCmdError, conn, addr); err != nil {
+			return err
+		}
+		return fmt.Errorf("rejected join of protocol version %d", join.Version)
+	}
+	if _, banned := ls.bans[join.ID]; banned {
+		ls.rejectedPackets.Inc()
+		sCmdError := protocol.NewSCmdError(protocol.ErrCodeBanned, "banned by server operator")
+		sCmdError.Header.Token = uint64(join.Nonce)
+		if err := ls.sendCmd(sCmdError, conn, addr); err != nil {
+			return err
+		}
+		return fmt.Errorf("rejected join of banned player %d", join.ID)
+	}
+	features := uint64(join.Features) & protocol.SupportedFeatures
+
+	lobbyName := string(join.Lobby)
+	if len(lobbyName) > protocol.LobbyNameMaxLen {
+		return fmt.Errorf(
+			"lobby name is too long (got %d; want <= %d)",
+			len(lobbyName),
+			protocol.LobbyNameMaxLen,
+		)
+	}
+	info := join.PlayerInfo()
+	if err := info.Validate(); err != nil {
+		ls.rejectedPackets.Inc()
+		return err
+	}
+
+	clientAddrKey := makeAddrKey(addr)
+	if prevClient, ok := ls.clients[clientAddrKey]; ok {
+		// client that re-joins the same lobby as the same player (e.g.
+		// after reconnecting) resumes its session
+		if prevClient.lobby.name == lobbyName && prevClient.id == join.ID {
+			return ls.resumeSession(prevClient, join, channel, features, info)
+		}
+
+		// client may re-join, possibly into a different lobby
+		ls.removeClient(clientAddrKey, prevClient)
+	}
+
+	// NOTE(blukai): player ids must be unique within a lobby, otherwise one
+	// client would be able to move other client's player. ids are public
+	// (e.g. steam ids); player that comes back from another address
+	// resumes its session only if join carries its token (see handleCmd),
+	// others must wait until the stale session is evicted.
+	if lby, ok := ls.lobbies[lobbyName]; ok {
+		for _, other := range lby.clients {
+			if other.id == join.ID {
+				ls.rejectedPackets.Inc()
+				message := fmt.Sprintf("player %d is already in the lobby", join.ID)
+				sCmdError := protocol.NewSCmdError(protocol.ErrCodeDuplicatePlayer, message)
+				sCmdError.Header.Token = uint64(join.Nonce)
+				if err := ls.sendCmd(sCmdError, conn, addr); err != nil {
+					return err
+				}
+				return errors.New(message)
+			}
+		}
+	}
+
+	lby, ok := ls.lobbies[lobbyName]
+	if !ok {
+		lby = ls.createLobby(lobbyName)
+	}
+
+	c := &client{
 		addr:     addr,
+		conn:     conn,
 		lastSeen: time.Now(),
+		lobby:    lby,
+		id:       join.ID,
+		info:     info,
+		token:    makeToken(),
+		nonce:    uint64(join.Nonce),
+		channel:  channel,
+		features: features,
+
+		chatLimiter: ratelimit.NewBucket(protocol.ChatInterval, protocol.ChatBurst),
+
+		needsFullSnapshot: true,
 	}
+	ls.clients[clientAddrKey] = c
+	ls.sessions[c.token] = c
+	lby.clients[clientAddrKey] = c
 
-	sCmdSetSeed := protocol.Cmd{
-		Header: &protocol.CmdHeader{
-			Cmd:  protocol.SCmdSetSeed,
-			Size: 4,
-		},
-		Body: ptr.To(protocol.NetworkedInt32(ls.seed)),
+	var errs error
+
+	if err := ls.sendSession(c); err != nil {
+		errs = multierror.Append(errs, err)
 	}
-	return ls.sendCmd(sCmdSetSeed, addr)
+
+	// let everyone else know about the joined player
+	sCmdSpawnPlayer := protocol.NewSCmdSpawnPlayer(c.info)
+	if err := ls.broadcastReliableCmd(sCmdSpawnPlayer, lby, clientAddrKey); err != nil {
+		errs = multierror.Append(errs, err)
+	}
+
+	return errs
+}
+
+// resumeSession hands client's session over to the connection that sent join
+// (see protocol.NetworkedJoin's Nonce).
+//
+// NOTE(blukai): ls.mu must be held.
+func (ls *LobbyServer) resumeSession(
+	c *client,
+	join *protocol.NetworkedJoin,
+	channel *reliable.Channel,
+	features uint64,
+	info protocol.NetworkedPlayerInfo,
+) error {
+	c.nonce = uint64(join.Nonce)
+	c.channel = channel
+	c.features = features
+	c.needsFullSnapshot = true
+	if err := ls.sendSession(c); err != nil {
+		return err
+	}
+
+	// NOTE(blukai): player may have changed its name (or metadata) in the
+	// meantime; spawn of a known player updates its info.
+	if !reflect.DeepEqual(c.info, info) {
+		c.info = info
+		sCmdSpawnPlayer := protocol.NewSCmdSpawnPlayer(info)
+		return ls.broadcastReliableCmd(sCmdSpawnPlayer, c.lobby, makeAddrKey(c.addr))
+	}
+	return nil
+}
+
+// sendSession sends the client its session (token and seed) and lets it know
+// who's already in the lobby.
+//
+// NOTE(blukai): ls.mu must be held.
+func (ls *LobbyServer) sendSession(c *client) error {
+	lby := c.lobby
+
+	var runSettings []protocol.NetworkedRunSetting
+	if c.features&protocol.FeatureRunSettings != 0 {
+		runSettings = ls.runSettings
+	}
+	sCmdSetSeed := protocol.NewSCmdSetSeed(c.token, lby.seed, runSettings)
+	if err := ls.sendReliableCmd(sCmdSetSeed, c); err != nil {
+		return err
+	}
+
+	var errs error
+
+	// let the joined player know who's already here
+	for _, other := range lby.clients {
+		if other == c {
+			continue
+		}
+
+		sCmdSpawnPlayer := protocol.NewSCmdSpawnPlayer(other.info)
+		if err := ls.sendReliableCmd(sCmdSpawnPlayer, c); err != nil {
+			errs = multierror.Append(errs, err)
+		}
+	}
+
+	return errs
 }
 
 func (ls *LobbyServer) handleCCmdTransformPlayer(
@@ -268,32 +1661,56 @@ func (ls *LobbyServer) handleCCmdTransformPlayer(
 	transformPlayer, ok := cCmdTransformPlayer.Body.(*protocol.NetworkedTransformPlayer)
 	debug.Assert(ok)
 
-	sCmdTransformPlayer := protocol.Cmd{
-		Header: &protocol.CmdHeader{
-			Cmd:  protocol.SCmdTransformPlayer,
-			Size: 16,
-		},
-		Body: transformPlayer,
+	sender, ok := ls.clients[makeAddrKey(addr)]
+	if !ok {
+		return fmt.Errorf("client did not join any lobby")
+	}
+	if transformPlayer.ID != sender.id {
+		ls.rejectedPackets.Inc()
+		return fmt.Errorf(
+			"player id does not match the session (got %d; want %d)",
+			transformPlayer.ID,
+			sender.id,
+		)
 	}
-	sCmdTransformPlayerBytes, err := sCmdTransformPlayer.MarshalBinary()
-	debug.Assert(err == nil)
 
-	// broadcast to everyone else
-	addrKey := makeAddrKey(addr)
-	var errs error
-	for clientAddrKey, client := range ls.clients {
-		// don't send to the sender
-		if clientAddrKey == addrKey {
-			continue
-		}
+	// NOTE(blukai): transform will be sent out to everyone else within
+	// sender's lobby on next tick
+	sender.transform = transformPlayer
+	sender.transformDirty = true
 
-		err := ls.sendBytes(sCmdTransformPlayerBytes, client.addr)
-		if err != nil {
-			ls.logger.Error().
-				Msgf("could not send player transform to %v: %v", client, err)
+	return nil
+}
 
-			errs = multierror.Append(errs, err)
-		}
+func (ls *LobbyServer) handleCCmdChat(cCmdChat *protocol.Cmd, addr *net.UDPAddr) error {
+	debug.Assert(cCmdChat.Header.Cmd == protocol.CCmdChat)
+
+	chat, ok := cCmdChat.Body.(*protocol.NetworkedChat)
+	debug.Assert(ok)
+
+	senderAddrKey := makeAddrKey(addr)
+	sender, ok := ls.clients[senderAddrKey]
+	if !ok {
+		return fmt.Errorf("client did not join any lobby")
 	}
-	return errs
+	if chat.ID != sender.id {
+		ls.rejectedPackets.Inc()
+		return fmt.Errorf(
+			"player id does not match the session (got %d; want %d)",
+			chat.ID,
+			sender.id,
+		)
+	}
+	if err := chat.Validate(); err != nil {
+		ls.rejectedPackets.Inc()
+		return err
+	}
+	// NOTE(blukai): chat is reliable; it was acknowledged already, dropping
+	// it is the only option.
+	if !sender.chatLimiter.Allow(time.Now()) {
+		return fmt.Errorf("player %d exceeded chat rate limit", sender.id)
+	}
+
+	sCmdChat := protocol.NewSCmdChat(uint64(chat.ID), uint64(chat.Kind), string(chat.Text))
+	return ls.broadcastReliableCmd(sCmdChat, sender.lobby, senderAddrKey)
 }
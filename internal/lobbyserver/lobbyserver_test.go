@@ -2,7 +2,10 @@ package lobbyserver_test
 
 import (
 	"context"
+	"errors"
+	"math"
 	"net"
+	"strings"
 	"testing"
 	"time"
 
@@ -17,7 +20,7 @@ func TestPing(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	lobbyServer, err := lobbyserver.NewLobbyServer("udp4", ":0", nil)
+	lobbyServer, err := lobbyserver.NewLobbyServer("udp4", ":0", nil, nil)
 	is.NoErr(err)
 	go lobbyServer.Run(ctx)
 
@@ -25,27 +28,521 @@ func TestPing(t *testing.T) {
 	is.NoErr(err)
 	defer clientConn.Close()
 
-	// send ping
+	// send ping and receive pong
 
-	pingHeader := protocol.CmdHeader{Cmd: protocol.CCmdPing}
-	pingHeaderBytes, err := pingHeader.MarshalBinary()
+	writeCmd(t, clientConn, protocol.NewCCmdPing(1337))
+	sCmdPong := readCmd(t, clientConn, protocol.SCmdPong)
+
+	pong, ok := sCmdPong.Body.(*protocol.NetworkedPong)
+	is.True(ok)
+	is.Equal(pong.ClientTime, protocol.NetworkedUint64(1337)) // client's time is echoed
+
+	stats := lobbyServer.Stats()
+	is.Equal(stats.RecvPackets, uint64(1))
+	is.Equal(stats.DroppedPackets, uint64(0))
+}
+
+func TestFlood(t *testing.T) {
+	is := is.New(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	lobbyServer, err := lobbyserver.NewLobbyServer("udp4", ":0", nil, nil)
+	is.NoErr(err)
+	go lobbyServer.Run(ctx)
+
+	clientConn, err := net.DialUDP("udp4", nil, lobbyServer.Addr())
+	is.NoErr(err)
+	defer clientConn.Close()
+
+	// flood server with pings without reading pongs
+
+	cCmdPing := protocol.NewCCmdPing(1337)
+	pingBytes, err := cCmdPing.MarshalBinary()
+	is.NoErr(err)
+
+	const numPings = 10000
+	for range numPings {
+		_, err = clientConn.Write(pingBytes)
+		is.NoErr(err)
+	}
+	waitFor(t, "pings to be queued", func() bool {
+		return lobbyServer.Stats().RecvPackets > 0
+	})
+
+	// NOTE(blukai): kernel may drop some packets on its own
+	stats := lobbyServer.Stats()
+	is.True(stats.RecvPackets > 0)
+	is.True(stats.RecvPackets+stats.DroppedPackets <= numPings)
+}
+
+func TestOptions(t *testing.T) {
+	is := is.New(t)
+
+	invalid := []lobbyserver.Options{
+		{TickInterval: -time.Second},
+		{TickInterval: time.Second}, // clients would have nothing to interpolate
+		{TickInterval: time.Millisecond * 20, RefreshInterval: time.Millisecond * 10},
+		{EvictorInterval: time.Second, EvictionTimeout: time.Millisecond},
+		{ReadTimeout: -time.Second},
+		{CmdMaxSize: protocol.CmdHeaderSize},
+		{CmdMaxSize: protocol.CmdMaxSize + 1},
+	}
+	for _, options := range invalid {
+		_, err := lobbyserver.NewLobbyServer("udp4", ":0", nil, &options)
+		is.True(err != nil)
+	}
+
+	lobbyServer, err := lobbyserver.NewLobbyServer("udp4", ":0", nil, &lobbyserver.Options{
+		TickInterval: time.Millisecond * 20,
+	})
+	is.NoErr(err)
+
+	// far players can't be sent more often than ticks happen
+	err = lobbyServer.SetInterestConfig(lobbyserver.InterestConfig{
+		Radius:      1,
+		FarInterval: time.Millisecond * 10,
+	})
+	is.True(err != nil)
+	err = lobbyServer.SetInterestConfig(lobbyserver.InterestConfig{
+		Radius:      1,
+		FarInterval: time.Millisecond * 20,
+	})
+	is.NoErr(err)
+}
+
+func TestMetrics(t *testing.T) {
+	is := is.New(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	lobbyServer, err := lobbyserver.NewLobbyServer("udp4", ":0", nil, nil)
+	is.NoErr(err)
+	go lobbyServer.Run(ctx)
+
+	clientConn, err := net.DialUDP("udp4", nil, lobbyServer.Addr())
+	is.NoErr(err)
+	defer clientConn.Close()
+
+	writeCmd(t, clientConn, protocol.NewCCmdPing(1337))
+	readCmd(t, clientConn, protocol.SCmdPong)
+
+	// garbage is counted, but not queued
+	_, err = clientConn.Write([]byte{0xde, 0xad})
+	is.NoErr(err)
+
+	var text string
+	waitFor(t, "garbage to be counted", func() bool {
+		var sb strings.Builder
+		_, err := lobbyServer.Metrics().WriteTo(&sb)
+		is.NoErr(err)
+		text = sb.String()
+		return strings.Contains(text, "noitaparty_server_decode_errors_total 1\n")
+	})
+	is.True(strings.Contains(text, "noitaparty_server_read_packets_total 2\n"))
+	is.True(strings.Contains(text, "noitaparty_server_recv_packets_total 1\n"))
+	is.True(strings.Contains(text, "noitaparty_server_sent_packets_total 1\n"))
+	is.True(strings.Contains(text, "noitaparty_server_clients 0\n"))
+}
+
+func writeCmd(t *testing.T, conn *net.UDPConn, cmd protocol.Cmd) {
+	t.Helper()
+	is := is.New(t)
+
+	cmdBytes, err := cmd.MarshalBinary()
+	is.NoErr(err)
+
+	err = conn.SetWriteDeadline(time.Now().Add(time.Second))
+	is.NoErr(err)
+	_, err = conn.Write(cmdBytes)
+	is.NoErr(err)
+}
+
+// waitFor polls cond until it returns true; the test fails if that does not
+// happen within a second.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// readCmd reads cmds until it encounters the one of the given type.
+func readCmd(t *testing.T, conn *net.UDPConn, cmdType uint16) protocol.Cmd {
+	t.Helper()
+	is := is.New(t)
+
+	buf := make([]byte, protocol.CmdMaxSize)
+	for {
+		err := conn.SetReadDeadline(time.Now().Add(time.Second))
+		is.NoErr(err)
+		n, _, err := conn.ReadFromUDP(buf)
+		is.NoErr(err)
+
+		cmd := protocol.Cmd{}
+		err = cmd.UnmarshalBinary(buf[0:n])
+		is.NoErr(err)
+		if cmd.Header.Cmd == cmdType {
+			return cmd
+		}
+	}
+}
+
+func TestSessionToken(t *testing.T) {
+	is := is.New(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	lobbyServer, err := lobbyserver.NewLobbyServer("udp4", ":0", nil, nil)
+	is.NoErr(err)
+	go lobbyServer.Run(ctx)
+
+	clientConn, err := net.DialUDP("udp4", nil, lobbyServer.Addr())
+	is.NoErr(err)
+	defer clientConn.Close()
+
+	// join and receive token
+
+	cCmdJoin := protocol.NewCCmdJoin(1, 0, "")
+	cCmdJoin.Header.Flags = protocol.CmdFlagReliable
+	writeCmd(t, clientConn, cCmdJoin)
+	sCmdSetSeed := readCmd(t, clientConn, protocol.SCmdSetSeed)
+	session, ok := sCmdSetSeed.Body.(*protocol.NetworkedSession)
+	is.True(ok)
+	is.True(session.Token != 0)
+
+	transform := func(token uint64, id uint64) protocol.Cmd {
+		cCmdTransformPlayer := protocol.NewCCmdTransformPlayer(protocol.NetworkedTransformPlayer{ID: protocol.NetworkedID(id)})
+		cCmdTransformPlayer.Header.Token = token
+		return cCmdTransformPlayer
+	}
+
+	rejected := func(n uint64) func() bool {
+		return func() bool {
+			return lobbyServer.Stats().RejectedPackets == n
+		}
+	}
+
+	// wrong token
+
+	writeCmd(t, clientConn, transform(uint64(session.Token)+1, 1))
+	waitFor(t, "transform to be rejected", rejected(1))
+
+	// right token, but wrong player id
+
+	writeCmd(t, clientConn, transform(uint64(session.Token), 2))
+	waitFor(t, "transform to be rejected", rejected(2))
+
+	// right token and player id
+
+	writeCmd(t, clientConn, transform(uint64(session.Token), 1))
+	waitFor(t, "transform to be accepted", func() bool {
+		lobbies := lobbyServer.Lobbies()
+		return len(lobbies) == 1 && lobbies[0].Clients[0].Position != nil
+	})
+	is.Equal(lobbyServer.Stats().RejectedPackets, uint64(2))
+}
+
+func TestRefresh(t *testing.T) {
+	is := is.New(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	lobbyServer, err := lobbyserver.NewLobbyServer("udp4", ":0", nil, &lobbyserver.Options{
+		RefreshInterval: time.Millisecond * 100,
+	})
 	is.NoErr(err)
+	go lobbyServer.Run(ctx)
 
-	err = clientConn.SetWriteDeadline(time.Now().Add(time.Second))
+	join := func(conn *net.UDPConn, id uint64) uint64 {
+		cCmdJoin := protocol.NewCCmdJoin(id, id, "")
+		cCmdJoin.Header.Flags = protocol.CmdFlagReliable
+		writeCmd(t, conn, cCmdJoin)
+		sCmdSetSeed := readCmd(t, conn, protocol.SCmdSetSeed)
+		return uint64(sCmdSetSeed.Body.(*protocol.NetworkedSession).Token)
+	}
+
+	movingConn, err := net.DialUDP("udp4", nil, lobbyServer.Addr())
 	is.NoErr(err)
-	_, err = clientConn.Write(pingHeaderBytes)
+	defer movingConn.Close()
+	movingToken := join(movingConn, 1)
+
+	watchingConn, err := net.DialUDP("udp4", nil, lobbyServer.Addr())
 	is.NoErr(err)
+	defer watchingConn.Close()
+	join(watchingConn, 2)
+
+	// player moves once and then stands still
+
+	cCmdTransformPlayer := protocol.NewCCmdTransformPlayer(protocol.NetworkedTransformPlayer{
+		ID:        1,
+		Transform: protocol.NetworkedInt32Vector2{X: 24, Y: 13},
+	})
+	cCmdTransformPlayer.Header.Token = movingToken
+	writeCmd(t, movingConn, cCmdTransformPlayer)
+
+	// its transform keeps coming, so that a lost snapshot does not leave
+	// it frozen somewhere else
 
-	// receive pong
+	for range 3 {
+		sCmdPlayerSnapshot := readCmd(t, watchingConn, protocol.SCmdPlayerSnapshot)
+		snapshot := sCmdPlayerSnapshot.Body.(*protocol.NetworkedPlayerSnapshot)
+		is.Equal(len(snapshot.Players), 1)
+		is.Equal(snapshot.Players[0].Transform.X, protocol.NetworkedInt32(24))
+	}
+}
+
+func TestDuplicatePlayer(t *testing.T) {
+	is := is.New(t)
 
-	err = clientConn.SetReadDeadline(time.Now().Add(time.Second))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	lobbyServer, err := lobbyserver.NewLobbyServer("udp4", ":0", nil, nil)
+	is.NoErr(err)
+	go lobbyServer.Run(ctx)
+
+	ownerConn, err := net.DialUDP("udp4", nil, lobbyServer.Addr())
+	is.NoErr(err)
+	defer ownerConn.Close()
+
+	cCmdJoin := protocol.NewCCmdJoin(1, 42, "party")
+	cCmdJoin.Header.Flags = protocol.CmdFlagReliable
+	writeCmd(t, ownerConn, cCmdJoin)
+	readCmd(t, ownerConn, protocol.SCmdSetSeed)
+
+	// join of the same player without a token is rejected, and the sender
+	// is told why
+
+	impostorConn, err := net.DialUDP("udp4", nil, lobbyServer.Addr())
 	is.NoErr(err)
-	pongHeaderBytes := make([]byte, protocol.CmdHeaderSize)
-	_, _, err = clientConn.ReadFromUDP(pongHeaderBytes)
+	defer impostorConn.Close()
+
+	cCmdJoin = protocol.NewCCmdJoin(1, 24, "party")
+	cCmdJoin.Header.Flags = protocol.CmdFlagReliable
+	writeCmd(t, impostorConn, cCmdJoin)
+	sCmdError := readCmd(t, impostorConn, protocol.SCmdError)
+	is.Equal(sCmdError.Header.Token, uint64(24))
+	is.Equal(uint64(sCmdError.Body.(*protocol.NetworkedError).Code), protocol.ErrCodeDuplicatePlayer)
+	is.Equal(lobbyServer.Stats().RejectedPackets, uint64(1))
+
+	// owner keeps the session
+	is.True(lobbyServer.SessionToken(ownerConn.LocalAddr().(*net.UDPAddr)) != 0)
+	is.Equal(lobbyServer.SessionToken(impostorConn.LocalAddr().(*net.UDPAddr)), uint64(0))
+}
+
+func TestAddressMigration(t *testing.T) {
+	is := is.New(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	lobbyServer, err := lobbyserver.NewLobbyServer("udp4", ":0", nil, nil)
 	is.NoErr(err)
+	go lobbyServer.Run(ctx)
 
-	pongHeader := protocol.CmdHeader{}
-	err = pongHeader.UnmarshalBinary(pongHeaderBytes)
+	join := func(conn *net.UDPConn, id uint64) *protocol.NetworkedSession {
+		cCmdJoin := protocol.NewCCmdJoin(id, 42, "")
+		cCmdJoin.Header.Flags = protocol.CmdFlagReliable
+		writeCmd(t, conn, cCmdJoin)
+		sCmdSetSeed := readCmd(t, conn, protocol.SCmdSetSeed)
+		session, ok := sCmdSetSeed.Body.(*protocol.NetworkedSession)
+		is.True(ok)
+		return session
+	}
+
+	oldConn, err := net.DialUDP("udp4", nil, lobbyServer.Addr())
 	is.NoErr(err)
-	is.True(pongHeader.Cmd == protocol.SCmdPong)
+	defer oldConn.Close()
+
+	session := join(oldConn, 1)
+
+	// same session shows up from a different address
+
+	newConn, err := net.DialUDP("udp4", nil, lobbyServer.Addr())
+	is.NoErr(err)
+	defer newConn.Close()
+
+	cCmdKeepAlive := protocol.NewCCmdKeepAlive()
+	cCmdKeepAlive.Header.Token = uint64(session.Token)
+	writeCmd(t, newConn, cCmdKeepAlive)
+	sCmdKeepAlive := readCmd(t, newConn, protocol.SCmdKeepAlive)
+	is.Equal(sCmdKeepAlive.Header.Token, uint64(42))
+
+	// reliable cmds follow the session to the new address
+
+	otherConn, err := net.DialUDP("udp4", nil, lobbyServer.Addr())
+	is.NoErr(err)
+	defer otherConn.Close()
+
+	join(otherConn, 2)
+
+	sCmdSpawnPlayer := readCmd(t, newConn, protocol.SCmdSpawnPlayer)
+	info, ok := sCmdSpawnPlayer.Body.(*protocol.NetworkedPlayerInfo)
+	is.True(ok)
+	is.Equal(uint64(info.ID), uint64(2))
+	is.Equal(lobbyServer.Stats().RejectedPackets, uint64(0))
+
+	// session is resumed from yet another address by a join that carries
+	// the token (e.g. client re-created its socket)
+
+	rejoinConn, err := net.DialUDP("udp4", nil, lobbyServer.Addr())
+	is.NoErr(err)
+	defer rejoinConn.Close()
+
+	cCmdJoin := protocol.NewCCmdJoin(1, 43, "")
+	cCmdJoin.Header.Flags = protocol.CmdFlagReliable
+	cCmdJoin.Header.Token = uint64(session.Token)
+	writeCmd(t, rejoinConn, cCmdJoin)
+	sCmdSetSeed := readCmd(t, rejoinConn, protocol.SCmdSetSeed)
+	is.Equal(sCmdSetSeed.Header.Token, uint64(43))
+	resumed, ok := sCmdSetSeed.Body.(*protocol.NetworkedSession)
+	is.True(ok)
+	is.Equal(resumed.Token, session.Token)
+	is.Equal(resumed.Seed, session.Seed)
+	is.Equal(lobbyServer.Stats().RejectedPackets, uint64(0))
+}
+
+func TestHandshake(t *testing.T) {
+	is := is.New(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	lobbyServer, err := lobbyserver.NewLobbyServer("udp4", ":0", nil, nil)
+	is.NoErr(err)
+	go lobbyServer.Run(ctx)
+
+	clientConn, err := net.DialUDP("udp4", nil, lobbyServer.Addr())
+	is.NoErr(err)
+	defer clientConn.Close()
+
+	t.Run("compatible", func(t *testing.T) {
+		writeCmd(t, clientConn, protocol.NewCCmdHello(protocol.ProtocolVersion, math.MaxUint64))
+		sCmdHello := readCmd(t, clientConn, protocol.SCmdHello)
+		hello := sCmdHello.Body.(*protocol.NetworkedHello)
+		is.Equal(uint64(hello.Version), uint64(protocol.ProtocolVersion))
+		is.Equal(uint64(hello.Features), protocol.SupportedFeatures)
+	})
+
+	t.Run("incompatible hello", func(t *testing.T) {
+		// NOTE(blukai): reply must not be bigger than the smallest
+		// hello; source address of hello may be spoofed.
+		cCmdHello := protocol.NewCCmdHello(protocol.ProtocolVersion+1, 0)
+		cCmdHelloBytes, err := cCmdHello.MarshalBinary()
+		is.NoErr(err)
+		writeCmd(t, clientConn, cCmdHello)
+
+		sCmdHello := readCmd(t, clientConn, protocol.SCmdHello)
+		sCmdHelloBytes, err := sCmdHello.MarshalBinary()
+		is.NoErr(err)
+		is.True(len(sCmdHelloBytes) <= len(cCmdHelloBytes))
+		hello := sCmdHello.Body.(*protocol.NetworkedHello)
+		is.Equal(uint64(hello.Version), uint64(protocol.ProtocolVersion))
+	})
+
+	t.Run("incompatible join", func(t *testing.T) {
+		cCmdJoin := protocol.NewCCmdJoin(42, 24, "party")
+		cCmdJoin.Body.(*protocol.NetworkedJoin).Version = protocol.ProtocolVersion + 1
+		writeCmd(t, clientConn, cCmdJoin)
+		sCmdError := readCmd(t, clientConn, protocol.SCmdError)
+		is.Equal(sCmdError.Header.Token, uint64(24))
+		is.Equal(uint64(sCmdError.Body.(*protocol.NetworkedError).Code), protocol.ErrCodeIncompatibleVersion)
+
+		_, err := lobbyServer.LobbySeed("party")
+		is.True(errors.Is(err, lobbyserver.ErrLobbyNotFound))
+	})
+}
+
+func FuzzHandlePacket(f *testing.F) {
+	seeds := []protocol.Cmd{
+		protocol.NewCCmdPing(42),
+		protocol.NewCCmdJoin(42, 24, "party"),
+		protocol.NewCCmdTransformPlayer(protocol.NetworkedTransformPlayer{
+			ID:        42,
+			Transform: protocol.NetworkedInt32Vector2{X: -1, Y: 1},
+			Facing:    protocol.FacingLeft,
+		}),
+		protocol.NewCCmdKeepAlive(),
+		protocol.NewCCmdAck(),
+		protocol.NewCCmdChat(42, protocol.ChatKindMessage, "hello, party"),
+		protocol.NewCCmdLeave(),
+		protocol.NewCCmdHello(protocol.ProtocolVersion, protocol.SupportedFeatures),
+		protocol.NewSCmdSetSeed(42, -1, []protocol.NetworkedRunSetting{{Key: "mode", Value: "nightmare"}}),
+		protocol.NewSCmdPlayerSnapshot(1337, []protocol.NetworkedTransformPlayer{{ID: 42}}),
+	}
+	for _, cmd := range seeds {
+		data, err := cmd.MarshalBinary()
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(data)
+	}
+	f.Add([]byte{})
+	f.Add(make([]byte, protocol.CmdHeaderSize-1))
+
+	lobbyServer, err := lobbyserver.NewLobbyServer("udp4", "127.0.0.1:0", nil, nil)
+	if err != nil {
+		f.Fatal(err)
+	}
+
+	// NOTE(blukai): server replies to the sender; nobody reads the replies.
+	peerConn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		f.Fatal(err)
+	}
+	defer peerConn.Close()
+	peerAddr := peerConn.LocalAddr().(*net.UDPAddr)
+
+	join := protocol.NewCCmdJoin(1, 1, "fuzz")
+	joinBytes, err := join.MarshalBinary()
+	if err != nil {
+		f.Fatal(err)
+	}
+
+	// withSessionToken returns cmd bytes that carry peer's session token;
+	// otherwise server would reject everything but ping and hello sent
+	// by a joined peer.
+	withSessionToken := func(data []byte) []byte {
+		header := protocol.CmdHeader{}
+		if len(data) < protocol.CmdHeaderSize || header.UnmarshalBinary(data[:protocol.CmdHeaderSize]) != nil {
+			return data
+		}
+		header.Token = lobbyServer.SessionToken(peerAddr)
+		headerBytes, err := header.MarshalBinary()
+		if err != nil {
+			return data
+		}
+		return append(headerBytes, data[protocol.CmdHeaderSize:]...)
+	}
+
+	leave := protocol.NewCCmdLeave()
+	leaveBytes, err := leave.MarshalBinary()
+	if err != nil {
+		f.Fatal(err)
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		// NOTE(blukai): data must not panic the server regardless of
+		// whether the sender joined a lobby or not; errors are fine.
+		_ = lobbyServer.HandlePacket(data, peerAddr)
+		_ = lobbyServer.HandlePacket(joinBytes, peerAddr)
+		_ = lobbyServer.HandlePacket(withSessionToken(data), peerAddr)
+		lobbyServer.Tick()
+
+		// every input starts with a peer that did not join
+		_ = lobbyServer.HandlePacket(withSessionToken(leaveBytes), peerAddr)
+		if lobbyServer.SessionToken(peerAddr) != 0 {
+			t.Fatal("peer did not leave")
+		}
+	})
 }
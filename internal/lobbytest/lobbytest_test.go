@@ -2,15 +2,170 @@ package lobbytest_test
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/blukai/noitaparty/internal/interpolation"
 	"github.com/blukai/noitaparty/internal/lobbyclient"
 	"github.com/blukai/noitaparty/internal/lobbyserver"
+	"github.com/blukai/noitaparty/internal/protocol"
+	"github.com/blukai/noitaparty/internal/reliable"
 	"github.com/matryer/is"
 	"github.com/phuslu/log"
 )
 
+// waitTimeout is how long waitFor* helpers wait for something that goes
+// through loopback; it only matters when the test is about to fail.
+const waitTimeout = time.Second
+
+func transformPlayer(id uint64, x int32, y int32) protocol.NetworkedTransformPlayer {
+	return protocol.NetworkedTransformPlayer{
+		ID: protocol.NetworkedID(id),
+		Transform: protocol.NetworkedInt32Vector2{
+			X: protocol.NetworkedInt32(x),
+			Y: protocol.NetworkedInt32(y),
+		},
+	}
+}
+
+// startServer starts a lobby server on an ephemeral port; it runs until the
+// test ends.
+func startServer(t *testing.T, options *lobbyserver.Options) *lobbyserver.LobbyServer {
+	t.Helper()
+	is := is.New(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	ls, err := lobbyserver.NewLobbyServer("udp4", ":0", nil, options)
+	is.NoErr(err)
+	go ls.Run(ctx)
+	return ls
+}
+
+// startClient starts a lobby client that talks to addr; it runs until the test
+// ends.
+func startClient(t *testing.T, addr *net.UDPAddr, options *lobbyclient.Options) *lobbyclient.LobbyClient {
+	t.Helper()
+	is := is.New(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	network := "udp4"
+	if addr.IP.To4() == nil {
+		network = "udp6"
+	}
+	lc, err := lobbyclient.NewLobbyClient(network, addr.String(), nil, options)
+	is.NoErr(err)
+	go lc.Run(ctx)
+	return lc
+}
+
+// startPlayer is like startClient, but the client also joins the lobby as
+// player id.
+func startPlayer(t *testing.T, addr *net.UDPAddr, id uint64, lobby string) *lobbyclient.LobbyClient {
+	t.Helper()
+	is := is.New(t)
+
+	lc := startClient(t, addr, nil)
+	_, err := lc.SendCCmdJoinRecvSCmdSetSeed(id, lobby, lobbyclient.PlayerInfo{})
+	is.NoErr(err)
+	return lc
+}
+
+// startParty starts a server and two players (one and two) that joined the
+// lobby.
+func startParty(t *testing.T, lobby string) (
+	ls *lobbyserver.LobbyServer,
+	playerOneClient *lobbyclient.LobbyClient,
+	playerTwoClient *lobbyclient.LobbyClient,
+) {
+	t.Helper()
+
+	ls = startServer(t, nil)
+	playerOneClient = startPlayer(t, ls.Addr(), 1, lobby)
+	playerTwoClient = startPlayer(t, ls.Addr(), 2, lobby)
+	return ls, playerOneClient, playerTwoClient
+}
+
+// waitFor polls cond until it returns true; the test fails if that does not
+// happen within timeout.
+func waitFor(t *testing.T, timeout time.Duration, what string, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// waitForPlayer waits until lc sees player id at x and returns its state.
+func waitForPlayer(t *testing.T, lc *lobbyclient.LobbyClient, id uint64, x int32) protocol.NetworkedTransformPlayer {
+	t.Helper()
+
+	var found protocol.NetworkedTransformPlayer
+	waitFor(t, waitTimeout, fmt.Sprintf("player %d at x %d", id, x), func() bool {
+		for _, player := range lc.GetPlayers() {
+			if uint64(player.ID) == id && int32(player.Transform.X) == x {
+				found = *player
+				return true
+			}
+		}
+		return false
+	})
+	return found
+}
+
+// waitForDelta waits until GetDeltaPlayers of lc reports anything and returns
+// that.
+func waitForDelta(t *testing.T, lc *lobbyclient.LobbyClient) (
+	changed []*protocol.NetworkedTransformPlayer,
+	despawned []protocol.NetworkedID,
+) {
+	t.Helper()
+
+	waitFor(t, waitTimeout, "delta players", func() bool {
+		changed, despawned = lc.GetDeltaPlayers()
+		return len(changed) > 0 || len(despawned) > 0
+	})
+	return changed, despawned
+}
+
+// waitForInfo waits until lc knows player id and returns its info.
+func waitForInfo(t *testing.T, lc *lobbyclient.LobbyClient, id uint64) lobbyclient.PlayerInfo {
+	t.Helper()
+
+	var info lobbyclient.PlayerInfo
+	waitFor(t, waitTimeout, fmt.Sprintf("info of player %d", id), func() bool {
+		var ok bool
+		info, ok = lc.PlayerInfo(id)
+		return ok
+	})
+	return info
+}
+
+// waitForChat waits until lc receives n chat messages and returns them.
+func waitForChat(t *testing.T, lc *lobbyclient.LobbyClient, n int) []protocol.NetworkedChat {
+	t.Helper()
+
+	var chat []protocol.NetworkedChat
+	waitFor(t, waitTimeout, fmt.Sprintf("%d chat messages", n), func() bool {
+		chat = append(chat, lc.GetChatMessages()...)
+		return len(chat) >= n
+	})
+	return chat
+}
+
 func TestTwoPlayers(t *testing.T) {
 	is := is.New(t)
 
@@ -27,13 +182,13 @@ func TestTwoPlayers(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	ls, err := lobbyserver.NewLobbyServer("udp4", ":0", logger)
+	ls, err := lobbyserver.NewLobbyServer("udp4", ":0", logger, nil)
 	is.NoErr(err)
 	go ls.Run(ctx)
 
 	// setup player one
 
-	playerOneClient, err := lobbyclient.NewLobbyClient("udp4", ls.Addr().String(), logger)
+	playerOneClient, err := lobbyclient.NewLobbyClient("udp4", ls.Addr().String(), logger, nil)
 	is.NoErr(err)
 	go playerOneClient.Run(ctx)
 
@@ -44,7 +199,7 @@ func TestTwoPlayers(t *testing.T) {
 
 	// setup player two
 
-	playerTwoClient, err := lobbyclient.NewLobbyClient("udp4", ls.Addr().String(), logger)
+	playerTwoClient, err := lobbyclient.NewLobbyClient("udp4", ls.Addr().String(), logger, nil)
 	is.NoErr(err)
 	go playerTwoClient.Run(ctx)
 
@@ -53,13 +208,13 @@ func TestTwoPlayers(t *testing.T) {
 	// join player one
 
 	t.Log("join one")
-	playerOneSeed, err := playerOneClient.SendCCmdJoinRecvSCmdSetSeed(playerOneID)
+	playerOneSeed, err := playerOneClient.SendCCmdJoinRecvSCmdSetSeed(playerOneID, "", lobbyclient.PlayerInfo{})
 	is.NoErr(err)
 
 	// join player two
 
 	t.Log("join two")
-	playerTwoSeed, err := playerTwoClient.SendCCmdJoinRecvSCmdSetSeed(playerTwoID)
+	playerTwoSeed, err := playerTwoClient.SendCCmdJoinRecvSCmdSetSeed(playerTwoID, "", lobbyclient.PlayerInfo{})
 	is.NoErr(err)
 
 	is.Equal(playerOneSeed, playerTwoSeed)
@@ -67,12 +222,926 @@ func TestTwoPlayers(t *testing.T) {
 	// transform player one
 
 	t.Log("transform player one")
-	playerOneClient.SendCCmdTransformPlayer(playerOneID, playerOneX, playerOneY)
-	// NOTE(blukai): need to sleep for a bit because client's send/recv is "async"
-	time.Sleep(time.Millisecond)
+	playerOneClient.SendCCmdTransformPlayer(transformPlayer(playerOneID, playerOneX, playerOneY))
+	// NOTE(blukai): client's send/recv is "async" and server sends transforms
+	// out on tick
+	player := waitForPlayer(t, playerTwoClient, playerOneID, playerOneX)
+	is.Equal(int32(player.Transform.Y), playerOneY)
+	is.Equal(len(playerTwoClient.GetPlayers()), 1)
+}
+
+func TestSeparateLobbies(t *testing.T) {
+	is := is.New(t)
+
+	// one and two are in the same lobby, three is alone
+
+	ls, playerOneClient, playerTwoClient := startParty(t, "party")
+	playerThreeClient := startPlayer(t, ls.Addr(), 3, "solo")
+
+	playerOneClient.SendCCmdTransformPlayer(transformPlayer(1, 24, 13))
+	waitForPlayer(t, playerTwoClient, 1, 24)
+
+	// NOTE(blukai): player three would have been sent the transform on the
+	// same tick.
+	is.Equal(len(playerTwoClient.GetPlayers()), 1)
+	is.Equal(len(playerThreeClient.GetPlayers()), 0)
+}
+
+func TestRejoinFromAnotherAddress(t *testing.T) {
+	is := is.New(t)
+
+	ls, playerOneClient, playerTwoClient := startParty(t, "party")
+
+	// player one restarts without leaving (e.g. dll reload); it has a new
+	// address and no token. ids are public, it can't be told apart from an
+	// impostor and must wait until its stale session is evicted.
+
+	restartedClient := startClient(t, ls.Addr(), nil)
+
+	start := time.Now()
+	_, err := restartedClient.SendCCmdJoinRecvSCmdSetSeed(1, "party", lobbyclient.PlayerInfo{})
+	is.True(errors.Is(err, lobbyclient.ErrRejected))
+	is.True(time.Since(start) < reliable.RetransmitTimeout*reliable.MaxAttempts) // told why instead of timing out
+
+	// session stays with the connection that holds the token; player two
+	// does not notice anything
+
+	playerOneClient.SendCCmdTransformPlayer(transformPlayer(1, 24, 13))
+
+	changed, despawned := waitForDelta(t, playerTwoClient)
+	is.Equal(len(despawned), 0)
+	is.Equal(len(changed), 1)
+	is.Equal(uint64(changed[0].ID), uint64(1))
+	is.Equal(int32(changed[0].Transform.X), int32(24))
+	is.NoErr(playerOneClient.Err())
+}
+
+func TestDespawnPlayer(t *testing.T) {
+	is := is.New(t)
+
+	_, playerOneClient, playerTwoClient := startParty(t, "party")
+
+	playerTwoClient.SendCCmdTransformPlayer(transformPlayer(2, 24, 13))
+	changed, _ := waitForDelta(t, playerOneClient)
+	is.Equal(len(changed), 1)
+	is.Equal(len(playerOneClient.GetPlayers()), 1)
+
+	// player two leaves the party by joining another lobby
+
+	_, err := playerTwoClient.SendCCmdJoinRecvSCmdSetSeed(2, "solo", lobbyclient.PlayerInfo{})
+	is.NoErr(err)
+
+	_, despawned := waitForDelta(t, playerOneClient)
+	is.Equal(len(despawned), 1)
+	is.Equal(uint64(despawned[0]), uint64(2))
+	is.Equal(len(playerOneClient.GetPlayers()), 0)
+	// despawned players are reported only once
+	_, despawned = playerOneClient.GetDeltaPlayers()
+	is.Equal(len(despawned), 0)
+}
+
+func TestLeave(t *testing.T) {
+	is := is.New(t)
+
+	ls := startServer(t, nil)
+	playerOneClient := startPlayer(t, ls.Addr(), 1, "party")
+	playerTwoClient := startClient(t, ls.Addr(), nil)
+
+	is.True(errors.Is(playerTwoClient.Leave(), lobbyclient.ErrNotJoined))
+
+	_, err := playerTwoClient.SendCCmdJoinRecvSCmdSetSeed(2, "party", lobbyclient.PlayerInfo{})
+	is.NoErr(err)
+
+	// player two leaves; player one sees it right away, without waiting
+	// for eviction
+
+	is.NoErr(playerTwoClient.Leave())
+
+	_, despawned := waitForDelta(t, playerOneClient)
+	is.Equal(len(despawned), 1)
+	is.Equal(uint64(despawned[0]), uint64(2))
+
+	is.True(errors.Is(playerTwoClient.Leave(), lobbyclient.ErrNotJoined))
+	is.True(errors.Is(playerTwoClient.Reconnect(), lobbyclient.ErrNotJoined)) // left players don't come back on their own
+
+	// player that left may join again
+
+	_, err = playerTwoClient.SendCCmdJoinRecvSCmdSetSeed(2, "party", lobbyclient.PlayerInfo{Name: "again"})
+	is.NoErr(err)
+
+	info := waitForInfo(t, playerOneClient, 2)
+	is.Equal(info.Name, "again")
+}
+
+func TestLateJoinerReceivesTransforms(t *testing.T) {
+	is := is.New(t)
+
+	ls := startServer(t, nil)
+	playerOneClient := startPlayer(t, ls.Addr(), 1, "")
+
+	// player one moves and then stands still
+
+	playerOneClient.SendCCmdTransformPlayer(transformPlayer(1, 24, 13))
+	waitFor(t, waitTimeout, "server to receive the transform", func() bool {
+		lobbies := ls.Lobbies()
+		return len(lobbies) == 1 && lobbies[0].Clients[0].Position != nil
+	})
+
+	// player two joins after that and must still see player one
+
+	playerTwoClient := startPlayer(t, ls.Addr(), 2, "")
+
+	player := waitForPlayer(t, playerTwoClient, 1, 24)
+	is.Equal(int32(player.Transform.Y), int32(13))
+	is.Equal(len(playerTwoClient.GetPlayers()), 1)
+}
+
+func TestPlayerInfo(t *testing.T) {
+	is := is.New(t)
+
+	ls := startServer(t, nil)
+	playerOneClient := startClient(t, ls.Addr(), nil)
+	playerTwoClient := startClient(t, ls.Addr(), nil)
+
+	// invalid info is not sent
+
+	_, err := playerOneClient.SendCCmdJoinRecvSCmdSetSeed(1, "", lobbyclient.PlayerInfo{Name: "\xff"})
+	is.True(err != nil)
+	_, err = playerOneClient.SendCCmdJoinRecvSCmdSetSeed(1, "", lobbyclient.PlayerInfo{
+		Metadata: map[string]string{"blob": strings.Repeat("x", 5000)},
+	})
+	is.True(err != nil) // does not fit into a single cmd
+
+	playerOneInfo := lobbyclient.PlayerInfo{
+		Name:     "Мина 🧙",
+		Metadata: map[string]string{"color": "red", "version": "1"},
+	}
+	_, err = playerOneClient.SendCCmdJoinRecvSCmdSetSeed(1, "", playerOneInfo)
+	is.NoErr(err)
+
+	playerTwoInfo := lobbyclient.PlayerInfo{Name: "Ash", Metadata: map[string]string{}}
+	_, err = playerTwoClient.SendCCmdJoinRecvSCmdSetSeed(2, "", playerTwoInfo)
+	is.NoErr(err)
+
+	// late joiner learns about those who are already here and vice versa
+
+	is.Equal(waitForInfo(t, playerTwoClient, 1), playerOneInfo)
+	is.Equal(waitForInfo(t, playerOneClient, 2), playerTwoInfo)
+
+	// info of players that left is forgotten
+
+	_, err = playerTwoClient.SendCCmdJoinRecvSCmdSetSeed(2, "elsewhere", playerTwoInfo)
+	is.NoErr(err)
+
+	waitFor(t, waitTimeout, "info of player 2 to be forgotten", func() bool {
+		_, ok := playerOneClient.PlayerInfo(2)
+		return !ok
+	})
+}
+
+func TestDeltaPlayers(t *testing.T) {
+	is := is.New(t)
+
+	ls, playerOneClient, playerTwoClient := startParty(t, "")
+
+	playerOneClient.SendCCmdTransformPlayer(transformPlayer(1, 24, 13))
+	// NOTE(blukai): client's send/recv is "async" and server sends transforms
+	// out on tick
+	changed, despawned := waitForDelta(t, playerTwoClient)
+	is.Equal(len(changed), 1)
+	is.Equal(len(despawned), 0)
+	is.Equal(int32(changed[0].Transform.X), int32(24))
+	is.Equal(int32(changed[0].Transform.Y), int32(13))
+
+	// nothing changed since previous call
+
+	changed, _ = playerTwoClient.GetDeltaPlayers()
+	is.Equal(len(changed), 0)
+	is.Equal(len(playerTwoClient.GetPlayers()), 1)
+
+	// same transform must not be reported as a change
+
+	playerThreeClient := startPlayer(t, ls.Addr(), 3, "")
+
+	playerOneClient.SendCCmdTransformPlayer(transformPlayer(1, 24, 13))
+	// NOTE(blukai): player three moves after player one; once player two
+	// sees that, it has seen player one's transform too.
+	playerThreeClient.SendCCmdTransformPlayer(transformPlayer(3, 42, 31))
+
+	changed, _ = waitForDelta(t, playerTwoClient)
+	is.Equal(len(changed), 1)
+	is.Equal(uint64(changed[0].ID), uint64(3))
+}
+
+func TestPlayerState(t *testing.T) {
+	is := is.New(t)
+
+	_, playerOneClient, playerTwoClient := startParty(t, "")
+
+	state := protocol.NetworkedTransformPlayer{
+		ID: 1,
+		Transform: protocol.NetworkedInt32Vector2{
+			X: protocol.ToFixedPoint(24.5),
+			Y: protocol.ToFixedPoint(-13.25),
+		},
+		Velocity: protocol.NetworkedInt32Vector2{
+			X: protocol.ToFixedPoint(-60),
+			Y: protocol.ToFixedPoint(0.5),
+		},
+		Facing:    protocol.FacingLeft,
+		Animation: 3,
+	}
+	playerOneClient.SendCCmdTransformPlayer(state)
+
+	changed, _ := waitForDelta(t, playerTwoClient)
+	is.Equal(len(changed), 1)
+	is.Equal(*changed[0], state)
+	is.Equal(protocol.FromFixedPoint(changed[0].Transform.X), 24.5)
+
+	// turning around in place is a change too
+
+	state.Facing = protocol.FacingRight
+	playerOneClient.SendCCmdTransformPlayer(state)
+
+	changed, _ = waitForDelta(t, playerTwoClient)
+	is.Equal(len(changed), 1)
+	is.Equal(changed[0].Facing, protocol.FacingRight)
+}
+
+func TestInterpolatedPlayers(t *testing.T) {
+	is := is.New(t)
+
+	_, playerOneClient, playerTwoClient := startParty(t, "")
+
+	is.Equal(len(playerTwoClient.GetInterpolatedPlayers(time.Now())), 0)
+
+	playerOneClient.SendCCmdTransformPlayer(transformPlayer(1, 0, 0))
+	waitForPlayer(t, playerTwoClient, 1, 0)
+	// NOTE(blukai): players are drawn interpolation.Delay in the past; the
+	// first state must be reached before the next one arrives.
+	waitFor(t, interpolation.Delay+waitTimeout, "player 1 to be drawn", func() bool {
+		return len(playerTwoClient.GetInterpolatedPlayers(time.Now())) == 1
+	})
+
+	playerOneClient.SendCCmdTransformPlayer(transformPlayer(1, 1000, 0))
+	waitForPlayer(t, playerTwoClient, 1, 1000)
+
+	// NOTE(blukai): players are drawn in the past; the latest state is not
+	// reached yet.
+	players := playerTwoClient.GetInterpolatedPlayers(time.Now())
+	is.Equal(len(players), 1)
+	is.True(int32(players[0].Transform.X) >= 0)
+	is.True(int32(players[0].Transform.X) < 1000)
+
+	players = playerTwoClient.GetInterpolatedPlayers(time.Now().Add(interpolation.Delay * 2))
+	is.Equal(len(players), 1)
+	is.Equal(int32(players[0].Transform.X), int32(1000))
+}
+
+func TestLatency(t *testing.T) {
+	is := is.New(t)
+
+	// NOTE(blukai): server's and client's times start when they are
+	// created; server's time is ahead of client's time by the time that
+	// passed in between.
+	serverStart := time.Now()
+	ls := startServer(t, nil)
+	serverStarted := time.Now()
+
+	clientStart := time.Now()
+	lc := startClient(t, ls.Addr(), nil)
+	clientStarted := time.Now()
+
+	_, ok := lc.Latency()
+	is.True(!ok) // nothing is known before the first pong
+
+	for range 3 {
+		is.NoErr(lc.SendCCmdPing())
+	}
+
+	latency, ok := lc.Latency()
+	is.True(ok)
+	is.True(latency.RTT > 0)
+	is.True(latency.RTT < time.Millisecond*100) // loopback is fast
+	is.True(latency.Jitter >= 0)
+	// NOTE(blukai): server's time is truncated to milliseconds and the
+	// trip to the server may take anywhere from nothing to the whole rtt.
+	slack := latency.RTT/2 + time.Millisecond
+	is.True(latency.ClockOffset >= clientStart.Sub(serverStarted)-slack)
+	is.True(latency.ClockOffset <= clientStarted.Sub(serverStart)+slack)
+}
+
+// TestConcurrentPlayers is meant to be run with -race; it hammers client and
+// server state from multiple goroutines.
+func TestConcurrentPlayers(t *testing.T) {
+	is := is.New(t)
+
+	ls := startServer(t, nil)
+
+	const numPlayers = 8
+	const numTransforms = 50
+
+	clients := make([]*lobbyclient.LobbyClient, numPlayers)
+	for i := range clients {
+		clients[i] = startPlayer(t, ls.Addr(), uint64(i+1), "")
+	}
+
+	wg := sync.WaitGroup{}
+	for i, client := range clients {
+		id := uint64(i + 1)
+
+		// "network" thread
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range numTransforms {
+				client.SendCCmdTransformPlayer(transformPlayer(id, int32(j), int32(-j)))
+				time.Sleep(time.Millisecond)
+			}
+		}()
+
+		// "game" thread
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range numTransforms {
+				client.GetPlayers()
+				client.GetDeltaPlayers()
+				time.Sleep(time.Millisecond)
+			}
+		}()
+	}
+	wg.Wait()
+
+	for _, client := range clients {
+		waitFor(t, waitTimeout, "final transforms", func() bool {
+			players := client.GetPlayers()
+			if len(players) != numPlayers-1 {
+				return false
+			}
+			for _, player := range players {
+				if int32(player.Transform.X) != numTransforms-1 {
+					return false
+				}
+			}
+			return true
+		})
+		for _, player := range client.GetPlayers() {
+			is.Equal(int32(player.Transform.Y), int32(-(numTransforms - 1)))
+		}
+	}
+}
+
+// startLossyProxy forwards udp packets between a single client and the server
+// dropping every dropEvery-th packet in both directions. returned address must
+// be used by the client instead of server's address.
+func startLossyProxy(t *testing.T, serverAddr *net.UDPAddr, dropEvery uint64) *net.UDPAddr {
+	t.Helper()
+
+	var packets atomic.Uint64
+	return startProxy(t, serverAddr, func() bool {
+		return packets.Add(1)%dropEvery == 0
+	})
+}
+
+// startProxy is like startLossyProxy, but packets are dropped in both
+// directions whenever shouldDrop returns true.
+func startProxy(t *testing.T, serverAddr *net.UDPAddr, shouldDrop func() bool) *net.UDPAddr {
+	t.Helper()
+	is := is.New(t)
+
+	proxyConn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	is.NoErr(err)
+	t.Cleanup(func() { proxyConn.Close() })
+
+	serverConn, err := net.DialUDP("udp4", nil, serverAddr)
+	is.NoErr(err)
+	t.Cleanup(func() { serverConn.Close() })
+
+	clientAddrCh := make(chan *net.UDPAddr, 1)
+
+	// client -> server
+	go func() {
+		buf := make([]byte, 1<<16)
+		var clientAddr *net.UDPAddr
+		for {
+			n, addr, err := proxyConn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			if clientAddr == nil {
+				clientAddr = addr
+				clientAddrCh <- addr
+			}
+			if shouldDrop() {
+				continue
+			}
+			serverConn.Write(buf[:n])
+		}
+	}()
+
+	// server -> client
+	go func() {
+		buf := make([]byte, 1<<16)
+		clientAddr := <-clientAddrCh
+		for {
+			n, err := serverConn.Read(buf)
+			if err != nil {
+				return
+			}
+			if shouldDrop() {
+				continue
+			}
+			proxyConn.WriteToUDP(buf[:n], clientAddr)
+		}
+	}()
+
+	return proxyConn.LocalAddr().(*net.UDPAddr)
+}
+
+func TestReliableOverLossyLink(t *testing.T) {
+	is := is.New(t)
+
+	ls := startServer(t, nil)
+
+	// player one has a perfect connection
+
+	playerOneClient := startClient(t, ls.Addr(), nil)
+	playerOneSeed, err := playerOneClient.SendCCmdJoinRecvSCmdSetSeed(1, "", lobbyclient.PlayerInfo{})
+	is.NoErr(err)
+
+	// player two loses every other packet
+
+	playerTwoClient := startClient(t, startLossyProxy(t, ls.Addr(), 2), nil)
+	playerTwoSeed, err := playerTwoClient.SendCCmdJoinRecvSCmdSetSeed(2, "", lobbyclient.PlayerInfo{})
+	is.NoErr(err)
+	is.Equal(playerOneSeed, playerTwoSeed)
+
+	// player one leaves; despawn must reach player two despite the losses
+
+	_, err = playerOneClient.SendCCmdJoinRecvSCmdSetSeed(1, "elsewhere", lobbyclient.PlayerInfo{})
+	is.NoErr(err)
+
+	var despawned []protocol.NetworkedID
+	waitFor(t, reliable.RetransmitTimeout*reliable.MaxAttempts, "despawn", func() bool {
+		_, despawned = playerTwoClient.GetDeltaPlayers()
+		return len(despawned) > 0
+	})
+	is.Equal(len(despawned), 1)
+	is.Equal(uint64(despawned[0]), uint64(1))
+}
+
+func TestReconnectOnUndeliveredCmd(t *testing.T) {
+	is := is.New(t)
+
+	ls := startServer(t, nil)
+	playerOneClient := startPlayer(t, ls.Addr(), 1, "")
+
+	// NOTE(blukai): player two never reconnects because of silence; only
+	// undelivered cmd can make it reconnect.
+	var dropping atomic.Bool
+	playerTwoClient := startClient(t, startProxy(t, ls.Addr(), dropping.Load), &lobbyclient.Options{
+		SilenceTimeout: time.Hour,
+	})
+	_, err := playerTwoClient.SendCCmdJoinRecvSCmdSetSeed(2, "", lobbyclient.PlayerInfo{})
+	is.NoErr(err)
+
+	// chat is never acknowledged and stays at the head of the channel
+
+	dropping.Store(true)
+	is.NoErr(playerTwoClient.SendCCmdChat(protocol.ChatKindMessage, "lost"))
+	time.Sleep(reliable.RetransmitTimeout * (reliable.MaxAttempts + 1))
+	dropping.Store(false)
+
+	// client must start over instead of getting stuck; later reliable
+	// cmds get through
+
+	is.NoErr(playerTwoClient.SendCCmdChat(protocol.ChatKindMessage, "hello"))
+
+	var messages []protocol.NetworkedChat
+	waitFor(t, reliable.RetransmitTimeout*reliable.MaxAttempts, "chat message", func() bool {
+		messages = playerOneClient.GetChatMessages()
+		return len(messages) > 0
+	})
+	is.Equal(len(messages), 1)
+	is.Equal(string(messages[0].Text), "hello")
+	is.NoErr(playerTwoClient.Err())
+}
+
+func TestReconnect(t *testing.T) {
+	is := is.New(t)
+
+	ls, playerOneClient, playerTwoClient := startParty(t, "")
+
+	is.Equal(startClient(t, ls.Addr(), nil).Reconnect(), lobbyclient.ErrNotJoined)
+
+	// session is resumed; player two must not notice anything
+
+	is.NoErr(playerOneClient.Reconnect())
+
+	playerOneClient.SendCCmdTransformPlayer(transformPlayer(1, 24, 13))
+
+	changed, despawned := waitForDelta(t, playerTwoClient)
+	is.Equal(len(despawned), 0)
+	is.Equal(len(changed), 1)
+	is.Equal(uint64(changed[0].ID), uint64(1))
+	is.Equal(int32(changed[0].Transform.X), int32(24))
+}
+
+func TestReconnectToRestartedServer(t *testing.T) {
+	is := is.New(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	serverCtx, serverCancel := context.WithCancel(ctx)
+
+	ls, err := lobbyserver.NewLobbyServer("udp4", "127.0.0.1:0", nil, nil)
+	is.NoErr(err)
+	serverDone := make(chan error)
+	go func() { serverDone <- ls.Run(serverCtx) }()
+
+	lc, err := lobbyclient.NewLobbyClient("udp4", ls.Addr().String(), nil, nil)
+	is.NoErr(err)
+	go lc.Run(ctx)
+
+	_, err = lc.SendCCmdJoinRecvSCmdSetSeed(1, "", lobbyclient.PlayerInfo{})
+	is.NoErr(err)
+
+	// server forgets everything; lobby gets a new seed
+
+	serverCancel()
+	is.NoErr(<-serverDone)
+
+	ls, err = lobbyserver.NewLobbyServer("udp4", ls.Addr().String(), nil, nil)
+	is.NoErr(err)
+	go ls.Run(ctx)
+
+	err = lc.Reconnect()
+	is.True(errors.Is(err, lobbyclient.ErrSeedChanged))
+}
+
+func TestMultipleListeners(t *testing.T) {
+	is := is.New(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ls, err := lobbyserver.NewLobbyServer("udp4", "127.0.0.1:0", nil, nil)
+	is.NoErr(err)
+	is.NoErr(ls.Listen("udp4", "127.0.0.1:0"))
+	go ls.Run(ctx)
+
+	addrs := ls.Addrs()
+	is.Equal(len(addrs), 2)
+	is.Equal(addrs[0], ls.Addr())
+
+	// NOTE(blukai): clients' sockets are connected; they drop whatever
+	// comes from an address other than the one they dialed. replies that
+	// are sent through the wrong listener never arrive.
+
+	playerOneClient := startPlayer(t, addrs[0], 1, "party")
+	playerTwoClient := startPlayer(t, addrs[1], 2, "party")
+
+	playerOneClient.SendCCmdTransformPlayer(transformPlayer(1, 24, 13))
+	waitForPlayer(t, playerTwoClient, 1, 24)
+
+	is.True(ls.Listen("udp4", "127.0.0.1:0") != nil) // too late, server is running
+}
+
+func TestMixedFamilies(t *testing.T) {
+	is := is.New(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ls, err := lobbyserver.NewLobbyServer("udp4", "127.0.0.1:0", nil, nil)
+	is.NoErr(err)
+	if err := ls.Listen("udp6", "[::1]:0"); err != nil {
+		t.Skipf("ipv6 is not available: %v", err)
+	}
+	go ls.Run(ctx)
+
+	addrs := ls.Addrs()
+
+	playerOneClient := startClient(t, addrs[0], nil)
+	playerTwoClient := startClient(t, addrs[1], nil)
+
+	// ipv4 and ipv6 players share the lobby
+
+	playerOneSeed, err := playerOneClient.SendCCmdJoinRecvSCmdSetSeed(1, "party", lobbyclient.PlayerInfo{Name: "four"})
+	is.NoErr(err)
+	playerTwoSeed, err := playerTwoClient.SendCCmdJoinRecvSCmdSetSeed(2, "party", lobbyclient.PlayerInfo{Name: "six"})
+	is.NoErr(err)
+	is.Equal(playerOneSeed, playerTwoSeed)
+
+	playerOneClient.SendCCmdTransformPlayer(transformPlayer(1, 24, 13))
+	playerTwoClient.SendCCmdTransformPlayer(transformPlayer(2, 42, 31))
+	is.NoErr(playerTwoClient.SendCCmdChat(protocol.ChatKindMessage, "hi"))
+
+	changed, _ := waitForDelta(t, playerOneClient)
+	is.Equal(len(changed), 1)
+	is.Equal(int32(changed[0].Transform.X), int32(42))
+	is.Equal(waitForInfo(t, playerOneClient, 2).Name, "six")
+	chat := waitForChat(t, playerOneClient, 1)
+	is.Equal(len(chat), 1)
+	is.Equal(string(chat[0].Text), "hi")
+
+	waitForPlayer(t, playerTwoClient, 1, 24)
+	is.Equal(waitForInfo(t, playerTwoClient, 1).Name, "four")
+
+	// ipv6 player leaves; ipv4 player sees it
+
+	is.NoErr(playerTwoClient.Leave())
+
+	_, despawned := waitForDelta(t, playerOneClient)
+	is.Equal(len(despawned), 1)
+	is.Equal(uint64(despawned[0]), uint64(2))
+}
+
+func TestEviction(t *testing.T) {
+	is := is.New(t)
+
+	ls := startServer(t, &lobbyserver.Options{
+		EvictionTimeout: time.Millisecond * 300,
+		EvictorInterval: time.Millisecond * 50,
+	})
+
+	// NOTE(blukai): player one must not go silent for as long as player two
+	playerOneClient := startClient(t, ls.Addr(), &lobbyclient.Options{
+		KeepAliveInterval: time.Millisecond * 50,
+	})
+	_, err := playerOneClient.SendCCmdJoinRecvSCmdSetSeed(1, "", lobbyclient.PlayerInfo{})
+	is.NoErr(err)
+
+	playerTwoCtx, playerTwoCancel := context.WithCancel(context.Background())
+	defer playerTwoCancel()
+	playerTwoClient, err := lobbyclient.NewLobbyClient("udp4", ls.Addr().String(), nil, nil)
+	is.NoErr(err)
+	go playerTwoClient.Run(playerTwoCtx)
+
+	_, err = playerTwoClient.SendCCmdJoinRecvSCmdSetSeed(2, "", lobbyclient.PlayerInfo{})
+	is.NoErr(err)
+
+	// player two goes silent without leaving
+
+	playerTwoCancel()
+
+	_, despawned := waitForDelta(t, playerOneClient)
+	is.Equal(len(despawned), 1)
+	is.Equal(uint64(despawned[0]), uint64(2))
+	is.NoErr(playerOneClient.Err())
+}
+
+func TestInterestManagement(t *testing.T) {
+	is := is.New(t)
+
+	const farInterval = time.Millisecond * 500
+
+	ls, playerOneClient, playerTwoClient := startParty(t, "")
+	err := ls.SetInterestConfig(lobbyserver.InterestConfig{
+		Radius:      100,
+		FarInterval: farInterval,
+	})
+	is.NoErr(err)
+
+	waitForX := func(x int32, timeout time.Duration) {
+		t.Helper()
+		waitFor(t, timeout, fmt.Sprintf("x %d", x), func() bool {
+			players := playerTwoClient.GetPlayers()
+			return len(players) == 1 && int32(players[0].Transform.X) == x
+		})
+	}
+
+	playerTwoClient.SendCCmdTransformPlayer(transformPlayer(2, 0, 0))
+	waitForPlayer(t, playerOneClient, 2, 0)
+
+	// far player is still sent, but rarely
+
+	playerOneClient.SendCCmdTransformPlayer(transformPlayer(1, 10000, 0))
+	waitForX(10000, farInterval*2)
+	receivedAt := time.Now()
+
+	playerOneClient.SendCCmdTransformPlayer(transformPlayer(1, 10001, 0))
+	waitForX(10001, farInterval*2)
+	is.True(time.Since(receivedAt) > farInterval/2) // far update was not due right away
+
+	// near player is sent every tick
+
+	playerOneClient.SendCCmdTransformPlayer(transformPlayer(1, 50, 0))
+	waitForX(50, farInterval/4)
+}
+
+func TestChat(t *testing.T) {
+	is := is.New(t)
+
+	ls, playerOneClient, playerTwoClient := startParty(t, "party")
+	strangerClient := startPlayer(t, ls.Addr(), 3, "")
+
+	err := playerOneClient.SendCCmdChat(protocol.ChatKindMessage, "привет 👋")
+	is.NoErr(err)
+	err = playerOneClient.SendCCmdChat(protocol.ChatKindEmote, "waves")
+	is.NoErr(err)
+
+	// messages reach lobby members in order
+
+	chat := waitForChat(t, playerTwoClient, 2)
+	is.Equal(len(chat), 2)
+	is.Equal(chat[0], protocol.NetworkedChat{ID: 1, Kind: protocol.NetworkedUint64(protocol.ChatKindMessage), Text: "привет 👋"})
+	is.Equal(chat[1], protocol.NetworkedChat{ID: 1, Kind: protocol.NetworkedUint64(protocol.ChatKindEmote), Text: "waves"})
+	is.Equal(len(playerTwoClient.GetChatMessages()), 0) // messages are read once
+
+	// NOTE(blukai): everyone would have been sent the messages at once.
+	is.Equal(len(playerOneClient.GetChatMessages()), 0) // not sent back to the sender
+	is.Equal(len(strangerClient.GetChatMessages()), 0)  // not sent across lobbies
+
+	// invalid messages are not sent
+
+	is.True(playerOneClient.SendCCmdChat(protocol.ChatKindMessage, "\xff") != nil)
+	is.True(playerOneClient.SendCCmdChat(protocol.ChatKindMessage, "") != nil)
+
+	// messages that are sent too fast are not sent
+
+	for range protocol.ChatBurst - 2 {
+		is.NoErr(playerOneClient.SendCCmdChat(protocol.ChatKindMessage, "spam"))
+	}
+	err = playerOneClient.SendCCmdChat(protocol.ChatKindMessage, "spam")
+	is.True(errors.Is(err, lobbyclient.ErrRateLimited))
+}
+
+func TestLobbySeedControl(t *testing.T) {
+	is := is.New(t)
+
+	ls := startServer(t, nil)
+	err := ls.SetLobbyConfig(lobbyserver.LobbyConfig{
+		Retention:   time.Hour,
+		RunSettings: map[string]string{"mode": "nightmare"},
+	})
+	is.NoErr(err)
+
+	lc := startClient(t, ls.Addr(), nil)
+
+	// pinned seed and run settings are given on join
+
+	is.NoErr(ls.PinLobbySeed("party", 42))
+
+	seed, err := lc.SendCCmdJoinRecvSCmdSetSeed(1, "party", lobbyclient.PlayerInfo{})
+	is.NoErr(err)
+	is.Equal(seed, int32(42))
+	is.Equal(lc.RunSettings(), map[string]string{"mode": "nightmare"})
+
+	// rotated seed is given to those who join afterwards
+
+	rotatedSeed, err := ls.RotateLobbySeed("party")
+	is.NoErr(err)
+
+	seed, err = lc.SendCCmdJoinRecvSCmdSetSeed(2, "party", lobbyclient.PlayerInfo{})
+	is.NoErr(err)
+	is.Equal(seed, rotatedSeed)
+
+	// empty lobby keeps its seed
+
+	briefSeed, err := lc.SendCCmdJoinRecvSCmdSetSeed(1, "brief", lobbyclient.PlayerInfo{})
+	is.NoErr(err)
+	_, err = lc.SendCCmdJoinRecvSCmdSetSeed(1, "elsewhere", lobbyclient.PlayerInfo{})
+	is.NoErr(err)
+
+	seed, err = ls.LobbySeed("brief")
+	is.NoErr(err)
+	is.Equal(seed, briefSeed)
+
+	seed, err = lc.SendCCmdJoinRecvSCmdSetSeed(1, "brief", lobbyclient.PlayerInfo{})
+	is.NoErr(err)
+	is.Equal(seed, briefSeed)
+
+	is.Equal(ls.UnpinLobbySeed("nowhere"), lobbyserver.ErrLobbyNotFound)
+}
+
+func TestIncompatibleServer(t *testing.T) {
+	is := is.New(t)
+
+	// NOTE(blukai): server of some other protocol version; it refuses to
+	// talk to anyone.
+	serverConn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	is.NoErr(err)
+	defer serverConn.Close()
+	go func() {
+		buf := make([]byte, protocol.CmdMaxSize)
+		for {
+			n, addr, err := serverConn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			cmd := protocol.Cmd{}
+			if err := cmd.UnmarshalBinary(buf[:n]); err != nil || cmd.Header.Cmd != protocol.CCmdHello {
+				continue
+			}
+
+			sCmdError := protocol.NewSCmdError(protocol.ErrCodeIncompatibleVersion, "update the mod")
+			sCmdErrorBytes, err := sCmdError.MarshalBinary()
+			if err != nil {
+				return
+			}
+			serverConn.WriteToUDP(sCmdErrorBytes, addr)
+		}
+	}()
+
+	lc := startClient(t, serverConn.LocalAddr().(*net.UDPAddr), nil)
+
+	_, err = lc.SendCCmdJoinRecvSCmdSetSeed(1, "", lobbyclient.PlayerInfo{})
+	is.True(errors.Is(err, lobbyclient.ErrRejected))
+	is.True(errors.Is(lc.Err(), lobbyclient.ErrRejected))
+}
+
+func TestSnapshotOfUnannouncedPlayer(t *testing.T) {
+	is := is.New(t)
+
+	// NOTE(blukai): server that sends a snapshot of a player it never
+	// spawned (e.g. a snapshot that arrived after the despawn) and then
+	// refuses to talk.
+	serverConn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	is.NoErr(err)
+	defer serverConn.Close()
+	go func() {
+		buf := make([]byte, protocol.CmdMaxSize)
+		for {
+			n, addr, err := serverConn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			cmd := protocol.Cmd{}
+			if err := cmd.UnmarshalBinary(buf[:n]); err != nil || cmd.Header.Cmd != protocol.CCmdHello {
+				continue
+			}
+
+			for _, sCmd := range []protocol.Cmd{
+				protocol.NewSCmdPlayerSnapshot(0, []protocol.NetworkedTransformPlayer{transformPlayer(2, 24, 13)}),
+				protocol.NewSCmdError(protocol.ErrCodeIncompatibleVersion, "update the mod"),
+			} {
+				sCmdBytes, err := sCmd.MarshalBinary()
+				if err != nil {
+					return
+				}
+				serverConn.WriteToUDP(sCmdBytes, addr)
+			}
+		}
+	}()
+
+	lc := startClient(t, serverConn.LocalAddr().(*net.UDPAddr), nil)
+
+	_, err = lc.SendCCmdJoinRecvSCmdSetSeed(1, "", lobbyclient.PlayerInfo{})
+	is.True(errors.Is(err, lobbyclient.ErrRejected))
+
+	// snapshot was handled before the error
+	is.Equal(len(lc.GetPlayers()), 0)
+	changed, _ := lc.GetDeltaPlayers()
+	is.Equal(len(changed), 0)
+}
+
+func TestSnapshotBeforeSpawn(t *testing.T) {
+	is := is.New(t)
+
+	// NOTE(blukai): server that sends a snapshot of a player before
+	// spawning it (e.g. the first spawn got lost and was re-sent after the
+	// only snapshot the player is in) and then refuses to talk.
+	serverConn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	is.NoErr(err)
+	defer serverConn.Close()
+	go func() {
+		buf := make([]byte, protocol.CmdMaxSize)
+		for {
+			n, addr, err := serverConn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			cmd := protocol.Cmd{}
+			if err := cmd.UnmarshalBinary(buf[:n]); err != nil || cmd.Header.Cmd != protocol.CCmdHello {
+				continue
+			}
+
+			for _, sCmd := range []protocol.Cmd{
+				protocol.NewSCmdPlayerSnapshot(0, []protocol.NetworkedTransformPlayer{transformPlayer(2, 24, 13)}),
+				protocol.NewSCmdSpawnPlayer(protocol.NetworkedPlayerInfo{ID: 2}),
+				protocol.NewSCmdError(protocol.ErrCodeIncompatibleVersion, "update the mod"),
+			} {
+				sCmdBytes, err := sCmd.MarshalBinary()
+				if err != nil {
+					return
+				}
+				serverConn.WriteToUDP(sCmdBytes, addr)
+			}
+		}
+	}()
+
+	lc := startClient(t, serverConn.LocalAddr().(*net.UDPAddr), nil)
+
+	_, err = lc.SendCCmdJoinRecvSCmdSetSeed(1, "", lobbyclient.PlayerInfo{})
+	is.True(errors.Is(err, lobbyclient.ErrRejected))
 
-	players := playerTwoClient.GetPlayers()
+	// snapshot and spawn were handled before the error
+	players := lc.GetPlayers()
 	is.Equal(len(players), 1)
-	is.Equal(int32(players[0].Transform.X), playerOneX)
-	is.Equal(int32(players[0].Transform.Y), playerOneY)
+	is.Equal(*players[0], transformPlayer(2, 24, 13))
+	changed, _ := lc.GetDeltaPlayers()
+	is.Equal(len(changed), 1)
 }
@@ -0,0 +1,219 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/blukai/noitaparty/internal/debug"
+)
+
+// ContentType is the content type of prometheus text exposition format (see
+// Registry.WriteTo).
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// NOTE(blukai): https://prometheus.io/docs/concepts/data_model/#metric-names-and-labels
+var nameRegexp = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+
+var helpReplacer = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+
+// Counter is a value that only goes up. it is safe for concurrent use.
+type Counter struct {
+	value atomic.Uint64
+}
+
+func (c *Counter) Inc() {
+	c.value.Add(1)
+}
+
+func (c *Counter) Add(n uint64) {
+	c.value.Add(n)
+}
+
+func (c *Counter) Load() uint64 {
+	return c.value.Load()
+}
+
+// Histogram counts observed values in buckets. it is safe for concurrent use.
+type Histogram struct {
+	// bounds are inclusive upper bounds of buckets, ascending; values
+	// greater than the last bound fall into the implicit +Inf bucket.
+	bounds []float64
+	// counts holds non-cumulative per bucket counts; the last one is +Inf.
+	counts []atomic.Uint64
+	// sum holds float64 bits.
+	sum atomic.Uint64
+}
+
+func (h *Histogram) Observe(value float64) {
+	i := sort.SearchFloat64s(h.bounds, value)
+	h.counts[i].Add(1)
+
+	for {
+		prev := h.sum.Load()
+		next := math.Float64bits(math.Float64frombits(prev) + value)
+		if h.sum.CompareAndSwap(prev, next) {
+			return
+		}
+	}
+}
+
+// ExponentialBuckets returns count bounds: start, start*factor,
+// start*factor^2, ...
+func ExponentialBuckets(start, factor float64, count int) []float64 {
+	debug.Assert(start > 0 && factor > 1 && count > 0)
+
+	bounds := make([]float64, count)
+	for i := range bounds {
+		bounds[i] = start
+		start *= factor
+	}
+	return bounds
+}
+
+type metricKind string
+
+const (
+	kindCounter   metricKind = "counter"
+	kindGauge     metricKind = "gauge"
+	kindHistogram metricKind = "histogram"
+)
+
+type metric struct {
+	name string
+	help string
+	kind metricKind
+
+	counter   *Counter
+	gauge     func() float64
+	histogram *Histogram
+}
+
+// Registry holds metrics and writes them in prometheus text exposition format.
+// metrics are meant to be registered once, when their owner is constructed.
+type Registry struct {
+	mu      sync.Mutex
+	metrics []*metric
+}
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+func (r *Registry) register(m *metric) {
+	debug.Assert(nameRegexp.MatchString(m.name), "invalid metric name")
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, other := range r.metrics {
+		debug.Assert(other.name != m.name, "duplicate metric name")
+	}
+	r.metrics = append(r.metrics, m)
+}
+
+func (r *Registry) NewCounter(name, help string) *Counter {
+	counter := new(Counter)
+	r.register(&metric{name: name, help: help, kind: kindCounter, counter: counter})
+	return counter
+}
+
+// NewGaugeFunc registers a gauge whose value is computed by fn on every write;
+// fn may be called concurrently.
+func (r *Registry) NewGaugeFunc(name, help string, fn func() float64) {
+	r.register(&metric{name: name, help: help, kind: kindGauge, gauge: fn})
+}
+
+// NewHistogram registers a histogram with the given bucket bounds (see
+// ExponentialBuckets).
+func (r *Registry) NewHistogram(name, help string, bounds []float64) *Histogram {
+	debug.Assert(sort.Float64sAreSorted(bounds), "bounds must be sorted")
+
+	histogram := &Histogram{
+		bounds: bounds,
+		counts: make([]atomic.Uint64, len(bounds)+1),
+	}
+	r.register(&metric{name: name, help: help, kind: kindHistogram, histogram: histogram})
+	return histogram
+}
+
+func formatFloat(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	case math.IsNaN(value):
+		return "NaN"
+	default:
+		return strconv.FormatFloat(value, 'g', -1, 64)
+	}
+}
+
+// countingWriter counts bytes written to the underlying writer.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
+
+// WriteTo writes all metrics in prometheus text exposition format, in the
+// order they were registered.
+//
+// NOTE(blukai): values are read one by one, not all at once; a scrape may see,
+// for example, a histogram count that does not match the sum of its buckets
+// exactly.
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	metrics := r.metrics
+	r.mu.Unlock()
+
+	cw := &countingWriter{w: w}
+	bw := bufio.NewWriter(cw)
+	for _, m := range metrics {
+		fmt.Fprintf(bw, "# HELP %s %s\n", m.name, helpReplacer.Replace(m.help))
+		fmt.Fprintf(bw, "# TYPE %s %s\n", m.name, m.kind)
+
+		switch m.kind {
+		case kindCounter:
+			fmt.Fprintf(bw, "%s %d\n", m.name, m.counter.Load())
+		case kindGauge:
+			fmt.Fprintf(bw, "%s %s\n", m.name, formatFloat(m.gauge()))
+		case kindHistogram:
+			h := m.histogram
+			var cumulative uint64
+			for i := range h.counts {
+				cumulative += h.counts[i].Load()
+				le := math.Inf(1)
+				if i < len(h.bounds) {
+					le = h.bounds[i]
+				}
+				fmt.Fprintf(bw, "%s_bucket{le=\"%s\"} %d\n", m.name, formatFloat(le), cumulative)
+			}
+			fmt.Fprintf(bw, "%s_sum %s\n", m.name, formatFloat(math.Float64frombits(h.sum.Load())))
+			fmt.Fprintf(bw, "%s_count %d\n", m.name, cumulative)
+		}
+	}
+	err := bw.Flush()
+	return cw.n, err
+}
+
+// ServeHTTP writes metrics; registry can be mounted as a scrape target.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", ContentType)
+	// NOTE(blukai): nothing can be done if scraper went away
+	_, _ = r.WriteTo(w)
+}
@@ -0,0 +1,60 @@
+package metrics_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/blukai/noitaparty/internal/metrics"
+	"github.com/matryer/is"
+)
+
+func TestWriteTo(t *testing.T) {
+	is := is.New(t)
+
+	r := metrics.NewRegistry()
+
+	counter := r.NewCounter("test_packets_total", "Packets.\nwith a \\ newline")
+	counter.Inc()
+	counter.Add(2)
+
+	r.NewGaugeFunc("test_clients", "Clients.", func() float64 { return 1.5 })
+
+	histogram := r.NewHistogram("test_size_bytes", "Size.", metrics.ExponentialBuckets(1, 10, 2))
+	histogram.Observe(1) // bounds are inclusive
+	histogram.Observe(5)
+	histogram.Observe(100)
+
+	var sb strings.Builder
+	n, err := r.WriteTo(&sb)
+	is.NoErr(err)
+	is.Equal(int(n), sb.Len())
+	is.Equal(sb.String(), `# HELP test_packets_total Packets.\nwith a \\ newline
+# TYPE test_packets_total counter
+test_packets_total 3
+# HELP test_clients Clients.
+# TYPE test_clients gauge
+test_clients 1.5
+# HELP test_size_bytes Size.
+# TYPE test_size_bytes histogram
+test_size_bytes_bucket{le="1"} 1
+test_size_bytes_bucket{le="10"} 2
+test_size_bytes_bucket{le="+Inf"} 3
+test_size_bytes_sum 106
+test_size_bytes_count 3
+`)
+}
+
+func TestServeHTTP(t *testing.T) {
+	is := is.New(t)
+
+	r := metrics.NewRegistry()
+	r.NewCounter("test_total", "Test.").Inc()
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	is.Equal(w.Code, http.StatusOK)
+	is.Equal(w.Header().Get("Content-Type"), metrics.ContentType)
+	is.True(strings.Contains(w.Body.String(), "test_total 1\n"))
+}
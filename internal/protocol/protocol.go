@@ -3,33 +3,147 @@ package protocol
 import (
 	"bytes"
 	"encoding"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"math"
+	"time"
+	"unicode/utf8"
 
 	"github.com/blukai/noitaparty/internal/byteorder"
 	"github.com/blukai/noitaparty/internal/debug"
-	"github.com/blukai/noitaparty/internal/ptr"
 	"github.com/blukai/noitaparty/internal/zigzag"
 )
 
-// TODO(blukai): consider using varint (/leb128) encoding for some numbers.
-
 const (
-	CmdHeaderSize = 4       // uint16 (2) + uint16 (2) = 4
+	CmdHeaderSize = 18      // uint16 (2) * 5 + uint64 (8) = 18
 	CmdMaxSize    = 4 << 10 // 4 * 1024 = 4096 bytes (4 is just an arbitrary number here)
+
+	// LobbyNameMaxLen limits the length (in bytes) of lobby names that
+	// clients are allowed to join.
+	LobbyNameMaxLen = 64
+
+	// PlayerNameMaxLen limits the length (in bytes) of player names.
+	PlayerNameMaxLen = 128
+	// PlayerMetadataMaxLen limits the amount of player's metadata entries.
+	PlayerMetadataMaxLen = 16
+
+	// ChatTextMaxLen limits the length (in bytes) of chat messages.
+	ChatTextMaxLen = 256
+	// ChatBurst is the amount of chat messages client may send at once;
+	// afterwards it may send one message per ChatInterval. server drops
+	// messages that exceed the limit.
+	ChatBurst    = 5
+	ChatInterval = time.Second
+
+	// InterpolationDelay is how far in the past clients draw remote
+	// players. server must send snapshots more often than that, otherwise
+	// clients would rarely know the next state.
+	InterpolationDelay = time.Millisecond * 100
+)
+
+// ProtocolVersion must be bumped on every change that makes peers unable to
+// understand each other (new cmds, changed bodies, changed semantics). peers
+// of different versions refuse to talk to each other (see CCmdHello).
+const ProtocolVersion = 8
+
+// features are optional behaviors that both peers must support to be used;
+// they are negotiated during the handshake (see CCmdHello) and don't require
+// ProtocolVersion to be bumped.
+const (
+	// FeatureRunSettings indicates that SCmdSetSeed carries run settings.
+	FeatureRunSettings uint64 = 1 << iota
 )
 
+// SupportedFeatures are the features that this version of the protocol
+// implements.
+const SupportedFeatures = FeatureRunSettings
+
+// error codes carried by SCmdError.
+const (
+	_ uint64 = iota
+	// ErrCodeIncompatibleVersion means that peers speak different
+	// ProtocolVersion.
+	ErrCodeIncompatibleVersion
+	// ErrCodeKicked means that server operator removed the player from
+	// the lobby.
+	ErrCodeKicked
+	// ErrCodeBanned means that player is not allowed to join.
+	ErrCodeBanned
+	// ErrCodeDuplicatePlayer means that join was rejected because the
+	// player is in the lobby on another connection, and join did not carry
+	// that session's token.
+	ErrCodeDuplicatePlayer
+)
+
+// NOTE(blukai): data that is being decoded comes from the network and can't be
+// trusted; decoders must never panic, they return one of these errors instead.
+var (
+	// ErrShortBuffer is returned when data ends before the value does.
+	ErrShortBuffer = errors.New("short buffer")
+	// ErrUnknownCmd is returned when cmd is not registered.
+	ErrUnknownCmd = errors.New("unknown cmd")
+	// ErrSizeMismatch is returned when size of data does not match size of
+	// the value (e.g. there are trailing bytes or CmdHeader.Size is wrong).
+	ErrSizeMismatch = errors.New("size mismatch")
+	// ErrOverflow is returned when decoded number does not fit into its
+	// type or exceeds its limit.
+	ErrOverflow = errors.New("overflow")
+)
+
+// checkSize is used by UnmarshalBinary funcs to make sure that decode consumed
+// all of the data.
+func checkSize(size int, err error, data []byte) error {
+	if err != nil {
+		return err
+	}
+	if size != len(data) {
+		return fmt.Errorf("%w (got %d; want %d)", ErrSizeMismatch, len(data), size)
+	}
+	return nil
+}
+
+// NOTE(blukai): most numbers are varint (/leb128) encoded (see encoding/binary);
+// small numbers take fewer bytes, which is the case for most of the numbers
+// that are being sent around (coordinates, sizes, etc.). signed numbers are
+// zigzag encoded first (see zigzag package). identifiers are the exception (see
+// NetworkedID).
+
+// decodeUvarint is like binary.Uvarint, but returns an error instead of n <= 0.
+func decodeUvarint(data []byte) (uint64, int, error) {
+	v, n := binary.Uvarint(data)
+	switch {
+	case n == 0:
+		return 0, 0, ErrShortBuffer
+	case n < 0:
+		return 0, 0, ErrOverflow
+	}
+	return v, n, nil
+}
+
 const (
 	// NOTE(blukai): C stands for client
 	_ uint16 = iota
-	// respond with SCmdPong
+	// respond with SCmdPong which echoes client's time and carries server's
+	// time; it is used to measure round trip time and to sync clocks.
 	CCmdPing
-	// respond with SCmdSetSeed
+	// respond with SCmdSetSeed which carries session token, seed and run
+	// settings
 	CCmdJoin
 	// no response
 	CCmdTransformPlayer
-	// no response; if client stopped sending keep alive messages server
-	// must assume that client is not connected anymore
+	// respond with SCmdKeepAlive; if client stopped sending keep alive
+	// messages server must assume that client is not connected anymore
 	CCmdKeepAlive
+	// no response; acknowledges reliable server cmds (see CmdHeader.Ack)
+	CCmdAck
+	// reliable; no response. server sends it to other lobby members as
+	// SCmdChat.
+	CCmdChat
+	// no response; player leaves the lobby and its session ends. other
+	// lobby members receive SCmdDespawnPlayer right away instead of after
+	// eviction.
+	CCmdLeave
 
 	CCmdMax
 )
@@ -39,18 +153,65 @@ const (
 	_ uint16 = iota + CCmdMax
 	SCmdPong
 	SCmdSetSeed
-	// TODO(blukai): maybe it would be better to send player transforms in
-	// batches?
-	SCmdTransformPlayer
-	// TODO(blukai): spawn player (on connect)
-	// TODO(blukai): despawn player (on disconnect)
+	// sent periodically; contains transforms of players that moved since
+	// the previous snapshot
+	SCmdPlayerSnapshot
+	// sent to lobby members when player joins the lobby; also sent to the
+	// joined player for each player that is already in the lobby. carries
+	// player's name and metadata.
+	SCmdSpawnPlayer
+	// sent to lobby members when player leaves the lobby (or is evicted)
+	SCmdDespawnPlayer
+	// acknowledges reliable client cmds (see CmdHeader.Ack)
+	SCmdAck
+	// if client stopped receiving keep alive messages it must assume that
+	// server is not reachable anymore
+	SCmdKeepAlive
+	// reliable; chat message of another lobby member
+	SCmdChat
 
 	SCmdMax
 )
 
+// NOTE(blukai): hello and error cmds are how peers of different versions learn
+// about each other; unlike the rest, their numbers and bodies must never change.
+// numbers are picked far away from the regular cmds so that adding new cmds
+// won't collide with them.
+const (
+	// respond with SCmdHello; client whose protocol version differs from
+	// the one in the response must not join. client must say hello before
+	// joining.
+	CCmdHello uint16 = 0xff00 + iota
+	// carries server's protocol version and features
+	SCmdHello
+	// sent when server refuses to talk to the client (e.g. on version
+	// mismatch); carries a code (see ErrCode...) and a human readable
+	// message.
+	SCmdError
+)
+
+const (
+	// CmdFlagReliable indicates that cmd must be acknowledged by the peer
+	// and delivered in order; CmdHeader.Seq is valid.
+	CmdFlagReliable uint16 = 1 << iota
+	// CmdFlagAck indicates that CmdHeader.Ack is valid.
+	CmdFlagAck
+)
+
 type CmdHeader struct {
-	Cmd  uint16
-	Size uint16
+	Cmd   uint16
+	Size  uint16
+	Flags uint16
+	// Seq is a sequence number of a reliable cmd.
+	Seq uint16
+	// Ack is a cumulative acknowledgement; all reliable cmds with sequence
+	// numbers less than Ack were received by the peer.
+	Ack uint16
+	// Token is a session token issued by the server in response to
+	// CCmdJoin; clients must attach it to all subsequent cmds. in cmds sent
+	// by the server Token carries connection's nonce (see NetworkedJoin)
+	// instead.
+	Token uint64
 }
 
 var (
@@ -63,6 +224,10 @@ func (h *CmdHeader) MarshalBinary() ([]byte, error) {
 
 	buf.Write(byteorder.Htons(h.Cmd))
 	buf.Write(byteorder.Htons(h.Size))
+	buf.Write(byteorder.Htons(h.Flags))
+	buf.Write(byteorder.Htons(h.Seq))
+	buf.Write(byteorder.Htons(h.Ack))
+	buf.Write(byteorder.Htonll(h.Token))
 
 	data := buf.Bytes()
 	debug.Assert(len(data) == CmdHeaderSize)
@@ -71,16 +236,25 @@ func (h *CmdHeader) MarshalBinary() ([]byte, error) {
 }
 
 func (h *CmdHeader) UnmarshalBinary(data []byte) error {
-	debug.Assert(len(data) == CmdHeaderSize)
+	if len(data) < CmdHeaderSize {
+		return ErrShortBuffer
+	}
+	if len(data) > CmdHeaderSize {
+		return fmt.Errorf("%w (got %d; want %d)", ErrSizeMismatch, len(data), CmdHeaderSize)
+	}
 
 	h.Cmd = byteorder.Ntohs(data[0:2])
 	h.Size = byteorder.Ntohs(data[2:4])
+	h.Flags = byteorder.Ntohs(data[4:6])
+	h.Seq = byteorder.Ntohs(data[6:8])
+	h.Ack = byteorder.Ntohs(data[8:10])
+	h.Token = byteorder.Ntohll(data[10:18])
 
 	return nil
 }
 
-// TODO: get rid of CmdBody and define bodies for each cmd + command
-// constructors
+// CmdBody is implemented by networked types that cmds carry; body type of each
+// cmd is declared in cmdRegistry.
 type CmdBody interface {
 	encoding.BinaryMarshaler
 	encoding.BinaryUnmarshaler
@@ -96,22 +270,36 @@ var (
 	_ encoding.BinaryUnmarshaler = (*Cmd)(nil)
 )
 
+// MarshalBinary ignores Header.Size, it is computed from the body.
 func (cmd *Cmd) MarshalBinary() ([]byte, error) {
 	buf := bytes.Buffer{}
 
-	headerBytes, err := cmd.Header.MarshalBinary()
-	if err != nil {
-		return nil, fmt.Errorf("could not marshal header: %w", err)
-	}
-	buf.Write(headerBytes)
-
+	var bodyBytes []byte
 	if cmd.Body != nil {
-		bodyBytes, err := cmd.Body.MarshalBinary()
+		var err error
+		bodyBytes, err = cmd.Body.MarshalBinary()
 		if err != nil {
 			return nil, fmt.Errorf("could not marshal body: %w", err)
 		}
-		buf.Write(bodyBytes)
 	}
+	if len(bodyBytes) > CmdMaxSize-CmdHeaderSize {
+		return nil, fmt.Errorf(
+			"body is too big (got %d; want <= %d)",
+			len(bodyBytes),
+			CmdMaxSize-CmdHeaderSize,
+		)
+	}
+
+	// NOTE(blukai): size of the body is not known upfront because most
+	// numbers are varint encoded. header is copied because it may be shared.
+	header := *cmd.Header
+	header.Size = uint16(len(bodyBytes))
+	headerBytes, err := header.MarshalBinary()
+	if err != nil {
+		return nil, fmt.Errorf("could not marshal header: %w", err)
+	}
+	buf.Write(headerBytes)
+	buf.Write(bodyBytes)
 
 	data := buf.Bytes()
 	debug.Assert(len(data) >= CmdHeaderSize)
@@ -120,43 +308,52 @@ func (cmd *Cmd) MarshalBinary() ([]byte, error) {
 }
 
 func (cmd *Cmd) UnmarshalBinary(data []byte) error {
-	debug.Assert(len(data) >= CmdHeaderSize)
+	if len(data) < CmdHeaderSize {
+		return fmt.Errorf("could not unmarshal header: %w", ErrShortBuffer)
+	}
 
-	headerBytes := data[0:CmdHeaderSize]
 	header := &CmdHeader{}
-	err := header.UnmarshalBinary(headerBytes)
+	err := header.UnmarshalBinary(data[0:CmdHeaderSize])
 	if err != nil {
 		return fmt.Errorf("could not unmarshal header: %w", err)
 	}
-	cmd.Header = header
 
-	if len(data) > CmdHeaderSize {
-		body := (CmdBody)(nil)
-		switch cmd.Header.Cmd {
-		// client
-		case CCmdJoin:
-			body = ptr.To(NetworkedUint64(0))
-		case CCmdTransformPlayer:
-			body = &NetworkedTransformPlayer{}
-		// server
-		case SCmdSetSeed:
-			body = ptr.To(NetworkedInt32(0))
-		case SCmdTransformPlayer:
-			body = &NetworkedTransformPlayer{}
-		}
-		if body != nil {
-			bodyBytes := data[CmdHeaderSize : CmdHeaderSize+cmd.Header.Size]
-			err := body.UnmarshalBinary(bodyBytes)
-			if err != nil {
-				return fmt.Errorf("could not unmarshal body: %w", err)
-			}
-			cmd.Body = body
+	spec, ok := cmdRegistry[header.Cmd]
+	if !ok {
+		return fmt.Errorf("%w: %d", ErrUnknownCmd, header.Cmd)
+	}
+
+	bodyBytes := data[CmdHeaderSize:]
+	if int(header.Size) != len(bodyBytes) {
+		return fmt.Errorf(
+			"%w (got %d body bytes; header says %d)",
+			ErrSizeMismatch,
+			len(bodyBytes),
+			header.Size,
+		)
+	}
+
+	var body CmdBody
+	if spec.newBody != nil {
+		body = spec.newBody()
+		if err := body.UnmarshalBinary(bodyBytes); err != nil {
+			return fmt.Errorf("could not unmarshal body: %w", err)
 		}
+	} else if len(bodyBytes) > 0 {
+		return fmt.Errorf("%w (cmd %d does not have a body)", ErrSizeMismatch, header.Cmd)
 	}
 
+	cmd.Header = header
+	cmd.Body = body
+
 	return nil
 }
 
+// NOTE(blukai): encoded size of most networked types is not fixed (see
+// decodeUvarint); decode unmarshals value from the beginning of data and returns
+// the amount of bytes read, which allows to decode fields one after another.
+// decode does not modify the value if it returns an error.
+
 type NetworkedInt32 int32
 
 var (
@@ -165,13 +362,24 @@ var (
 )
 
 func (n *NetworkedInt32) MarshalBinary() ([]byte, error) {
-	return byteorder.Htonl(zigzag.Encode32(int32(*n))), nil
+	return binary.AppendUvarint(nil, uint64(zigzag.Encode32(int32(*n)))), nil
 }
 
 func (n *NetworkedInt32) UnmarshalBinary(data []byte) error {
-	debug.Assert(len(data) == 4)
-	*n = NetworkedInt32(zigzag.Decode32(byteorder.Ntohl(data)))
-	return nil
+	size, err := n.decode(data)
+	return checkSize(size, err, data)
+}
+
+func (n *NetworkedInt32) decode(data []byte) (int, error) {
+	v, size, err := decodeUvarint(data)
+	if err != nil {
+		return 0, err
+	}
+	if v > math.MaxUint32 {
+		return 0, ErrOverflow
+	}
+	*n = NetworkedInt32(zigzag.Decode32(uint32(v)))
+	return size, nil
 }
 
 type NetworkedUint64 uint64
@@ -182,13 +390,52 @@ var (
 )
 
 func (n *NetworkedUint64) MarshalBinary() ([]byte, error) {
-	return byteorder.Htonll(uint64(*n)), nil
+	return binary.AppendUvarint(nil, uint64(*n)), nil
 }
 
 func (n *NetworkedUint64) UnmarshalBinary(data []byte) error {
-	debug.Assert(len(data) == 8)
-	*n = NetworkedUint64(byteorder.Ntohll(data))
-	return nil
+	size, err := n.decode(data)
+	return checkSize(size, err, data)
+}
+
+func (n *NetworkedUint64) decode(data []byte) (int, error) {
+	v, size, err := decodeUvarint(data)
+	if err != nil {
+		return 0, err
+	}
+	*n = NetworkedUint64(v)
+	return size, nil
+}
+
+// NetworkedIDSize is the size (in bytes) of encoded NetworkedID.
+const NetworkedIDSize = 8
+
+// NetworkedID identifies a player (steam id), a connection (nonce) or a
+// session (token). it is encoded as fixed 8 bytes in network byte order:
+// steam ids are >= 2^56 and nonces and tokens are random, as varints they
+// would take 9 or 10 bytes.
+type NetworkedID uint64
+
+var (
+	_ encoding.BinaryMarshaler   = (*NetworkedID)(nil)
+	_ encoding.BinaryUnmarshaler = (*NetworkedID)(nil)
+)
+
+func (n *NetworkedID) MarshalBinary() ([]byte, error) {
+	return byteorder.Htonll(uint64(*n)), nil
+}
+
+func (n *NetworkedID) UnmarshalBinary(data []byte) error {
+	size, err := n.decode(data)
+	return checkSize(size, err, data)
+}
+
+func (n *NetworkedID) decode(data []byte) (int, error) {
+	if len(data) < NetworkedIDSize {
+		return 0, ErrShortBuffer
+	}
+	*n = NetworkedID(byteorder.Ntohll(data))
+	return NetworkedIDSize, nil
 }
 
 type NetworkedInt32Vector2 struct {
@@ -216,25 +463,79 @@ func (n *NetworkedInt32Vector2) MarshalBinary() ([]byte, error) {
 }
 
 func (n *NetworkedInt32Vector2) UnmarshalBinary(data []byte) error {
-	debug.Assert(len(data) == 8)
+	size, err := n.decode(data)
+	return checkSize(size, err, data)
+}
 
-	err := n.X.UnmarshalBinary(data[0:4])
-	debug.Assert(err == nil)
+func (n *NetworkedInt32Vector2) decode(data []byte) (int, error) {
+	var v NetworkedInt32Vector2
 
-	err = n.Y.UnmarshalBinary(data[4:8])
-	debug.Assert(err == nil)
+	xSize, err := v.X.decode(data)
+	if err != nil {
+		return 0, fmt.Errorf("could not decode x: %w", err)
+	}
+	ySize, err := v.Y.decode(data[xSize:])
+	if err != nil {
+		return 0, fmt.Errorf("could not decode y: %w", err)
+	}
 
-	return nil
+	*n = v
+	return xSize + ySize, nil
+}
+
+// FixedPointScale is the amount of fixed-point units per pixel; positions and
+// velocities are sent as fixed-point numbers to not lose sub-pixel precision
+// while still being compact (see decodeUvarint).
+const FixedPointScale = 16
+
+// ToFixedPoint converts v to fixed-point, rounding it to the nearest unit and
+// clamping it to the range of int32.
+func ToFixedPoint(v float64) NetworkedInt32 {
+	v = math.Round(v * FixedPointScale)
+	switch {
+	case math.IsNaN(v):
+		return 0
+	case v >= math.MaxInt32:
+		return math.MaxInt32
+	case v <= math.MinInt32:
+		return math.MinInt32
+	}
+	return NetworkedInt32(v)
 }
 
+// FromFixedPoint converts fixed-point v back to a floating point number.
+func FromFixedPoint(v NetworkedInt32) float64 {
+	return float64(v) / FixedPointScale
+}
+
+const (
+	FacingUnknown NetworkedInt32 = 0
+	FacingRight   NetworkedInt32 = 1
+	FacingLeft    NetworkedInt32 = -1
+)
+
+// NetworkedTransformPlayerMaxSize is the max amount of bytes encoded
+// NetworkedTransformPlayer can take.
+const NetworkedTransformPlayerMaxSize = NetworkedIDSize + binary.MaxVarintLen32*6 // 8 + 5 * 6 = 38
+
+// NetworkedTransformPlayer is player's state that is needed to draw the player
+// on other clients.
 type NetworkedTransformPlayer struct {
-	ID        NetworkedUint64
+	ID NetworkedID
+	// Transform is player's position in fixed-point (see FixedPointScale).
 	Transform NetworkedInt32Vector2
+	// Velocity is in fixed-point pixels per second.
+	Velocity NetworkedInt32Vector2
+	// Facing is one of Facing... constants.
+	Facing NetworkedInt32
+	// Animation identifies sprite animation that player plays; ids are
+	// defined by the mod.
+	Animation NetworkedInt32
 }
 
 var (
-	_ encoding.BinaryMarshaler   = (*NetworkedInt32Vector2)(nil)
-	_ encoding.BinaryUnmarshaler = (*NetworkedInt32Vector2)(nil)
+	_ encoding.BinaryMarshaler   = (*NetworkedTransformPlayer)(nil)
+	_ encoding.BinaryUnmarshaler = (*NetworkedTransformPlayer)(nil)
 )
 
 func (n *NetworkedTransformPlayer) MarshalBinary() ([]byte, error) {
@@ -248,17 +549,762 @@ func (n *NetworkedTransformPlayer) MarshalBinary() ([]byte, error) {
 	debug.Assert(err == nil)
 	buf.Write(transform)
 
+	velocity, err := n.Velocity.MarshalBinary()
+	debug.Assert(err == nil)
+	buf.Write(velocity)
+
+	facing, err := n.Facing.MarshalBinary()
+	debug.Assert(err == nil)
+	buf.Write(facing)
+
+	animation, err := n.Animation.MarshalBinary()
+	debug.Assert(err == nil)
+	buf.Write(animation)
+
 	return buf.Bytes(), nil
 }
 
 func (n *NetworkedTransformPlayer) UnmarshalBinary(data []byte) error {
-	debug.Assert(len(data) == 16)
+	size, err := n.decode(data)
+	return checkSize(size, err, data)
+}
+
+func (n *NetworkedTransformPlayer) decode(data []byte) (int, error) {
+	var v NetworkedTransformPlayer
+
+	size, err := v.ID.decode(data)
+	if err != nil {
+		return 0, fmt.Errorf("could not decode id: %w", err)
+	}
+	transformSize, err := v.Transform.decode(data[size:])
+	if err != nil {
+		return 0, fmt.Errorf("could not decode transform: %w", err)
+	}
+	size += transformSize
+	velocitySize, err := v.Velocity.decode(data[size:])
+	if err != nil {
+		return 0, fmt.Errorf("could not decode velocity: %w", err)
+	}
+	size += velocitySize
+	facingSize, err := v.Facing.decode(data[size:])
+	if err != nil {
+		return 0, fmt.Errorf("could not decode facing: %w", err)
+	}
+	size += facingSize
+	animationSize, err := v.Animation.decode(data[size:])
+	if err != nil {
+		return 0, fmt.Errorf("could not decode animation: %w", err)
+	}
+	size += animationSize
+
+	*n = v
+	return size, nil
+}
+
+// PlayerSnapshotMaxLen is the max amount of players that are guaranteed to fit
+// into a single SCmdPlayerSnapshot.
+const PlayerSnapshotMaxLen = (CmdMaxSize - CmdHeaderSize - binary.MaxVarintLen64 - binary.MaxVarintLen32) / NetworkedTransformPlayerMaxSize
+
+// NetworkedPlayerSnapshot is encoded as varint time, varint count and players.
+type NetworkedPlayerSnapshot struct {
+	// Time is server's time (in milliseconds since server started) at
+	// which the snapshot was taken; it allows clients to place players'
+	// states on a timeline (e.g. to interpolate between them).
+	Time    NetworkedUint64
+	Players []NetworkedTransformPlayer
+}
+
+var (
+	_ encoding.BinaryMarshaler   = (*NetworkedPlayerSnapshot)(nil)
+	_ encoding.BinaryUnmarshaler = (*NetworkedPlayerSnapshot)(nil)
+)
+
+func (n *NetworkedPlayerSnapshot) MarshalBinary() ([]byte, error) {
+	if len(n.Players) > PlayerSnapshotMaxLen {
+		return nil, fmt.Errorf(
+			"too many players (got %d; want <= %d)",
+			len(n.Players),
+			PlayerSnapshotMaxLen,
+		)
+	}
+
+	buf := bytes.Buffer{}
+
+	buf.Write(binary.AppendUvarint(nil, uint64(n.Time)))
+	buf.Write(binary.AppendUvarint(nil, uint64(len(n.Players))))
+	for i := range n.Players {
+		player, err := n.Players[i].MarshalBinary()
+		debug.Assert(err == nil)
+		buf.Write(player)
+	}
+
+	return buf.Bytes(), nil
+}
+
+func (n *NetworkedPlayerSnapshot) UnmarshalBinary(data []byte) error {
+	var snapshotTime NetworkedUint64
+	size, err := snapshotTime.decode(data)
+	if err != nil {
+		return fmt.Errorf("could not decode time: %w", err)
+	}
+
+	count, countSize, err := decodeUvarint(data[size:])
+	if err != nil {
+		return fmt.Errorf("could not decode count: %w", err)
+	}
+	size += countSize
+	if count > PlayerSnapshotMaxLen {
+		return fmt.Errorf("%w: too many players (got %d; want <= %d)", ErrOverflow, count, PlayerSnapshotMaxLen)
+	}
+	// NOTE(blukai): each player takes at least 14 bytes (id and 6 one byte
+	// varints); don't allocate more than data can possibly hold.
+	if count > uint64(len(data)-size)/(NetworkedIDSize+6) {
+		return ErrShortBuffer
+	}
+
+	players := make([]NetworkedTransformPlayer, count)
+	for i := range players {
+		playerSize, err := players[i].decode(data[size:])
+		if err != nil {
+			return fmt.Errorf("could not decode player %d: %w", i, err)
+		}
+		size += playerSize
+	}
+	if err := checkSize(size, nil, data); err != nil {
+		return err
+	}
+
+	n.Time = snapshotTime
+	n.Players = players
+	return nil
+}
+
+// NetworkedString is encoded as varint length followed by raw bytes.
+type NetworkedString string
+
+var (
+	_ encoding.BinaryMarshaler   = (*NetworkedString)(nil)
+	_ encoding.BinaryUnmarshaler = (*NetworkedString)(nil)
+)
+
+func (n *NetworkedString) MarshalBinary() ([]byte, error) {
+	if len(*n) > math.MaxUint16 {
+		return nil, fmt.Errorf("string is too long (got %d; want <= %d)", len(*n), math.MaxUint16)
+	}
+
+	buf := bytes.Buffer{}
+
+	buf.Write(binary.AppendUvarint(nil, uint64(len(*n))))
+	buf.WriteString(string(*n))
+
+	return buf.Bytes(), nil
+}
+
+func (n *NetworkedString) UnmarshalBinary(data []byte) error {
+	size, err := n.decode(data)
+	return checkSize(size, err, data)
+}
+
+func (n *NetworkedString) decode(data []byte) (int, error) {
+	length, size, err := decodeUvarint(data)
+	if err != nil {
+		return 0, fmt.Errorf("could not decode length: %w", err)
+	}
+	if length > math.MaxUint16 {
+		return 0, fmt.Errorf("%w: string is too long (got %d; want <= %d)", ErrOverflow, length, math.MaxUint16)
+	}
+	if uint64(len(data)-size) < length {
+		return 0, ErrShortBuffer
+	}
+
+	*n = NetworkedString(data[size : size+int(length)])
+
+	return size + int(length), nil
+}
+
+// NetworkedHello is the body of CCmdHello and SCmdHello.
+type NetworkedHello struct {
+	Version NetworkedUint64
+	// Features is a bitset of Feature... constants that the peer
+	// supports.
+	Features NetworkedUint64
+}
+
+var (
+	_ encoding.BinaryMarshaler   = (*NetworkedHello)(nil)
+	_ encoding.BinaryUnmarshaler = (*NetworkedHello)(nil)
+)
+
+func (n *NetworkedHello) MarshalBinary() ([]byte, error) {
+	buf := binary.AppendUvarint(nil, uint64(n.Version))
+	buf = binary.AppendUvarint(buf, uint64(n.Features))
+	return buf, nil
+}
+
+func (n *NetworkedHello) UnmarshalBinary(data []byte) error {
+	var v NetworkedHello
+
+	size, err := v.Version.decode(data)
+	if err != nil {
+		return fmt.Errorf("could not decode version: %w", err)
+	}
+	featuresSize, err := v.Features.decode(data[size:])
+	if err != nil {
+		return fmt.Errorf("could not decode features: %w", err)
+	}
+	size += featuresSize
+	if err := checkSize(size, nil, data); err != nil {
+		return err
+	}
+
+	*n = v
+	return nil
+}
+
+// NetworkedError is the body of SCmdError.
+type NetworkedError struct {
+	Code    NetworkedUint64
+	Message NetworkedString
+}
+
+var (
+	_ encoding.BinaryMarshaler   = (*NetworkedError)(nil)
+	_ encoding.BinaryUnmarshaler = (*NetworkedError)(nil)
+)
+
+func (n *NetworkedError) MarshalBinary() ([]byte, error) {
+	buf := binary.AppendUvarint(nil, uint64(n.Code))
+
+	message, err := n.Message.MarshalBinary()
+	if err != nil {
+		return nil, fmt.Errorf("could not marshal message: %w", err)
+	}
+
+	return append(buf, message...), nil
+}
+
+func (n *NetworkedError) UnmarshalBinary(data []byte) error {
+	var v NetworkedError
+
+	size, err := v.Code.decode(data)
+	if err != nil {
+		return fmt.Errorf("could not decode code: %w", err)
+	}
+	messageSize, err := v.Message.decode(data[size:])
+	if err != nil {
+		return fmt.Errorf("could not decode message: %w", err)
+	}
+	size += messageSize
+	if err := checkSize(size, nil, data); err != nil {
+		return err
+	}
+
+	*n = v
+	return nil
+}
+
+// NetworkedPing is the body of CCmdPing.
+type NetworkedPing struct {
+	// ClientTime is client's time in microseconds; server echoes it back
+	// as is, client defines what it means.
+	ClientTime NetworkedUint64
+}
+
+var (
+	_ encoding.BinaryMarshaler   = (*NetworkedPing)(nil)
+	_ encoding.BinaryUnmarshaler = (*NetworkedPing)(nil)
+)
+
+func (n *NetworkedPing) MarshalBinary() ([]byte, error) {
+	return binary.AppendUvarint(nil, uint64(n.ClientTime)), nil
+}
+
+func (n *NetworkedPing) UnmarshalBinary(data []byte) error {
+	var v NetworkedPing
+
+	size, err := v.ClientTime.decode(data)
+	if err != nil {
+		return fmt.Errorf("could not decode client time: %w", err)
+	}
+	if err := checkSize(size, nil, data); err != nil {
+		return err
+	}
+
+	*n = v
+	return nil
+}
+
+// NetworkedPong is the body of SCmdPong.
+type NetworkedPong struct {
+	// ClientTime is echoed from NetworkedPing.
+	ClientTime NetworkedUint64
+	// ServerTime is server's time in milliseconds at the moment pong was
+	// sent; it is on the same clock as NetworkedPlayerSnapshot.Time.
+	ServerTime NetworkedUint64
+}
+
+var (
+	_ encoding.BinaryMarshaler   = (*NetworkedPong)(nil)
+	_ encoding.BinaryUnmarshaler = (*NetworkedPong)(nil)
+)
+
+func (n *NetworkedPong) MarshalBinary() ([]byte, error) {
+	buf := binary.AppendUvarint(nil, uint64(n.ClientTime))
+	buf = binary.AppendUvarint(buf, uint64(n.ServerTime))
+	return buf, nil
+}
+
+func (n *NetworkedPong) UnmarshalBinary(data []byte) error {
+	var v NetworkedPong
+
+	size, err := v.ClientTime.decode(data)
+	if err != nil {
+		return fmt.Errorf("could not decode client time: %w", err)
+	}
+	serverTimeSize, err := v.ServerTime.decode(data[size:])
+	if err != nil {
+		return fmt.Errorf("could not decode server time: %w", err)
+	}
+	size += serverTimeSize
+	if err := checkSize(size, nil, data); err != nil {
+		return err
+	}
+
+	*n = v
+	return nil
+}
+
+// chat kinds carried by NetworkedChat.
+const (
+	// ChatKindMessage is a regular message ("player: text").
+	ChatKindMessage uint64 = iota
+	// ChatKindEmote describes an action ("* player text").
+	ChatKindEmote
+
+	chatKindMax
+)
+
+// NetworkedChat is the body of CCmdChat and SCmdChat.
+type NetworkedChat struct {
+	// ID is the player's id of the sender.
+	ID NetworkedID
+	// Kind is one of ChatKind... constants.
+	Kind NetworkedUint64
+	// Text is utf-8; it is at most ChatTextMaxLen bytes long.
+	Text NetworkedString
+}
+
+var (
+	_ encoding.BinaryMarshaler   = (*NetworkedChat)(nil)
+	_ encoding.BinaryUnmarshaler = (*NetworkedChat)(nil)
+)
+
+func (n *NetworkedChat) MarshalBinary() ([]byte, error) {
+	buf := byteorder.Htonll(uint64(n.ID))
+	buf = binary.AppendUvarint(buf, uint64(n.Kind))
+
+	text, err := n.Text.MarshalBinary()
+	if err != nil {
+		return nil, fmt.Errorf("could not marshal text: %w", err)
+	}
+
+	return append(buf, text...), nil
+}
+
+func (n *NetworkedChat) UnmarshalBinary(data []byte) error {
+	var v NetworkedChat
+
+	size, err := v.ID.decode(data)
+	if err != nil {
+		return fmt.Errorf("could not decode id: %w", err)
+	}
+	kindSize, err := v.Kind.decode(data[size:])
+	if err != nil {
+		return fmt.Errorf("could not decode kind: %w", err)
+	}
+	size += kindSize
+	textSize, err := v.Text.decode(data[size:])
+	if err != nil {
+		return fmt.Errorf("could not decode text: %w", err)
+	}
+	size += textSize
+	if err := checkSize(size, nil, data); err != nil {
+		return err
+	}
+
+	*n = v
+	return nil
+}
+
+// Validate returns an error if chat message must not be sent (or shown).
+func (n *NetworkedChat) Validate() error {
+	if uint64(n.Kind) >= chatKindMax {
+		return fmt.Errorf("unknown chat kind: %d", n.Kind)
+	}
+	if len(n.Text) == 0 {
+		return fmt.Errorf("chat text is empty")
+	}
+	if len(n.Text) > ChatTextMaxLen {
+		return fmt.Errorf(
+			"chat text is too long (got %d; want <= %d)",
+			len(n.Text),
+			ChatTextMaxLen,
+		)
+	}
+	if !utf8.ValidString(string(n.Text)) {
+		return fmt.Errorf("chat text is not valid utf-8")
+	}
+	return nil
+}
+
+// NetworkedMetadata is a key/value pair that describes the player (e.g. mod
+// version, chosen color); it is defined and interpreted by the mod.
+type NetworkedMetadata struct {
+	Key   NetworkedString
+	Value NetworkedString
+}
+
+// appendMetadata appends varint count and key/value pairs to buf.
+func appendMetadata(buf []byte, metadata []NetworkedMetadata) ([]byte, error) {
+	if len(metadata) > PlayerMetadataMaxLen {
+		return nil, fmt.Errorf(
+			"too much metadata (got %d; want <= %d)",
+			len(metadata),
+			PlayerMetadataMaxLen,
+		)
+	}
+
+	buf = binary.AppendUvarint(buf, uint64(len(metadata)))
+	for i := range metadata {
+		key, err := metadata[i].Key.MarshalBinary()
+		if err != nil {
+			return nil, fmt.Errorf("could not marshal metadata key: %w", err)
+		}
+		buf = append(buf, key...)
+
+		value, err := metadata[i].Value.MarshalBinary()
+		if err != nil {
+			return nil, fmt.Errorf("could not marshal metadata value: %w", err)
+		}
+		buf = append(buf, value...)
+	}
+	return buf, nil
+}
+
+// decodeMetadata is the opposite of appendMetadata; metadata is nil if there
+// are no entries.
+func decodeMetadata(data []byte) ([]NetworkedMetadata, int, error) {
+	count, size, err := decodeUvarint(data)
+	if err != nil {
+		return nil, 0, fmt.Errorf("could not decode metadata count: %w", err)
+	}
+	if count > PlayerMetadataMaxLen {
+		return nil, 0, fmt.Errorf(
+			"%w: too much metadata (got %d; want <= %d)",
+			ErrOverflow,
+			count,
+			PlayerMetadataMaxLen,
+		)
+	}
+	if count == 0 {
+		return nil, size, nil
+	}
+
+	metadata := make([]NetworkedMetadata, count)
+	for i := range metadata {
+		keySize, err := metadata[i].Key.decode(data[size:])
+		if err != nil {
+			return nil, 0, fmt.Errorf("could not decode metadata %d key: %w", i, err)
+		}
+		size += keySize
+		valueSize, err := metadata[i].Value.decode(data[size:])
+		if err != nil {
+			return nil, 0, fmt.Errorf("could not decode metadata %d value: %w", i, err)
+		}
+		size += valueSize
+	}
+	return metadata, size, nil
+}
+
+// validatePlayerName returns an error if name can't be shown to other players.
+func validatePlayerName(name NetworkedString) error {
+	if len(name) > PlayerNameMaxLen {
+		return fmt.Errorf(
+			"player name is too long (got %d; want <= %d)",
+			len(name),
+			PlayerNameMaxLen,
+		)
+	}
+	if !utf8.ValidString(string(name)) {
+		return fmt.Errorf("player name is not valid utf-8")
+	}
+	return nil
+}
+
+// NetworkedPlayerInfo is the body of SCmdSpawnPlayer; it describes a player
+// to other lobby members.
+type NetworkedPlayerInfo struct {
+	ID       NetworkedID
+	Name     NetworkedString
+	Metadata []NetworkedMetadata
+}
+
+var (
+	_ encoding.BinaryMarshaler   = (*NetworkedPlayerInfo)(nil)
+	_ encoding.BinaryUnmarshaler = (*NetworkedPlayerInfo)(nil)
+)
+
+func (n *NetworkedPlayerInfo) MarshalBinary() ([]byte, error) {
+	buf := byteorder.Htonll(uint64(n.ID))
+
+	name, err := n.Name.MarshalBinary()
+	if err != nil {
+		return nil, fmt.Errorf("could not marshal name: %w", err)
+	}
+	buf = append(buf, name...)
+
+	return appendMetadata(buf, n.Metadata)
+}
+
+func (n *NetworkedPlayerInfo) UnmarshalBinary(data []byte) error {
+	var v NetworkedPlayerInfo
+
+	size, err := v.ID.decode(data)
+	if err != nil {
+		return fmt.Errorf("could not decode id: %w", err)
+	}
+	nameSize, err := v.Name.decode(data[size:])
+	if err != nil {
+		return fmt.Errorf("could not decode name: %w", err)
+	}
+	size += nameSize
+	metadata, metadataSize, err := decodeMetadata(data[size:])
+	if err != nil {
+		return err
+	}
+	v.Metadata = metadata
+	size += metadataSize
+	if err := checkSize(size, nil, data); err != nil {
+		return err
+	}
+
+	*n = v
+	return nil
+}
+
+// Validate returns an error if player info must not be accepted (or shown).
+func (n *NetworkedPlayerInfo) Validate() error {
+	return validatePlayerName(n.Name)
+}
+
+// NetworkedJoin is the body of CCmdJoin. Version and Features are the ones
+// that were agreed on during the handshake.
+type NetworkedJoin struct {
+	Version  NetworkedUint64
+	Features NetworkedUint64
+	ID       NetworkedID
+	// Nonce identifies client's connection; it changes when client
+	// reconnects (and starts over its reliable delivery state).
+	Nonce NetworkedID
+	Lobby NetworkedString
+	// Name and Metadata are sent to other lobby members (see
+	// NetworkedPlayerInfo).
+	Name     NetworkedString
+	Metadata []NetworkedMetadata
+}
+
+var (
+	_ encoding.BinaryMarshaler   = (*NetworkedJoin)(nil)
+	_ encoding.BinaryUnmarshaler = (*NetworkedJoin)(nil)
+)
+
+func (n *NetworkedJoin) MarshalBinary() ([]byte, error) {
+	buf := bytes.Buffer{}
+
+	buf.Write(binary.AppendUvarint(nil, uint64(n.Version)))
+	buf.Write(binary.AppendUvarint(nil, uint64(n.Features)))
+
+	id, err := n.ID.MarshalBinary()
+	debug.Assert(err == nil)
+	buf.Write(id)
+
+	nonce, err := n.Nonce.MarshalBinary()
+	debug.Assert(err == nil)
+	buf.Write(nonce)
+
+	lobby, err := n.Lobby.MarshalBinary()
+	if err != nil {
+		return nil, fmt.Errorf("could not marshal lobby: %w", err)
+	}
+	buf.Write(lobby)
+
+	name, err := n.Name.MarshalBinary()
+	if err != nil {
+		return nil, fmt.Errorf("could not marshal name: %w", err)
+	}
+	buf.Write(name)
+
+	metadata, err := appendMetadata(nil, n.Metadata)
+	if err != nil {
+		return nil, err
+	}
+	buf.Write(metadata)
+
+	return buf.Bytes(), nil
+}
+
+// PlayerInfo returns info that is sent to other lobby members.
+func (n *NetworkedJoin) PlayerInfo() NetworkedPlayerInfo {
+	return NetworkedPlayerInfo{
+		ID:       n.ID,
+		Name:     n.Name,
+		Metadata: n.Metadata,
+	}
+}
+
+func (n *NetworkedJoin) UnmarshalBinary(data []byte) error {
+	var v NetworkedJoin
+
+	size, err := v.Version.decode(data)
+	if err != nil {
+		return fmt.Errorf("could not decode version: %w", err)
+	}
+	featuresSize, err := v.Features.decode(data[size:])
+	if err != nil {
+		return fmt.Errorf("could not decode features: %w", err)
+	}
+	size += featuresSize
+	idSize, err := v.ID.decode(data[size:])
+	if err != nil {
+		return fmt.Errorf("could not decode id: %w", err)
+	}
+	size += idSize
+	nonceSize, err := v.Nonce.decode(data[size:])
+	if err != nil {
+		return fmt.Errorf("could not decode nonce: %w", err)
+	}
+	size += nonceSize
+	lobbySize, err := v.Lobby.decode(data[size:])
+	if err != nil {
+		return fmt.Errorf("could not decode lobby: %w", err)
+	}
+	size += lobbySize
+	nameSize, err := v.Name.decode(data[size:])
+	if err != nil {
+		return fmt.Errorf("could not decode name: %w", err)
+	}
+	size += nameSize
+	metadata, metadataSize, err := decodeMetadata(data[size:])
+	if err != nil {
+		return err
+	}
+	v.Metadata = metadata
+	size += metadataSize
+	if err := checkSize(size, nil, data); err != nil {
+		return err
+	}
+
+	*n = v
+	return nil
+}
 
-	err := n.ID.UnmarshalBinary(data[0:8])
+// NetworkedRunSetting is a key/value pair that describes the run (in addition
+// to the seed); settings are defined by the server and interpreted by the mod.
+type NetworkedRunSetting struct {
+	Key   NetworkedString
+	Value NetworkedString
+}
+
+// NetworkedSession is the response to CCmdJoin. it carries everything client
+// needs to play in the lobby.
+type NetworkedSession struct {
+	Token    NetworkedID
+	Seed     NetworkedInt32
+	Settings []NetworkedRunSetting
+}
+
+var (
+	_ encoding.BinaryMarshaler   = (*NetworkedSession)(nil)
+	_ encoding.BinaryUnmarshaler = (*NetworkedSession)(nil)
+)
+
+func (n *NetworkedSession) MarshalBinary() ([]byte, error) {
+	if len(n.Settings) > math.MaxUint16 {
+		return nil, fmt.Errorf("too many settings (got %d; want <= %d)", len(n.Settings), math.MaxUint16)
+	}
+
+	buf := bytes.Buffer{}
+
+	token, err := n.Token.MarshalBinary()
 	debug.Assert(err == nil)
+	buf.Write(token)
 
-	err = n.Transform.UnmarshalBinary(data[8:16])
+	seed, err := n.Seed.MarshalBinary()
 	debug.Assert(err == nil)
+	buf.Write(seed)
+
+	buf.Write(binary.AppendUvarint(nil, uint64(len(n.Settings))))
+	for i := range n.Settings {
+		key, err := n.Settings[i].Key.MarshalBinary()
+		if err != nil {
+			return nil, fmt.Errorf("could not marshal setting key: %w", err)
+		}
+		buf.Write(key)
+
+		value, err := n.Settings[i].Value.MarshalBinary()
+		if err != nil {
+			return nil, fmt.Errorf("could not marshal setting value: %w", err)
+		}
+		buf.Write(value)
+	}
+
+	return buf.Bytes(), nil
+}
+
+func (n *NetworkedSession) UnmarshalBinary(data []byte) error {
+	var v NetworkedSession
+
+	size, err := v.Token.decode(data)
+	if err != nil {
+		return fmt.Errorf("could not decode token: %w", err)
+	}
+	seedSize, err := v.Seed.decode(data[size:])
+	if err != nil {
+		return fmt.Errorf("could not decode seed: %w", err)
+	}
+	size += seedSize
+
+	count, countSize, err := decodeUvarint(data[size:])
+	if err != nil {
+		return fmt.Errorf("could not decode settings count: %w", err)
+	}
+	size += countSize
+	if count > math.MaxUint16 {
+		return fmt.Errorf("%w: too many settings (got %d; want <= %d)", ErrOverflow, count, math.MaxUint16)
+	}
+	// NOTE(blukai): each setting takes at least 2 bytes; don't allocate
+	// more than data can possibly hold.
+	if count > uint64(len(data)-size)/2 {
+		return ErrShortBuffer
+	}
+
+	v.Settings = make([]NetworkedRunSetting, count)
+	for i := range v.Settings {
+		keySize, err := v.Settings[i].Key.decode(data[size:])
+		if err != nil {
+			return fmt.Errorf("could not decode setting %d key: %w", i, err)
+		}
+		size += keySize
+		valueSize, err := v.Settings[i].Value.decode(data[size:])
+		if err != nil {
+			return fmt.Errorf("could not decode setting %d value: %w", i, err)
+		}
+		size += valueSize
+	}
+	if err := checkSize(size, nil, data); err != nil {
+		return err
+	}
 
+	*n = v
 	return nil
 }
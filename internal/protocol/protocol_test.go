@@ -1,7 +1,11 @@
 package protocol_test
 
 import (
+	"bytes"
+	"encoding/binary"
+	"errors"
 	"math"
+	"strings"
 	"testing"
 
 	"github.com/blukai/noitaparty/internal/protocol"
@@ -12,8 +16,12 @@ func TestCmdHeaderEncoding(t *testing.T) {
 	is := is.New(t)
 
 	originalCmdHeader := protocol.CmdHeader{
-		Cmd:  protocol.CCmdPing,
-		Size: 42,
+		Cmd:   protocol.CCmdPing,
+		Size:  42,
+		Flags: protocol.CmdFlagReliable | protocol.CmdFlagAck,
+		Seq:   math.MaxUint16,
+		Ack:   24,
+		Token: math.MaxUint64,
 	}
 
 	encodedCmdHeaderBytes, err := originalCmdHeader.MarshalBinary()
@@ -32,7 +40,7 @@ func TestCmdEncoding(t *testing.T) {
 	t.Run("no body", func(t *testing.T) {
 		originalCmd := protocol.Cmd{
 			Header: &protocol.CmdHeader{
-				Cmd: 42,
+				Cmd: protocol.CCmdKeepAlive,
 			},
 		}
 
@@ -47,28 +55,346 @@ func TestCmdEncoding(t *testing.T) {
 	})
 
 	t.Run("with body", func(t *testing.T) {
-		// TODO(blukai): mashal cmd with body
-		t.Skip()
+		testCases := []protocol.Cmd{
+			protocol.NewCCmdPing(math.MaxUint64),
+			protocol.NewCCmdJoin(42, 24, "party"),
+			protocol.NewCCmdTransformPlayer(protocol.NetworkedTransformPlayer{
+				ID:        42,
+				Transform: protocol.NetworkedInt32Vector2{X: -1, Y: 1},
+				Velocity:  protocol.NetworkedInt32Vector2{X: 24, Y: -24},
+				Facing:    protocol.FacingLeft,
+				Animation: 3,
+			}),
+			protocol.NewCCmdKeepAlive(),
+			protocol.NewCCmdAck(),
+			protocol.NewSCmdPong(math.MaxUint64, 1337),
+			protocol.NewSCmdSetSeed(42, -1, []protocol.NetworkedRunSetting{{Key: "mode", Value: "nightmare"}}),
+			protocol.NewSCmdPlayerSnapshot(1337, []protocol.NetworkedTransformPlayer{{ID: 42}}),
+			protocol.NewSCmdSpawnPlayer(protocol.NetworkedPlayerInfo{
+				ID:       42,
+				Name:     "Mina",
+				Metadata: []protocol.NetworkedMetadata{{Key: "color", Value: "#ff00ff"}},
+			}),
+			protocol.NewSCmdDespawnPlayer(42),
+			protocol.NewSCmdAck(),
+			protocol.NewSCmdKeepAlive(),
+			protocol.NewCCmdChat(42, protocol.ChatKindMessage, "hello, party"),
+			protocol.NewCCmdLeave(),
+			protocol.NewSCmdChat(math.MaxUint64, protocol.ChatKindEmote, "waves 👋"),
+			protocol.NewCCmdHello(protocol.ProtocolVersion, protocol.SupportedFeatures),
+			protocol.NewSCmdHello(math.MaxUint64, math.MaxUint64),
+			protocol.NewSCmdError(protocol.ErrCodeIncompatibleVersion, "update the mod"),
+		}
+
+		for _, originalCmd := range testCases {
+			encodedCmdBytes, err := originalCmd.MarshalBinary()
+			is.NoErr(err)
+
+			decodedCmd := protocol.Cmd{}
+			err = decodedCmd.UnmarshalBinary(encodedCmdBytes)
+			is.NoErr(err)
+
+			// NOTE(blukai): size is computed by MarshalBinary
+			is.Equal(int(decodedCmd.Header.Size), len(encodedCmdBytes)-protocol.CmdHeaderSize)
+			decodedCmd.Header.Size = 0
+			is.Equal(originalCmd, decodedCmd)
+		}
+	})
+
+	t.Run("invalid body", func(t *testing.T) {
+		defer func() {
+			is.True(recover() != nil)
+		}()
+		protocol.NewCmd(protocol.CCmdKeepAlive, &protocol.NetworkedJoin{})
+	})
+}
+
+func TestCmdDecodingErrors(t *testing.T) {
+	is := is.New(t)
+
+	join := protocol.NewCCmdJoin(42, 24, "party")
+	joinBytes, err := join.MarshalBinary()
+	is.NoErr(err)
+
+	unknown := protocol.CmdHeader{Cmd: math.MaxUint16}
+	unknownBytes, err := unknown.MarshalBinary()
+	is.NoErr(err)
+
+	// NOTE(blukai): header claims a body, but there's none
+	lying := protocol.CmdHeader{Cmd: protocol.CCmdJoin, Size: 42}
+	lyingBytes, err := lying.MarshalBinary()
+	is.NoErr(err)
+
+	// NOTE(blukai): size matches, but body ends in the middle of id
+	truncated := protocol.CmdHeader{Cmd: protocol.CCmdJoin, Size: 3}
+	truncatedBytes, err := truncated.MarshalBinary()
+	is.NoErr(err)
+	truncatedBytes = append(truncatedBytes, 42, 24, 5)
+
+	// NOTE(blukai): client's time does not fit into 64 bits
+	overflowing := protocol.CmdHeader{Cmd: protocol.CCmdPing, Size: binary.MaxVarintLen64 + 1}
+	overflowingBytes, err := overflowing.MarshalBinary()
+	is.NoErr(err)
+	overflowingBytes = append(overflowingBytes, bytes.Repeat([]byte{0xff}, binary.MaxVarintLen64)...)
+	overflowingBytes = append(overflowingBytes, 0x01)
+
+	testCases := []struct {
+		name string
+		data []byte
+		want error
+	}{
+		{"empty", nil, protocol.ErrShortBuffer},
+		{"short header", joinBytes[:protocol.CmdHeaderSize-1], protocol.ErrShortBuffer},
+		{"unknown cmd", unknownBytes, protocol.ErrUnknownCmd},
+		{"short body", joinBytes[:len(joinBytes)-1], protocol.ErrSizeMismatch},
+		{"trailing bytes", append(joinBytes, 0), protocol.ErrSizeMismatch},
+		{"size beyond data", lyingBytes, protocol.ErrSizeMismatch},
+		{"truncated body", truncatedBytes, protocol.ErrShortBuffer},
+		{"overflowing varint", overflowingBytes, protocol.ErrOverflow},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cmd := protocol.Cmd{}
+			err := cmd.UnmarshalBinary(tc.data)
+			is.True(errors.Is(err, tc.want))
+		})
+	}
+}
+
+func TestChatValidation(t *testing.T) {
+	is := is.New(t)
+
+	valid := protocol.NetworkedChat{Kind: protocol.NetworkedUint64(protocol.ChatKindEmote), Text: "waves 👋"}
+	is.NoErr(valid.Validate())
+
+	testCases := []struct {
+		name string
+		chat protocol.NetworkedChat
+	}{
+		{"unknown kind", protocol.NetworkedChat{Kind: math.MaxUint64, Text: "hi"}},
+		{"empty", protocol.NetworkedChat{}},
+		{"too long", protocol.NetworkedChat{Text: protocol.NetworkedString(strings.Repeat("a", protocol.ChatTextMaxLen+1))}},
+		{"invalid utf-8", protocol.NetworkedChat{Text: "\xff"}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			is.True(tc.chat.Validate() != nil)
+		})
+	}
+}
+
+func FuzzCmdUnmarshal(f *testing.F) {
+	seeds := []protocol.Cmd{
+		protocol.NewCCmdPing(42),
+		protocol.NewSCmdPong(42, 1337),
+		protocol.NewCCmdJoin(42, 24, "party"),
+		protocol.NewCCmdTransformPlayer(protocol.NetworkedTransformPlayer{
+			ID:        42,
+			Transform: protocol.NetworkedInt32Vector2{X: -1, Y: 1},
+			Facing:    protocol.FacingRight,
+		}),
+		protocol.NewSCmdSetSeed(42, -1, []protocol.NetworkedRunSetting{{Key: "mode", Value: "nightmare"}}),
+		protocol.NewSCmdPlayerSnapshot(1337, []protocol.NetworkedTransformPlayer{{ID: 42}}),
+		protocol.NewSCmdSpawnPlayer(protocol.NetworkedPlayerInfo{ID: 42, Name: "Mina"}),
+		protocol.NewCCmdChat(42, protocol.ChatKindMessage, "hello, party"),
+		protocol.NewCCmdHello(protocol.ProtocolVersion, protocol.SupportedFeatures),
+		protocol.NewSCmdError(protocol.ErrCodeIncompatibleVersion, "update the mod"),
+	}
+	for _, cmd := range seeds {
+		data, err := cmd.MarshalBinary()
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(data)
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		cmd := protocol.Cmd{}
+		if err := cmd.UnmarshalBinary(data); err != nil {
+			return
+		}
+
+		// NOTE(blukai): whatever decodes must encode back to the same
+		// cmd (but not necessarily to the same bytes, varints may be
+		// padded).
+		encoded, err := cmd.MarshalBinary()
+		if err != nil {
+			t.Fatalf("could not marshal decoded cmd: %v", err)
+		}
+		decoded := protocol.Cmd{}
+		if err := decoded.UnmarshalBinary(encoded); err != nil {
+			t.Fatalf("could not unmarshal re-encoded cmd: %v", err)
+		}
+		if len(encoded) > len(data) {
+			t.Fatalf("re-encoded cmd is bigger (got %d; want <= %d)", len(encoded), len(data))
+		}
 	})
 }
 
 func TestNetworkedInt32Encoding(t *testing.T) {
 	is := is.New(t)
 
-	testCases := []int32{0, 1, -1, 42, -42, math.MaxInt32, math.MinInt32}
+	// NOTE(blukai): small numbers of either sign take a single byte
+	testCases := []struct {
+		v       int32
+		encoded []byte
+	}{
+		{0, []byte{0x00}},
+		{-1, []byte{0x01}},
+		{1, []byte{0x02}},
+		{42, []byte{0x54}},
+		{-42, []byte{0x53}},
+		{64, []byte{0x80, 0x01}},
+		{math.MaxInt32, []byte{0xfe, 0xff, 0xff, 0xff, 0x0f}},
+		{math.MinInt32, []byte{0xff, 0xff, 0xff, 0xff, 0x0f}},
+	}
 
 	for _, tc := range testCases {
-		original := protocol.NetworkedInt32(tc)
+		original := protocol.NetworkedInt32(tc.v)
 
 		encoded, err := original.MarshalBinary()
 		is.NoErr(err)
-		is.Equal(len(encoded), 4)
+		is.Equal(encoded, tc.encoded)
+
+		var decoded protocol.NetworkedInt32
+		err = decoded.UnmarshalBinary(encoded)
+		is.NoErr(err)
+		is.Equal(original, decoded)
+	}
+}
+
+func TestNetworkedUint64Encoding(t *testing.T) {
+	is := is.New(t)
+
+	testCases := []struct {
+		v       uint64
+		encoded []byte
+	}{
+		{0, []byte{0x00}},
+		{1, []byte{0x01}},
+		{127, []byte{0x7f}},
+		{128, []byte{0x80, 0x01}},
+		{300, []byte{0xac, 0x02}},
+		{math.MaxUint32, []byte{0xff, 0xff, 0xff, 0xff, 0x0f}},
+		{math.MaxUint64, []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01}},
+	}
+
+	for _, tc := range testCases {
+		original := protocol.NetworkedUint64(tc.v)
+
+		encoded, err := original.MarshalBinary()
+		is.NoErr(err)
+		is.Equal(encoded, tc.encoded)
+
+		var decoded protocol.NetworkedUint64
+		err = decoded.UnmarshalBinary(encoded)
+		is.NoErr(err)
+		is.Equal(original, decoded)
+	}
+
+	t.Run("short buffer", func(t *testing.T) {
+		var decoded protocol.NetworkedUint64
+		err := decoded.UnmarshalBinary([]byte{0x80, 0x80})
+		is.True(errors.Is(err, protocol.ErrShortBuffer))
+	})
+
+	t.Run("overflow", func(t *testing.T) {
+		var decoded protocol.NetworkedUint64
+		err := decoded.UnmarshalBinary([]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x02})
+		is.True(errors.Is(err, protocol.ErrOverflow))
+		err = decoded.UnmarshalBinary(bytes.Repeat([]byte{0x80}, 11))
+		is.True(errors.Is(err, protocol.ErrOverflow))
+	})
+}
+
+func FuzzNetworkedInt32(f *testing.F) {
+	f.Add(int32(0))
+	f.Add(int32(-1))
+	f.Add(int32(math.MinInt32))
+
+	f.Fuzz(func(t *testing.T, v int32) {
+		original := protocol.NetworkedInt32(v)
+		encoded, err := original.MarshalBinary()
+		if err != nil || len(encoded) > binary.MaxVarintLen32 {
+			t.Fatalf("could not encode %d (%d bytes): %v", v, len(encoded), err)
+		}
 
 		var decoded protocol.NetworkedInt32
+		if err := decoded.UnmarshalBinary(encoded); err != nil || decoded != original {
+			t.Fatalf("got %d; want %d: %v", decoded, original, err)
+		}
+	})
+}
+
+func FuzzNetworkedUint64(f *testing.F) {
+	f.Add(uint64(0))
+	f.Add(uint64(300))
+	f.Add(uint64(math.MaxUint64))
+
+	f.Fuzz(func(t *testing.T, v uint64) {
+		original := protocol.NetworkedUint64(v)
+		encoded, err := original.MarshalBinary()
+		if err != nil || len(encoded) > binary.MaxVarintLen64 {
+			t.Fatalf("could not encode %d (%d bytes): %v", v, len(encoded), err)
+		}
+
+		var decoded protocol.NetworkedUint64
+		if err := decoded.UnmarshalBinary(encoded); err != nil || decoded != original {
+			t.Fatalf("got %d; want %d: %v", decoded, original, err)
+		}
+	})
+}
+
+// every successfully decoded value must survive a round trip and must not take
+// more bytes when re-encoded (varints may be padded with 0x80).
+func FuzzNetworkedUint64Decode(f *testing.F) {
+	f.Add([]byte{})
+	f.Add([]byte{0x80})
+	f.Add([]byte{0x80, 0x00})
+	f.Add([]byte{0xac, 0x02, 0xff})
+	f.Add(bytes.Repeat([]byte{0xff}, 11))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var decoded protocol.NetworkedUint64
+		if err := decoded.UnmarshalBinary(data); err != nil {
+			return
+		}
+
+		encoded, err := decoded.MarshalBinary()
+		if err != nil || len(encoded) > len(data) {
+			t.Fatalf("could not re-encode %d (got %d bytes; want <= %d): %v", decoded, len(encoded), len(data), err)
+		}
+		var redecoded protocol.NetworkedUint64
+		if err := redecoded.UnmarshalBinary(encoded); err != nil || redecoded != decoded {
+			t.Fatalf("got %d; want %d: %v", redecoded, decoded, err)
+		}
+	})
+}
+
+func TestNetworkedIDEncoding(t *testing.T) {
+	is := is.New(t)
+
+	// NOTE(blukai): steam ids are >= 2^56
+	testCases := []uint64{0, 1, 76561197960287930, math.MaxUint64}
+
+	for _, tc := range testCases {
+		original := protocol.NetworkedID(tc)
+
+		encoded, err := original.MarshalBinary()
+		is.NoErr(err)
+		is.Equal(len(encoded), protocol.NetworkedIDSize)
+
+		var decoded protocol.NetworkedID
 		err = decoded.UnmarshalBinary(encoded)
 		is.NoErr(err)
 		is.Equal(original, decoded)
 	}
+
+	var decoded protocol.NetworkedID
+	err := decoded.UnmarshalBinary(make([]byte, protocol.NetworkedIDSize-1))
+	is.True(errors.Is(err, protocol.ErrShortBuffer))
 }
 
 func TestNetworkedInt32Vector2Encoding(t *testing.T) {
@@ -76,11 +402,12 @@ func TestNetworkedInt32Vector2Encoding(t *testing.T) {
 
 	testCases := []struct {
 		x, y int32
+		size int
 	}{
-		{0, 0},
-		{1, -1},
-		{42, 24},
-		{math.MaxInt32, math.MinInt32},
+		{0, 0, 2},
+		{1, -1, 2},
+		{42, 24, 2},
+		{math.MaxInt32, math.MinInt32, binary.MaxVarintLen32 * 2},
 	}
 
 	for _, tc := range testCases {
@@ -91,7 +418,7 @@ func TestNetworkedInt32Vector2Encoding(t *testing.T) {
 
 		encoded, err := original.MarshalBinary()
 		is.NoErr(err)
-		is.Equal(len(encoded), 8)
+		is.Equal(len(encoded), tc.size)
 
 		var decoded protocol.NetworkedInt32Vector2
 		err = decoded.UnmarshalBinary(encoded)
@@ -99,3 +426,198 @@ func TestNetworkedInt32Vector2Encoding(t *testing.T) {
 		is.Equal(original, decoded)
 	}
 }
+
+// movement traffic mostly consists of small coordinates, those must take fewer
+// bytes than fixed size encoding would.
+func TestCCmdTransformPlayerSize(t *testing.T) {
+	is := is.New(t)
+
+	cCmdTransformPlayer := protocol.NewCCmdTransformPlayer(protocol.NetworkedTransformPlayer{
+		// NOTE(blukai): steam ids are big
+		ID: 76561197960287930,
+		Transform: protocol.NetworkedInt32Vector2{
+			X: protocol.ToFixedPoint(227.5),
+			Y: protocol.ToFixedPoint(-83.25),
+		},
+		Velocity: protocol.NetworkedInt32Vector2{
+			X: protocol.ToFixedPoint(3.5),
+			Y: protocol.ToFixedPoint(-1),
+		},
+		Facing:    protocol.FacingLeft,
+		Animation: 2,
+	})
+	encoded, err := cCmdTransformPlayer.MarshalBinary()
+	is.NoErr(err)
+	// header (18) + id (8) + transform (2 + 2) + velocity (1 + 1) + facing
+	// (1) + animation (1) = 34; with fixed int32s it would be 18 + 8 + 4 *
+	// 6 = 50.
+	is.Equal(len(encoded), 34)
+}
+
+func TestFixedPoint(t *testing.T) {
+	is := is.New(t)
+
+	testCases := []struct {
+		v    float64
+		want protocol.NetworkedInt32
+	}{
+		{0, 0},
+		{1, protocol.FixedPointScale},
+		{-1.5, -protocol.FixedPointScale * 3 / 2},
+		// NOTE(blukai): sub-pixel positions survive
+		{227.0625, 227*protocol.FixedPointScale + 1},
+		{math.Inf(1), math.MaxInt32},
+		{math.Inf(-1), math.MinInt32},
+		{math.NaN(), 0},
+	}
+
+	for _, tc := range testCases {
+		got := protocol.ToFixedPoint(tc.v)
+		is.Equal(got, tc.want)
+		if !math.IsInf(tc.v, 0) && !math.IsNaN(tc.v) {
+			is.Equal(protocol.FromFixedPoint(got), tc.v)
+		}
+	}
+}
+
+func TestNetworkedJoinEncoding(t *testing.T) {
+	is := is.New(t)
+
+	testCases := []struct {
+		id       uint64
+		nonce    uint64
+		lobby    string
+		name     string
+		metadata []protocol.NetworkedMetadata
+	}{
+		{0, 0, "", "", nil},
+		{42, 24, "party", "Mina", []protocol.NetworkedMetadata{{Key: "version", Value: "1"}}},
+		{math.MaxUint64, math.MaxUint64, "party 🎉", "Мина 🧙", []protocol.NetworkedMetadata{{}, {Key: "color", Value: "red"}}},
+	}
+
+	for _, tc := range testCases {
+		original := protocol.NetworkedJoin{
+			ID:       protocol.NetworkedID(tc.id),
+			Nonce:    protocol.NetworkedID(tc.nonce),
+			Lobby:    protocol.NetworkedString(tc.lobby),
+			Name:     protocol.NetworkedString(tc.name),
+			Metadata: tc.metadata,
+		}
+
+		// NOTE(blukai): version and features; id and nonce; lobby,
+		// name and metadata count; metadata entries.
+		maxSize := binary.MaxVarintLen64*2 + protocol.NetworkedIDSize*2 + binary.MaxVarintLen32*3 + len(tc.lobby) + len(tc.name)
+		for _, md := range tc.metadata {
+			maxSize += binary.MaxVarintLen32*2 + len(md.Key) + len(md.Value)
+		}
+
+		encoded, err := original.MarshalBinary()
+		is.NoErr(err)
+		is.True(len(encoded) <= maxSize)
+
+		var decoded protocol.NetworkedJoin
+		err = decoded.UnmarshalBinary(encoded)
+		is.NoErr(err)
+		is.Equal(original, decoded)
+	}
+
+	t.Run("too much metadata", func(t *testing.T) {
+		join := protocol.NetworkedJoin{
+			Metadata: make([]protocol.NetworkedMetadata, protocol.PlayerMetadataMaxLen+1),
+		}
+		_, err := join.MarshalBinary()
+		is.True(err != nil)
+	})
+}
+
+func TestPlayerInfoValidation(t *testing.T) {
+	is := is.New(t)
+
+	valid := protocol.NetworkedPlayerInfo{Name: "Мина 🧙"}
+	is.NoErr(valid.Validate())
+
+	tooLong := protocol.NetworkedPlayerInfo{Name: protocol.NetworkedString(strings.Repeat("a", protocol.PlayerNameMaxLen+1))}
+	is.True(tooLong.Validate() != nil)
+
+	invalid := protocol.NetworkedPlayerInfo{Name: "\xff"}
+	is.True(invalid.Validate() != nil)
+}
+
+func TestNetworkedPlayerSnapshotEncoding(t *testing.T) {
+	is := is.New(t)
+
+	testCases := []int{0, 1, 42, protocol.PlayerSnapshotMaxLen}
+
+	for _, tc := range testCases {
+		original := protocol.NetworkedPlayerSnapshot{
+			Time:    math.MaxUint64,
+			Players: make([]protocol.NetworkedTransformPlayer, tc),
+		}
+		// NOTE(blukai): values that take the max amount of bytes
+		for i := range original.Players {
+			original.Players[i] = protocol.NetworkedTransformPlayer{
+				ID: protocol.NetworkedID(math.MaxUint64 - uint64(i)),
+				Transform: protocol.NetworkedInt32Vector2{
+					X: protocol.NetworkedInt32(math.MinInt32 + int32(i)),
+					Y: protocol.NetworkedInt32(math.MaxInt32 - int32(i)),
+				},
+				Velocity: protocol.NetworkedInt32Vector2{
+					X: protocol.NetworkedInt32(math.MinInt32 + int32(i)),
+					Y: protocol.NetworkedInt32(math.MaxInt32 - int32(i)),
+				},
+				Facing:    protocol.NetworkedInt32(math.MinInt32 + int32(i)),
+				Animation: protocol.NetworkedInt32(math.MaxInt32 - int32(i)),
+			}
+		}
+
+		encoded, err := original.MarshalBinary()
+		is.NoErr(err)
+		is.True(protocol.CmdHeaderSize+len(encoded) <= protocol.CmdMaxSize)
+
+		var decoded protocol.NetworkedPlayerSnapshot
+		err = decoded.UnmarshalBinary(encoded)
+		is.NoErr(err)
+		is.Equal(original, decoded)
+	}
+
+	t.Run("too many players", func(t *testing.T) {
+		original := protocol.NetworkedPlayerSnapshot{
+			Players: make([]protocol.NetworkedTransformPlayer, protocol.PlayerSnapshotMaxLen+1),
+		}
+		_, err := original.MarshalBinary()
+		is.True(err != nil)
+	})
+}
+
+func TestNetworkedSessionEncoding(t *testing.T) {
+	is := is.New(t)
+
+	testCases := []struct {
+		seed     int32
+		settings []protocol.NetworkedRunSetting
+	}{
+		{0, []protocol.NetworkedRunSetting{}},
+		{math.MinInt32, []protocol.NetworkedRunSetting{{Key: "mode", Value: ""}}},
+		{math.MaxInt32, []protocol.NetworkedRunSetting{
+			{Key: "mode", Value: "nightmare"},
+			{Key: "", Value: "🎉"},
+		}},
+	}
+
+	for _, tc := range testCases {
+		original := protocol.NetworkedSession{
+			Token:    42,
+			Seed:     protocol.NetworkedInt32(tc.seed),
+			Settings: tc.settings,
+		}
+
+		encoded, err := original.MarshalBinary()
+		is.NoErr(err)
+
+		decoded := protocol.NetworkedSession{}
+		err = decoded.UnmarshalBinary(encoded)
+		is.NoErr(err)
+
+		is.Equal(original, decoded)
+	}
+}
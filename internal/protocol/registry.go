@@ -0,0 +1,176 @@
+package protocol
+
+import (
+	"fmt"
+	"reflect"
+
+	"github.com/blukai/noitaparty/internal/debug"
+	"github.com/blukai/noitaparty/internal/ptr"
+)
+
+type cmdSpec struct {
+	// newBody is nil if cmd does not have a body.
+	newBody func() CmdBody
+}
+
+func newBody[T any, PT interface {
+	*T
+	CmdBody
+}]() CmdBody {
+	return PT(new(T))
+}
+
+// cmdRegistry declares body types of cmds; adding a cmd means adding it here
+// (and to NewXxx constructors below).
+var cmdRegistry = map[uint16]cmdSpec{
+	// client
+	CCmdPing:            {newBody: newBody[NetworkedPing]},
+	CCmdJoin:            {newBody: newBody[NetworkedJoin]},
+	CCmdTransformPlayer: {newBody: newBody[NetworkedTransformPlayer]},
+	CCmdKeepAlive:       {},
+	CCmdAck:             {},
+	CCmdChat:            {newBody: newBody[NetworkedChat]},
+	CCmdLeave:           {},
+	CCmdHello:           {newBody: newBody[NetworkedHello]},
+	// server
+	SCmdPong:           {newBody: newBody[NetworkedPong]},
+	SCmdSetSeed:        {newBody: newBody[NetworkedSession]},
+	SCmdPlayerSnapshot: {newBody: newBody[NetworkedPlayerSnapshot]},
+	SCmdSpawnPlayer:    {newBody: newBody[NetworkedPlayerInfo]},
+	SCmdDespawnPlayer:  {newBody: newBody[NetworkedID]},
+	SCmdAck:            {},
+	SCmdKeepAlive:      {},
+	SCmdChat:           {newBody: newBody[NetworkedChat]},
+	SCmdHello:          {newBody: newBody[NetworkedHello]},
+	SCmdError:          {newBody: newBody[NetworkedError]},
+}
+
+// NewCmd constructs cmd with the given body. body must be of the type that is
+// registered for cmd, or nil if cmd does not have a body. consider using
+// NewXxx constructors instead.
+func NewCmd(cmd uint16, body CmdBody) Cmd {
+	spec, ok := cmdRegistry[cmd]
+	debug.Assert(ok, fmt.Sprintf("unregistered cmd: %d", cmd))
+	if spec.newBody == nil {
+		debug.Assert(body == nil, fmt.Sprintf("cmd %d does not have a body", cmd))
+	} else {
+		debug.Assert(
+			reflect.TypeOf(body) == reflect.TypeOf(spec.newBody()),
+			fmt.Sprintf("invalid body of cmd %d: %T", cmd, body),
+		)
+	}
+
+	return Cmd{
+		Header: &CmdHeader{Cmd: cmd},
+		Body:   body,
+	}
+}
+
+func NewCCmdPing(clientTime uint64) Cmd {
+	return NewCmd(CCmdPing, &NetworkedPing{
+		ClientTime: NetworkedUint64(clientTime),
+	})
+}
+
+// NewCCmdJoin constructs join of this version of the protocol with all of the
+// supported features.
+func NewCCmdJoin(id uint64, nonce uint64, lobby string) Cmd {
+	return NewCmd(CCmdJoin, &NetworkedJoin{
+		Version:  ProtocolVersion,
+		Features: NetworkedUint64(SupportedFeatures),
+		ID:       NetworkedID(id),
+		Nonce:    NetworkedID(nonce),
+		Lobby:    NetworkedString(lobby),
+	})
+}
+
+func NewCCmdTransformPlayer(player NetworkedTransformPlayer) Cmd {
+	return NewCmd(CCmdTransformPlayer, &player)
+}
+
+func NewCCmdKeepAlive() Cmd {
+	return NewCmd(CCmdKeepAlive, nil)
+}
+
+func NewCCmdAck() Cmd {
+	return NewCmd(CCmdAck, nil)
+}
+
+func NewCCmdChat(id uint64, kind uint64, text string) Cmd {
+	return NewCmd(CCmdChat, &NetworkedChat{
+		ID:   NetworkedID(id),
+		Kind: NetworkedUint64(kind),
+		Text: NetworkedString(text),
+	})
+}
+
+func NewCCmdLeave() Cmd {
+	return NewCmd(CCmdLeave, nil)
+}
+
+func NewCCmdHello(version uint64, features uint64) Cmd {
+	return NewCmd(CCmdHello, &NetworkedHello{
+		Version:  NetworkedUint64(version),
+		Features: NetworkedUint64(features),
+	})
+}
+
+func NewSCmdPong(clientTime uint64, serverTime uint64) Cmd {
+	return NewCmd(SCmdPong, &NetworkedPong{
+		ClientTime: NetworkedUint64(clientTime),
+		ServerTime: NetworkedUint64(serverTime),
+	})
+}
+
+func NewSCmdSetSeed(token uint64, seed int32, settings []NetworkedRunSetting) Cmd {
+	return NewCmd(SCmdSetSeed, &NetworkedSession{
+		Token:    NetworkedID(token),
+		Seed:     NetworkedInt32(seed),
+		Settings: settings,
+	})
+}
+
+func NewSCmdPlayerSnapshot(time uint64, players []NetworkedTransformPlayer) Cmd {
+	return NewCmd(SCmdPlayerSnapshot, &NetworkedPlayerSnapshot{
+		Time:    NetworkedUint64(time),
+		Players: players,
+	})
+}
+
+func NewSCmdSpawnPlayer(info NetworkedPlayerInfo) Cmd {
+	return NewCmd(SCmdSpawnPlayer, &info)
+}
+
+func NewSCmdDespawnPlayer(id uint64) Cmd {
+	return NewCmd(SCmdDespawnPlayer, ptr.To(NetworkedID(id)))
+}
+
+func NewSCmdAck() Cmd {
+	return NewCmd(SCmdAck, nil)
+}
+
+func NewSCmdKeepAlive() Cmd {
+	return NewCmd(SCmdKeepAlive, nil)
+}
+
+func NewSCmdChat(id uint64, kind uint64, text string) Cmd {
+	return NewCmd(SCmdChat, &NetworkedChat{
+		ID:   NetworkedID(id),
+		Kind: NetworkedUint64(kind),
+		Text: NetworkedString(text),
+	})
+}
+
+func NewSCmdHello(version uint64, features uint64) Cmd {
+	return NewCmd(SCmdHello, &NetworkedHello{
+		Version:  NetworkedUint64(version),
+		Features: NetworkedUint64(features),
+	})
+}
+
+func NewSCmdError(code uint64, message string) Cmd {
+	return NewCmd(SCmdError, &NetworkedError{
+		Code:    NetworkedUint64(code),
+		Message: NetworkedString(message),
+	})
+}
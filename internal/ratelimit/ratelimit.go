@@ -0,0 +1,39 @@
+package ratelimit
+
+import "time"
+
+// Bucket is a token bucket: it holds up to burst tokens and gains one token
+// every interval; each allowed event takes a token. Bucket is not safe for
+// concurrent use.
+type Bucket struct {
+	interval time.Duration
+	burst    int
+	tokens   int
+	// last is when the bucket gained a token the last time.
+	last time.Time
+}
+
+func NewBucket(interval time.Duration, burst int) *Bucket {
+	return &Bucket{
+		interval: interval,
+		burst:    burst,
+		tokens:   burst,
+	}
+}
+
+// Allow takes a token if there's one and reports whether it did.
+func (b *Bucket) Allow(now time.Time) bool {
+	if b.last.IsZero() {
+		b.last = now
+	}
+	if n := now.Sub(b.last) / b.interval; n > 0 {
+		b.tokens = min(b.burst, b.tokens+int(n))
+		b.last = b.last.Add(n * b.interval)
+	}
+
+	if b.tokens == 0 {
+		return false
+	}
+	b.tokens -= 1
+	return true
+}
@@ -0,0 +1,37 @@
+package ratelimit_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/blukai/noitaparty/internal/ratelimit"
+	"github.com/matryer/is"
+)
+
+func TestBucket(t *testing.T) {
+	is := is.New(t)
+
+	bucket := ratelimit.NewBucket(time.Second, 3)
+	now := time.Now()
+
+	// burst is allowed right away
+
+	for range 3 {
+		is.True(bucket.Allow(now))
+	}
+	is.True(!bucket.Allow(now))
+
+	// one token is gained per interval
+
+	is.True(!bucket.Allow(now.Add(time.Millisecond * 999)))
+	is.True(bucket.Allow(now.Add(time.Second)))
+	is.True(!bucket.Allow(now.Add(time.Second)))
+
+	// bucket does not hold more than burst
+
+	later := now.Add(time.Hour)
+	for range 3 {
+		is.True(bucket.Allow(later))
+	}
+	is.True(!bucket.Allow(later))
+}
@@ -0,0 +1,166 @@
+package reliable
+
+import (
+	"errors"
+	"time"
+
+	"github.com/blukai/noitaparty/internal/protocol"
+)
+
+// NOTE(blukai): this is a minimal reliable-ordered delivery on top of
+// unreliable transport. every reliable cmd gets a sequence number; receiver
+// acknowledges cmds cumulatively (by sending next expected sequence number);
+// sender re-sends unacknowledged cmds until they are acknowledged or until
+// it gives up.
+
+const (
+	// RetransmitTimeout is how long sender waits for an ack before
+	// re-sending a cmd.
+	RetransmitTimeout = time.Millisecond * 200
+	// MaxAttempts is how many times a cmd is sent before sender gives up.
+	MaxAttempts = 15
+	// recvWindow limits the amount of out-of-order cmds that are buffered.
+	recvWindow = 256
+)
+
+var ErrMaxAttempts = errors.New("reliable cmd was not acknowledged")
+
+// seqLess reports whether a comes before b, accounting for wraparound.
+func seqLess(a, b uint16) bool {
+	return int16(a-b) < 0
+}
+
+type pendingCmd struct {
+	cmd      protocol.Cmd
+	sentAt   time.Time
+	attempts int
+}
+
+// Channel holds reliable delivery state of one peer. Channel is not safe for
+// concurrent use.
+type Channel struct {
+	nextSendSeq uint16
+	// pending holds sent, but not yet acknowledged cmds ordered by seq.
+	pending []pendingCmd
+
+	nextRecvSeq uint16
+	// recvBuf holds reliable cmds that arrived out of order.
+	recvBuf map[uint16]protocol.Cmd
+}
+
+func NewChannel() *Channel {
+	return &Channel{
+		recvBuf: make(map[uint16]protocol.Cmd),
+	}
+}
+
+// stamp attaches current cumulative ack to the header.
+func (ch *Channel) stamp(header *protocol.CmdHeader) {
+	header.Flags |= protocol.CmdFlagAck
+	header.Ack = ch.nextRecvSeq
+}
+
+// Send prepares cmd for reliable delivery. returned cmd must be sent to the
+// peer; it'll be returned from Retransmit until peer acknowledges it.
+func (ch *Channel) Send(cmd protocol.Cmd, now time.Time) protocol.Cmd {
+	// NOTE(blukai): header is copied because it is modified here and on
+	// each retransmit; caller may share the original (e.g. in broadcasts).
+	header := *cmd.Header
+	header.Flags |= protocol.CmdFlagReliable
+	header.Seq = ch.nextSendSeq
+	ch.stamp(&header)
+	ch.nextSendSeq += 1
+
+	cmd = protocol.Cmd{Header: &header, Body: cmd.Body}
+	ch.pending = append(ch.pending, pendingCmd{
+		cmd:      cmd,
+		sentAt:   now,
+		attempts: 1,
+	})
+	return copyCmd(cmd)
+}
+
+// copyCmd makes a copy of cmd's header so that cmd can be marshaled while the
+// channel keeps modifying the original.
+func copyCmd(cmd protocol.Cmd) protocol.Cmd {
+	header := *cmd.Header
+	return protocol.Cmd{Header: &header, Body: cmd.Body}
+}
+
+// Ack constructs a standalone acknowledgement cmd of type cmdType (CCmdAck or
+// SCmdAck).
+func (ch *Channel) Ack(cmdType uint16) protocol.Cmd {
+	cmd := protocol.NewCmd(cmdType, nil)
+	ch.stamp(cmd.Header)
+	return cmd
+}
+
+// Recv processes ack carried by cmd and returns cmds that are ready to be
+// handled, in order. duplicate reliable cmds are dropped; unreliable cmds are
+// returned as is. ack reports whether peer must be sent an acknowledgement.
+func (ch *Channel) Recv(cmd protocol.Cmd) (cmds []protocol.Cmd, ack bool) {
+	if cmd.Header.Flags&protocol.CmdFlagAck != 0 {
+		n := 0
+		for n < len(ch.pending) && seqLess(ch.pending[n].cmd.Header.Seq, cmd.Header.Ack) {
+			n += 1
+		}
+		ch.pending = ch.pending[n:]
+	}
+
+	if cmd.Header.Flags&protocol.CmdFlagReliable == 0 {
+		return []protocol.Cmd{cmd}, false
+	}
+
+	seq := cmd.Header.Seq
+	switch {
+	case seqLess(seq, ch.nextRecvSeq):
+		// duplicate; peer probably did not receive our ack
+		return nil, true
+	case seq != ch.nextRecvSeq:
+		// out of order; hold on to it until the gap is filled
+		if seqLess(seq, ch.nextRecvSeq+recvWindow) {
+			ch.recvBuf[seq] = cmd
+		}
+		return nil, true
+	}
+
+	cmds = append(cmds, cmd)
+	ch.nextRecvSeq += 1
+	for {
+		next, ok := ch.recvBuf[ch.nextRecvSeq]
+		if !ok {
+			break
+		}
+		delete(ch.recvBuf, ch.nextRecvSeq)
+		cmds = append(cmds, next)
+		ch.nextRecvSeq += 1
+	}
+	return cmds, true
+}
+
+// Retransmit returns cmds that were not acknowledged within
+// RetransmitTimeout and must be re-sent. ErrMaxAttempts is returned if peer
+// did not acknowledge a cmd after MaxAttempts.
+func (ch *Channel) Retransmit(now time.Time) ([]protocol.Cmd, error) {
+	var cmds []protocol.Cmd
+	for i := range ch.pending {
+		pending := &ch.pending[i]
+		if now.Sub(pending.sentAt) < RetransmitTimeout {
+			continue
+		}
+		if pending.attempts >= MaxAttempts {
+			return nil, ErrMaxAttempts
+		}
+
+		ch.stamp(pending.cmd.Header)
+		pending.sentAt = now
+		pending.attempts += 1
+		cmds = append(cmds, copyCmd(pending.cmd))
+	}
+	return cmds, nil
+}
+
+// Pending returns the amount of cmds that are waiting to be acknowledged.
+func (ch *Channel) Pending() int {
+	return len(ch.pending)
+}
@@ -0,0 +1,136 @@
+package reliable_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/blukai/noitaparty/internal/protocol"
+	"github.com/blukai/noitaparty/internal/reliable"
+	"github.com/matryer/is"
+)
+
+func makeCmd(cmd uint16) protocol.Cmd {
+	return protocol.Cmd{
+		Header: &protocol.CmdHeader{Cmd: cmd},
+	}
+}
+
+func TestInOrder(t *testing.T) {
+	is := is.New(t)
+
+	sender := reliable.NewChannel()
+	receiver := reliable.NewChannel()
+	now := time.Now()
+
+	for i := range 3 {
+		sent := sender.Send(makeCmd(uint16(i)), now)
+		is.Equal(sent.Header.Seq, uint16(i))
+
+		cmds, ack := receiver.Recv(sent)
+		is.True(ack)
+		is.Equal(len(cmds), 1)
+		is.Equal(cmds[0].Header.Cmd, uint16(i))
+	}
+	is.Equal(sender.Pending(), 3)
+
+	// receiver acknowledges everything at once
+
+	cmds, ack := sender.Recv(receiver.Ack(protocol.SCmdAck))
+	is.True(!ack)
+	is.Equal(len(cmds), 1)
+	is.Equal(sender.Pending(), 0)
+}
+
+func TestOutOfOrderAndDuplicates(t *testing.T) {
+	is := is.New(t)
+
+	sender := reliable.NewChannel()
+	receiver := reliable.NewChannel()
+	now := time.Now()
+
+	first := sender.Send(makeCmd(1), now)
+	second := sender.Send(makeCmd(2), now)
+
+	// second arrives first and is held back
+
+	cmds, ack := receiver.Recv(second)
+	is.True(ack)
+	is.Equal(len(cmds), 0)
+
+	// first fills the gap and both are delivered in order
+
+	cmds, ack = receiver.Recv(first)
+	is.True(ack)
+	is.Equal(len(cmds), 2)
+	is.Equal(cmds[0].Header.Cmd, uint16(1))
+	is.Equal(cmds[1].Header.Cmd, uint16(2))
+
+	// duplicate is dropped, but must still be acknowledged
+
+	cmds, ack = receiver.Recv(first)
+	is.True(ack)
+	is.Equal(len(cmds), 0)
+}
+
+func TestUnreliable(t *testing.T) {
+	is := is.New(t)
+
+	receiver := reliable.NewChannel()
+
+	for range 2 {
+		cmds, ack := receiver.Recv(makeCmd(1))
+		is.True(!ack)
+		is.Equal(len(cmds), 1)
+	}
+}
+
+func TestRetransmit(t *testing.T) {
+	is := is.New(t)
+
+	sender := reliable.NewChannel()
+	now := time.Now()
+
+	sender.Send(makeCmd(1), now)
+
+	cmds, err := sender.Retransmit(now)
+	is.NoErr(err)
+	is.Equal(len(cmds), 0)
+
+	for i := 1; i < reliable.MaxAttempts; i++ {
+		now = now.Add(reliable.RetransmitTimeout)
+		cmds, err = sender.Retransmit(now)
+		is.NoErr(err)
+		is.Equal(len(cmds), 1)
+		is.Equal(cmds[0].Header.Seq, uint16(0))
+	}
+
+	now = now.Add(reliable.RetransmitTimeout)
+	_, err = sender.Retransmit(now)
+	is.Equal(err, reliable.ErrMaxAttempts)
+}
+
+func TestSeqWraparound(t *testing.T) {
+	is := is.New(t)
+
+	sender := reliable.NewChannel()
+	receiver := reliable.NewChannel()
+	now := time.Now()
+
+	for i := range 1 << 16 {
+		sent := sender.Send(makeCmd(1), now)
+		cmds, _ := receiver.Recv(sent)
+		is.Equal(len(cmds), 1)
+
+		if i%1024 == 0 {
+			sender.Recv(receiver.Ack(protocol.SCmdAck))
+		}
+	}
+
+	sent := sender.Send(makeCmd(1), now)
+	is.Equal(sent.Header.Seq, uint16(0))
+	cmds, _ := receiver.Recv(sent)
+	is.Equal(len(cmds), 1)
+
+	sender.Recv(receiver.Ack(protocol.SCmdAck))
+	is.Equal(sender.Pending(), 0)
+}
@@ -3,32 +3,59 @@ local ffi = require("ffi")
 ffi.cdef([[
 typedef unsigned char GoUint8;
 typedef int GoInt32;
+typedef float GoFloat32;
 typedef GoInt32 GoInt;
 typedef unsigned long long GoUint64;
 
 typedef struct PlayerIter {} PlayerIter;
-
-typedef struct Int32Vector2 {
-	GoInt32 X;
-	GoInt32 Y;
-} Int32Vector2;
-typedef struct TransformPlayer {
-	GoUint64     ID;
-	Int32Vector2 Transform;
-} TransformPlayer;
+typedef struct DeltaPlayerIter {} DeltaPlayerIter;
+
+typedef struct Player {
+	GoUint64  ID;
+	GoFloat32 X;
+	GoFloat32 Y;
+	GoFloat32 VX;
+	GoFloat32 VY;
+	GoInt32   Facing;
+	GoInt32   Animation;
+} Player;
+typedef struct DeltaPlayer {
+	Player  Player;
+	GoUint8 Despawned;
+	GoUint8 _[7];
+} DeltaPlayer;
+typedef struct ChatMessage {
+	GoUint64 ID;
+	GoInt32  Kind;
+	GoInt32  Len;
+	char     Text[256];
+} ChatMessage;
+typedef struct ChatIter {} ChatIter;
 
 char* LastErr();
 void Connect(char* network, char* address);
-GoInt32 SendCCmdJoinRecvSCmdSetSeed(GoUint64 id);
-void SendCCmdTransformPlayer(GoUint64 id, GoInt32 x, GoInt32 y);
+void Disconnect();
+GoInt32 SendCCmdJoinRecvSCmdSetSeed(GoUint64 id, char* lobby, char* name, char** metadataKeys, char** metadataValues, GoInt32 metadataLen);
+char* GetRunSetting(char* key);
+char* GetPlayerName(GoUint64 id);
+char* GetPlayerMetadata(GoUint64 id, char* key);
+void SendCCmdTransformPlayer(GoUint64 id, GoFloat32 x, GoFloat32 y, GoFloat32 vx, GoFloat32 vy, GoInt32 facing, GoInt32 animation);
+GoUint8 GetLatency(float* rtt, float* jitter, float* clockOffset);
 
 GoInt IterLen(void* iterPtr);
 GoInt IterPos(void* iterPtr);
 GoUint8 IterHasNext(void* iterPtr);
 void IterFree(void* iterPtr);
 
-TransformPlayer* GetNextPlayerInIter(void* iter_ptr);
+Player* GetNextPlayerInIter(void* iter_ptr);
 PlayerIter* GetPlayerIter();
+
+DeltaPlayer* GetNextDeltaPlayerInIter(void* iter_ptr);
+DeltaPlayerIter* GetDeltaPlayerIter();
+
+char* SendCCmdChat(GoInt32 kind, char* text);
+ChatMessage* GetNextChatMessageInIter(void* iter_ptr);
+ChatIter* GetChatIter();
 ]])
 
 local client = ffi.load("mods/noitaparty/files/client.dll")
@@ -56,15 +83,97 @@ function mod.Connect(network, address)
 	return mod.LastErr()
 end
 
--- GoInt32 SendCCmdJoinRecvSCmdSetSeed(GoUint64 id);
-function mod.SendCCmdJoinRecvSCmdSetSeed(id)
-	local set_seed = client.SendCCmdJoinRecvSCmdSetSeed(id)
+-- void Disconnect();
+--
+-- it is safe to call Disconnect if client is not connected.
+mod.Disconnect = client.Disconnect
+
+-- GoInt32 SendCCmdJoinRecvSCmdSetSeed(GoUint64 id, char* lobby, char* name, char** metadataKeys, char** metadataValues, GoInt32 metadataLen);
+--
+-- metadata is a table of string keys and string values.
+function mod.SendCCmdJoinRecvSCmdSetSeed(id, lobby, name, metadata)
+	local len = 0
+	for _ in pairs(metadata) do
+		len = len + 1
+	end
+
+	-- NOTE(blukai): cstrings are referenced from strs so that they are not
+	-- garbage collected before the call returns.
+	local strs = {}
+	local keys = ffi.new("char*[?]", len)
+	local values = ffi.new("char*[?]", len)
+	local i = 0
+	for key, value in pairs(metadata) do
+		local key_str, value_str = cstring(key), cstring(tostring(value))
+		table.insert(strs, key_str)
+		table.insert(strs, value_str)
+		keys[i] = key_str
+		values[i] = value_str
+		i = i + 1
+	end
+
+	local set_seed = client.SendCCmdJoinRecvSCmdSetSeed(id, cstring(lobby), cstring(name), keys, values, len)
 	return set_seed, mod.LastErr()
 end
 
--- void SendCCmdTransformPlayer(GoUint64 id, GoInt32 x, GoInt32 y);
+-- char* GetRunSetting(char* key);
+--
+-- returns nil if server did not define the setting.
+function mod.GetRunSetting(key)
+	local value = client.GetRunSetting(cstring(key))
+	if value ~= nil then
+		return ffi.string(value)
+	end
+	return nil
+end
+
+-- char* GetPlayerName(GoUint64 id);
+--
+-- returns nil if player is not known.
+function mod.GetPlayerName(id)
+	local name = client.GetPlayerName(id)
+	if name ~= nil then
+		return ffi.string(name)
+	end
+	return nil
+end
+
+-- char* GetPlayerMetadata(GoUint64 id, char* key);
+--
+-- returns nil if player is not known or if it did not define the key.
+function mod.GetPlayerMetadata(id, key)
+	local value = client.GetPlayerMetadata(id, cstring(key))
+	if value ~= nil then
+		return ffi.string(value)
+	end
+	return nil
+end
+
+-- must match protocol.Facing... constants
+mod.FACING_UNKNOWN = 0
+mod.FACING_RIGHT = 1
+mod.FACING_LEFT = -1
+
+-- void SendCCmdTransformPlayer(GoUint64 id, GoFloat32 x, GoFloat32 y, GoFloat32 vx, GoFloat32 vy, GoInt32 facing, GoInt32 animation);
 mod.SendCCmdTransformPlayer = client.SendCCmdTransformPlayer
 
+-- GoUint8 GetLatency(float* rtt, float* jitter, float* clockOffset);
+--
+-- returns nil if latency is not known yet; values are in milliseconds.
+function mod.GetLatency()
+	local rtt = ffi.new("float[1]")
+	local jitter = ffi.new("float[1]")
+	local clock_offset = ffi.new("float[1]")
+	if client.GetLatency(rtt, jitter, clock_offset) ~= 1 then
+		return nil
+	end
+	return {
+		rtt = rtt[0],
+		jitter = jitter[0],
+		clock_offset = clock_offset[0],
+	}
+end
+
 -- GoInt IterLen(void* iterPtr);
 mod.IterLen = client.IterLen
 
@@ -85,4 +194,41 @@ mod.GetNextPlayerInIter = client.GetNextPlayerInIter
 -- void* GetPlayerIter();
 mod.GetPlayerIter = client.GetPlayerIter
 
+-- DeltaPlayer* GetNextDeltaPlayerInIter(void* iter_ptr);
+mod.GetNextDeltaPlayerInIter = client.GetNextDeltaPlayerInIter
+
+-- DeltaPlayerIter* GetDeltaPlayerIter();
+mod.GetDeltaPlayerIter = client.GetDeltaPlayerIter
+
+-- must match protocol.ChatKind... constants
+mod.CHAT_KIND_MESSAGE = 0
+mod.CHAT_KIND_EMOTE = 1
+
+-- char* SendCCmdChat(GoInt32 kind, char* text);
+--
+-- returns nil if message was sent, otherwise the reason why it was not (e.g.
+-- messages are sent too fast); the reason is not fatal.
+function mod.SendCCmdChat(kind, text)
+	local err = client.SendCCmdChat(kind, cstring(text))
+	if err ~= nil then
+		return ffi.string(err)
+	end
+	return nil
+end
+
+-- ChatMessage* GetNextChatMessageInIter(void* iter_ptr);
+--
+-- returns nil if iter is exhausted; otherwise returns id of the sender, kind
+-- and text of the message.
+function mod.GetNextChatMessageInIter(iter_ptr)
+	local message = client.GetNextChatMessageInIter(iter_ptr)
+	if message == nil then
+		return nil
+	end
+	return message.ID, message.Kind, ffi.string(message.Text, message.Len)
+end
+
+-- ChatIter* GetChatIter();
+mod.GetChatIter = client.GetChatIter
+
 return mod
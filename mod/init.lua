@@ -8,16 +8,55 @@ local client = dofile_once("mods/noitaparty/files/client.lua")
 -- NOTE(blukai): might need this later
 -- dofile_once("data/scripts/lib/utilities.lua")
 
+-- NOTE(blukai): sent to other players as metadata; bump it on release.
+local MOD_VERSION = "0.1.0"
+
 local STEAM_ID = nil
 
+-- NOTE(blukai): client disconnects once the run is over
+local DISCONNECTED = false
+
 -- TODO(blukai): find a nicer way to do error reporting, more sane
 local UNPRINTED_ERR = nil
 local CRITICAL_ERROR_ENDING = ". can't continue. seek help!"
 
-local LAST_PLAYER_X = nil
-local LAST_PLAYER_Y = nil
+local LAST_PLAYER_STATE = nil
+
+-- NOTE(blukai): gui is used to show latency
+local GUI = nil
 
 local OTHER_PLAYER_ENTITIES = {}
+-- NOTE(blukai): key is player's id; value is the id of animation that is being
+-- played.
+local OTHER_PLAYER_ANIMATIONS = {}
+-- NOTE(blukai): key is player's id; value is true if player's entity got a
+-- name tag. names arrive separately from transforms, possibly later.
+local OTHER_PLAYER_LABELED = {}
+
+-- NOTE(blukai): animations are sent as ids; ids are indices in this table
+-- (0 means unknown). only append to it, otherwise players with different
+-- versions of the mod would see each other play wrong animations.
+local ANIMATIONS = {
+	"stand",
+	"walk",
+	"run",
+	"jump_up",
+	"jump_fall",
+	"land",
+	"fly_idle",
+	"fly_move",
+	"crouch",
+	"kick",
+	"throw",
+	"knockback",
+	"lie",
+	"eat",
+	"burn",
+}
+local ANIMATION_IDS = {}
+for id, name in ipairs(ANIMATIONS) do
+	ANIMATION_IDS[name] = id
+end
 
 -- TODO(blukai): introduce some kind of global state "object" that would be more
 -- convenient to deal with then a bunch of individual globals.
@@ -30,6 +69,91 @@ local function get_player_entity()
 	return players[1]
 end
 
+local function get_player_state(player_entity)
+	-- NOTE(blukai): transform's horizontal scale is negative when player
+	-- faces left
+	local x, y, _, scale_x = EntityGetTransform(player_entity)
+	local facing = client.FACING_RIGHT
+	if scale_x < 0 then
+		facing = client.FACING_LEFT
+	end
+
+	local vx, vy = 0, 0
+	local character_data = EntityGetFirstComponent(player_entity, "CharacterDataComponent")
+	if character_data ~= nil then
+		vx, vy = ComponentGetValue2(character_data, "mVelocity")
+	end
+
+	local animation = 0
+	local sprite = EntityGetFirstComponent(player_entity, "SpriteComponent", "character")
+	if sprite ~= nil then
+		animation = ANIMATION_IDS[ComponentGetValue2(sprite, "rect_animation")] or 0
+	end
+
+	return {
+		x = x,
+		y = y,
+		vx = vx,
+		vy = vy,
+		facing = facing,
+		animation = animation,
+	}
+end
+
+-- label_player_entity shows player's name above its entity; it returns false
+-- if name is not known yet.
+local function label_player_entity(player_entity, id)
+	local name = client.GetPlayerName(id)
+	if name == nil or name == "" then
+		return false
+	end
+
+	EntityAddComponent2(player_entity, "SpriteComponent", {
+		_tags = "noitaparty_name",
+		image_file = "data/fonts/font_pixel_white.xml",
+		is_text_sprite = true,
+		text = name,
+		-- NOTE(blukai): font is roughly 4 pixels wide (scaled by half)
+		offset_x = #name * 2,
+		offset_y = 28,
+		special_scale_x = 0.5,
+		special_scale_y = 0.5,
+		-- NOTE(blukai): entity is mirrored when player faces left, text
+		-- must not be
+		has_special_scale = true,
+		update_transform = true,
+		update_transform_rotation = false,
+		alpha = 0.8,
+		z_index = -9000,
+	})
+	return true
+end
+
+local function player_state_changed(prev, next)
+	if prev == nil then
+		return true
+	end
+	for key, value in pairs(next) do
+		if prev[key] ~= value then
+			return true
+		end
+	end
+	return false
+end
+
+-- disconnect lets others know that player is gone and removes other players
+-- from the world; nothing is sent or received afterwards.
+local function disconnect()
+	client.Disconnect()
+	for id, other_player_entity in pairs(OTHER_PLAYER_ENTITIES) do
+		EntityKill(other_player_entity)
+		OTHER_PLAYER_ENTITIES[id] = nil
+		OTHER_PLAYER_ANIMATIONS[id] = nil
+		OTHER_PLAYER_LABELED[id] = nil
+	end
+	DISCONNECTED = true
+end
+
 -- Called in order upon loading a new(?) game:
 function OnModPreInit()
 	STEAM_ID = steam_api.ISteamUser.GetSteamID()
@@ -39,16 +163,26 @@ function OnModPreInit()
 		return
 	end
 
+	-- NOTE(blukai): client.dll stays loaded when a new game is started; it
+	-- may still be connected to the previous one.
+	client.Disconnect()
+
 	-- TODO(blukai): unhardcode server address, make it configurable via
 	-- in-game settings or something
-	local connect_err = client.Connect("udp4", "noitaparty.ayaya.moe:5000")
+	-- NOTE(blukai): "udp" prefers ipv4 and falls back to ipv6 if server has no
+	-- ipv4 address.
+	local connect_err = client.Connect("udp", "noitaparty.ayaya.moe:5000")
 	if connect_err ~= nil then
 		UNPRINTED_ERR = "could not connect: " .. connect_err .. CRITICAL_ERROR_ENDING
 		print(UNPRINTED_ERR)
 		return
 	end
 
-	local seed, seed_err = client.SendCCmdJoinRecvSCmdSetSeed(STEAM_ID)
+	-- NOTE(blukai): players that join the same lobby play in the same world
+	local lobby = ModSettingGet("noitaparty.lobby") or ""
+	local name = steam_api.ISteamFriends.GetPersonaName() or ""
+	local metadata = { mod_version = MOD_VERSION }
+	local seed, seed_err = client.SendCCmdJoinRecvSCmdSetSeed(STEAM_ID, lobby, name, metadata)
 	if seed_err ~= nil then
 		UNPRINTED_ERR = "could not get server seed: " .. seed_err .. CRITICAL_ERROR_ENDING
 		print(UNPRINTED_ERR)
@@ -65,7 +199,14 @@ function OnModPostInit() end
 function OnPlayerSpawned(player_entity) end
 
 -- Called when the player dies
-function OnPlayerDied(player_entity) end
+function OnPlayerDied(player_entity)
+	if STEAM_ID == nil or DISCONNECTED then
+		return
+	end
+
+	-- NOTE(blukai): run is over; let others know right away
+	disconnect()
+end
 
 -- Called once the game world is initialized. Doesn't ensure any chunks around the player.
 function OnWorldInitialized() end
@@ -75,55 +216,133 @@ function OnWorldPreUpdate() end
 
 -- Called *every* time the game has finished updating the world
 function OnWorldPostUpdate()
-	if STEAM_ID == nil then
+	if STEAM_ID == nil or DISCONNECTED then
 		return
 	end
 
+	-- NOTE(blukai): client failed to connect or join; LastErr would report
+	-- the same error again.
 	if UNPRINTED_ERR ~= nil then
 		GamePrintImportant("noitaparty error", UNPRINTED_ERR)
 		UNPRINTED_ERR = nil
+		disconnect()
+		return
 	end
 
+	-- NOTE(blukai): client does not recover from errors it reports (e.g.
+	-- server rejected it); print it once and stop.
 	local last_err = client.LastErr()
-	if client.LastErr() ~= nil then
-		GamePrint("noitaparty error: " .. last_err)
+	if last_err ~= nil then
+		GamePrintImportant("noitaparty error", last_err .. CRITICAL_ERROR_ENDING)
+		disconnect()
 		return
 	end
 
+	local latency = client.GetLatency()
+	if latency ~= nil then
+		if GUI == nil then
+			GUI = GuiCreate()
+		end
+		GuiStartFrame(GUI)
+		GuiText(GUI, 2, 2, string.format("ping: %dms (±%dms)", math.floor(latency.rtt), math.floor(latency.jitter)))
+	end
+
+	local chat_iter_ptr = client.GetChatIter()
+	while client.IterHasNext(chat_iter_ptr) do
+		local id, kind, text = client.GetNextChatMessageInIter(chat_iter_ptr)
+		local sender = client.GetPlayerName(id)
+		if sender == nil or sender == "" then
+			-- NOTE(blukai): tostring of 64 bit cdata number ends with ULL
+			sender = tostring(id):gsub("ULL$", "")
+		end
+		if kind == client.CHAT_KIND_EMOTE then
+			GamePrint("* " .. sender .. " " .. text)
+		else
+			GamePrint(sender .. ": " .. text)
+		end
+	end
+	client.IterFree(chat_iter_ptr)
+
 	local player_entity = get_player_entity()
 	if player_entity ~= nil then
-		local x, y = EntityGetTransform(player_entity)
-		-- NOTE(blukai): it turns out that x and y are actually floats..
-		-- do we care about precision?
-		x, y = math.floor(x), math.floor(y)
-		if x ~= LAST_PLAYER_X or y ~= LAST_PLAYER_Y then
-			client.SendCCmdTransformPlayer(STEAM_ID, x, y)
-			LAST_PLAYER_X, LAST_PLAYER_Y = x, y
+		-- NOTE(blukai): positions are floats; they are sent with
+		-- sub-pixel precision.
+		local state = get_player_state(player_entity)
+		if player_state_changed(LAST_PLAYER_STATE, state) then
+			client.SendCCmdTransformPlayer(
+				STEAM_ID,
+				state.x,
+				state.y,
+				state.vx,
+				state.vy,
+				state.facing,
+				state.animation
+			)
+			LAST_PLAYER_STATE = state
 		end
 	end
 
-	local player_iter_ptr = client.GetPlayerIter()
-	while client.IterHasNext(player_iter_ptr) do
-		local other_player = client.GetNextPlayerInIter(player_iter_ptr)
+	-- NOTE(blukai): delta iter only yields players that moved or left since
+	-- the previous frame
+	local delta_player_iter_ptr = client.GetDeltaPlayerIter()
+	while client.IterHasNext(delta_player_iter_ptr) do
+		local delta_player = client.GetNextDeltaPlayerInIter(delta_player_iter_ptr)
+		local other_player = delta_player.Player
 
 		local id = tonumber(other_player.ID)
 		assert(type(id) == "number")
-		local x = tonumber(other_player.Transform.X)
-		assert(type(x) == "number")
-		local y = tonumber(other_player.Transform.Y)
-		assert(type(y) == "number")
 
 		local other_player_entity = OTHER_PLAYER_ENTITIES[id]
-		if other_player_entity == nil then
-			other_player_entity = EntityLoad("mods/noitaparty/files/player.xml", x, y)
-			OTHER_PLAYER_ENTITIES[id] = other_player_entity
+		if delta_player.Despawned == 1 then
+			if other_player_entity ~= nil then
+				EntityKill(other_player_entity)
+				OTHER_PLAYER_ENTITIES[id] = nil
+				OTHER_PLAYER_ANIMATIONS[id] = nil
+				OTHER_PLAYER_LABELED[id] = nil
+			end
 		else
-			EntitySetTransform(other_player_entity, x, y)
+			if other_player_entity == nil then
+				local x = tonumber(other_player.X)
+				assert(type(x) == "number")
+				local y = tonumber(other_player.Y)
+				assert(type(y) == "number")
+
+				other_player_entity = EntityLoad("mods/noitaparty/files/player.xml", x, y)
+				OTHER_PLAYER_ENTITIES[id] = other_player_entity
+			end
+
+			local animation = tonumber(other_player.Animation)
+			local animation_name = ANIMATIONS[animation]
+			if animation_name ~= nil and OTHER_PLAYER_ANIMATIONS[id] ~= animation then
+				GamePlayAnimation(other_player_entity, animation_name, 0)
+				OTHER_PLAYER_ANIMATIONS[id] = animation
+			end
 		end
 	end
+	client.IterFree(delta_player_iter_ptr)
 
-	-- TODO(blukai): remove disconnected entities
+	-- NOTE(blukai): players are moved every frame, not only when their state
+	-- changes; positions are smoothed between received states.
+	local player_iter_ptr = client.GetPlayerIter()
+	while client.IterHasNext(player_iter_ptr) do
+		local other_player = client.GetNextPlayerInIter(player_iter_ptr)
 
+		local id = tonumber(other_player.ID)
+		assert(type(id) == "number")
+
+		local other_player_entity = OTHER_PLAYER_ENTITIES[id]
+		if other_player_entity ~= nil then
+			local scale_x = 1
+			if other_player.Facing == client.FACING_LEFT then
+				scale_x = -1
+			end
+			EntitySetTransform(other_player_entity, other_player.X, other_player.Y, 0, scale_x, 1)
+
+			if not OTHER_PLAYER_LABELED[id] then
+				OTHER_PLAYER_LABELED[id] = label_player_entity(other_player_entity, other_player.ID)
+			end
+		end
+	end
 	client.IterFree(player_iter_ptr)
 end
 
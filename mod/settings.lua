@@ -17,7 +17,16 @@ dofile("data/scripts/lib/mod_settings.lua") -- see this file for documentation o
 
 local mod_id = "noitaparty" -- This should match the name of your mod's folder.
 mod_settings_version = 1 -- This is a magic global that can be used to migrate settings to new mod versions. call mod_settings_get_version() before mod_settings_update() to get the old value.
-mod_settings = {}
+mod_settings = {
+	{
+		id = "lobby",
+		ui_name = "Lobby",
+		ui_description = "Players that join the same lobby play together. Leave empty to join the default lobby.",
+		value_default = "",
+		text_max_length = 64,
+		scope = MOD_SETTING_SCOPE_NEW_GAME,
+	},
+}
 
 -- This function is called to ensure the correct setting values are visible to the game via ModSettingGet(). your mod's settings don't work if you don't have a function like this defined in settings.lua.
 -- This function is called: